@@ -0,0 +1,231 @@
+// Стенд для приема Prometheus remote_write: записывает запросы настоящего Prometheus,
+// генерирует синтетические запросы и отправляет записанные запросы на бэкенд.
+//
+//	go run ./cmd/remote-write-harness -record data/remote-write -listen :9201
+//	go run ./cmd/remote-write-harness -generate data/remote-write -count 300
+//	go run ./cmd/remote-write-harness -send data/remote-write -url http://localhost:8080/api/v1/write -key $KEY
+//
+// Запрос хранится в файле NNNNNN.bin как есть: WriteRequest в protobuf, сжатый snappy
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func main() {
+	record := flag.String("record", "", "directory to record incoming remote_write requests to")
+	listen := flag.String("listen", ":9201", "address to receive requests on with -record")
+	generate := flag.String("generate", "", "directory to write synthetic requests to")
+	count := flag.Int("count", 300, "number of requests to generate")
+	send := flag.String("send", "", "directory with recorded requests to send")
+	url := flag.String("url", "http://localhost:8080/api/v1/write", "remote_write endpoint for -send")
+	key := flag.String("key", os.Getenv("INGEST_API_KEY"), "API key for -send")
+	interval := flag.Duration("interval", time.Second, "delay between requests for -send and scrape step for -generate")
+	loop := flag.Bool("loop", false, "start over after the last request with -send")
+	flag.Parse()
+
+	var err error
+	switch {
+	case *record != "":
+		err = recordRequests(*record, *listen)
+	case *generate != "":
+		err = generateRequests(*generate, *count, *interval)
+	case *send != "":
+		err = sendRequests(*send, *url, *key, *interval, *loop)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Прием запросов и сохранение тел без изменений
+func recordRequests(dir, addr string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	n := 0
+	http.HandleFunc("/api/v1/write", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		n++
+		path := filepath.Join(dir, fmt.Sprintf("%06d.bin", n))
+		if err := os.WriteFile(path, body, 0o644); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Recorded %s (%d bytes)", path, len(body))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	log.Printf("Recording remote_write requests on %s/api/v1/write into %s", addr, dir)
+	return http.ListenAndServe(addr, nil)
+}
+
+// Отправка записанных запросов по порядку имен файлов
+func sendRequests(dir, url, key string, interval time.Duration, loop bool) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.bin"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no recorded requests in %s", dir)
+	}
+	sort.Strings(files)
+
+	for {
+		for _, path := range files {
+			body, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/x-protobuf")
+			req.Header.Set("Content-Encoding", "snappy")
+			req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+			if key != "" {
+				req.Header.Set("Authorization", "Bearer "+key)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+			answer, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			log.Printf("Sent %s: %s %s", filepath.Base(path), resp.Status, answer)
+			time.Sleep(interval)
+		}
+		if !loop {
+			return nil
+		}
+	}
+}
+
+type label struct {
+	name, value string
+}
+
+type series struct {
+	labels []label
+	value  float64
+}
+
+// Границы корзин гистограммы времени ответа, секунды
+var durationBuckets = []float64{0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// Синтетические запросы: счетчики заказов и ошибок, гистограмма времени ответа и число
+// пользователей по регионам, как их отдавал бы сервис после сбора с шагом interval
+func generateRequests(dir string, count int, interval time.Duration) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	rng := rand.New(rand.NewSource(1))
+	regions := []string{"Москва", "Санкт-Петербург", "Казань"}
+	errorTypes := []string{"Server Error", "Timeout"}
+
+	orders := make(map[string]float64)
+	errors := make(map[string]float64)
+	buckets := make([]float64, len(durationBuckets)+1)
+	var durationSum, requests float64
+	start := time.Now().Add(-time.Duration(count) * interval)
+
+	for i := 1; i <= count; i++ {
+		var request []series
+		for _, region := range regions {
+			orders[region] += float64(rng.Intn(5))
+			request = append(request,
+				series{[]label{{"__name__", "orders_total"}, {"instance", "shop:9100"}, {"region", region}}, orders[region]},
+				series{[]label{{"__name__", "active_users"}, {"instance", "shop:9100"}, {"region", region}}, float64(800 + rng.Intn(400))})
+		}
+
+		n := 50 + rng.Intn(100)
+		for j := 0; j < n; j++ {
+			duration := math.Exp(rng.NormFloat64()*0.6 - 2) // около 135 мс
+			durationSum += duration
+			requests++
+			for b, bound := range durationBuckets {
+				if duration <= bound {
+					buckets[b]++
+				}
+			}
+		}
+		buckets[len(durationBuckets)] = requests
+		for b, bound := range durationBuckets {
+			request = append(request, series{[]label{{"__name__", "http_request_duration_seconds_bucket"}, {"instance", "shop:9100"}, {"le", fmt.Sprint(bound)}}, buckets[b]})
+		}
+		request = append(request,
+			series{[]label{{"__name__", "http_request_duration_seconds_bucket"}, {"instance", "shop:9100"}, {"le", "+Inf"}}, requests},
+			series{[]label{{"__name__", "http_request_duration_seconds_sum"}, {"instance", "shop:9100"}}, durationSum},
+			series{[]label{{"__name__", "http_request_duration_seconds_count"}, {"instance", "shop:9100"}}, requests})
+
+		for _, errorType := range errorTypes {
+			if rng.Intn(3) == 0 {
+				errors[errorType]++
+			}
+			request = append(request, series{[]label{{"__name__", "errors_total"}, {"instance", "shop:9100"}, {"type", errorType}}, errors[errorType]})
+		}
+
+		timestamp := start.Add(time.Duration(i)*interval).UnixNano() / int64(time.Millisecond)
+		body := snappy.Encode(nil, encodeWriteRequest(request, timestamp))
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%06d.bin", i)), body, 0o644); err != nil {
+			return err
+		}
+	}
+	log.Printf("Generated %d requests in %s", count, dir)
+	return nil
+}
+
+// WriteRequest: timeseries = 1; TimeSeries: labels = 1, samples = 2; Label: name = 1, value = 2;
+// Sample: value = 1, timestamp = 2
+func encodeWriteRequest(request []series, timestamp int64) []byte {
+	var buf []byte
+	for _, s := range request {
+		var ts []byte
+		for _, l := range s.labels {
+			var msg []byte
+			msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.name)
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, msg)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, ts)
+	}
+	return buf
+}
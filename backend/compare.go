@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Сдвиги сравнения по именам
+var compareOffsets = map[string]time.Duration{
+	"day":  24 * time.Hour,
+	"week": week,
+}
+
+// Значение метрики за диапазон [From, To). Value равен nil, если данных нет
+type CompareRange struct {
+	From  int64    `json:"from"`
+	To    int64    `json:"to"`
+	Value *float64 `json:"value"`
+}
+
+// Точка сравнения: интервал текущего диапазона и соответствующий интервал прошлого
+type ComparePoint struct {
+	Timestamp         int64    `json:"timestamp"`
+	Value             *float64 `json:"value"`
+	PreviousTimestamp int64    `json:"previousTimestamp"`
+	PreviousValue     *float64 `json:"previousValue"`
+	Delta             *float64 `json:"delta"`
+	DeltaPercent      *float64 `json:"deltaPercent"`
+}
+
+// Сравнение метрики за диапазон с тем же диапазоном, сдвинутым в прошлое на Offset секунд
+type CompareResult struct {
+	Metric       string         `json:"metric"`
+	Offset       int64          `json:"offset"`
+	Resolution   int64          `json:"resolution"` // Точность границ диапазонов, секунды
+	Current      CompareRange   `json:"current"`
+	Previous     CompareRange   `json:"previous"`
+	Delta        *float64       `json:"delta"`
+	DeltaPercent *float64       `json:"deltaPercent"` // nil, если прошлое значение нулевое или неизвестно
+	Points       []ComparePoint `json:"points,omitempty"`
+}
+
+// Сдвиг сравнения: day, week или длительность (7d, 36h)
+func parseCompareOffset(value string) (time.Duration, error) {
+	if value == "" {
+		return week, nil
+	}
+	if offset, ok := compareOffsets[value]; ok {
+		return offset, nil
+	}
+	offset, err := parseLongDuration(strings.TrimPrefix(value, "-"))
+	if err != nil || offset < tickInterval || offset%tickInterval != 0 {
+		return 0, fmt.Errorf("invalid offset: %q, expected day, week or a duration like 7d", value)
+	}
+	return offset, nil
+}
+
+// Самое грубое разрешение уровня хранения, по которому выровнены границы обоих диапазонов.
+// Так сводки уровня не захватывают данные за пределами диапазонов
+func compareResolution(resolutions []time.Duration, from, to int64, offset time.Duration) time.Duration {
+	aligned := func(ts int64, resolution time.Duration) bool {
+		return bucketStart(ts, resolution) == ts
+	}
+	for i := len(resolutions) - 1; i > 0; i-- {
+		resolution := resolutions[i]
+		if aligned(from, resolution) && aligned(to, resolution) &&
+			aligned(from-int64(offset/time.Second), resolution) && aligned(to-int64(offset/time.Second), resolution) {
+			return resolution
+		}
+	}
+	return resolutions[0]
+}
+
+// Значение метрики за диапазон: сводки всех интервалов объединяются в одну
+func rangeValue(rollups []*Rollup, metric historyMetric) *float64 {
+	if len(rollups) == 0 {
+		return nil
+	}
+	total := newRollup(rollups[0].Start)
+	for _, rollup := range rollups {
+		total.Merge(rollup)
+	}
+	metrics := total.Metrics()
+	value := metric.value(total, &metrics)
+	return &value
+}
+
+// Абсолютная и относительная (в процентах) разница значений
+func deltas(current, previous *float64) (*float64, *float64) {
+	if current == nil || previous == nil {
+		return nil, nil
+	}
+	delta := *current - *previous
+	if *previous == 0 {
+		return &delta, nil
+	}
+	percent := delta / *previous * 100
+	return &delta, &percent
+}
+
+func compareMetric(store *TieredStore, metric historyMetric, from, to int64, offset, step time.Duration) (CompareResult, error) {
+	shift := int64(offset / time.Second)
+	resolution := compareResolution(store.Resolutions(), from, to, offset)
+	result := CompareResult{
+		Metric:     metric.name,
+		Offset:     shift,
+		Resolution: int64(resolution / time.Second),
+		Current:    CompareRange{From: from, To: to},
+		Previous:   CompareRange{From: from - shift, To: to - shift},
+	}
+
+	current, err := store.Buckets(resolution, from, to)
+	if err != nil {
+		return result, err
+	}
+	previous, err := store.Buckets(resolution, from-shift, to-shift)
+	if err != nil {
+		return result, err
+	}
+	result.Current.Value = rangeValue(current, metric)
+	result.Previous.Value = rangeValue(previous, metric)
+	result.Delta, result.DeltaPercent = deltas(result.Current.Value, result.Previous.Value)
+
+	if step == 0 {
+		return result, nil
+	}
+
+	// Поинтервальное сравнение: интервалы прошлого диапазона сдвинуты ровно на offset
+	start := stepStart(from, step)
+	currentSteps, err := historyRollupsFor(store, step, start, to)
+	if err != nil {
+		return result, err
+	}
+	previousSteps, err := historyRollupsFor(store, step, start-shift, to-shift)
+	if err != nil {
+		return result, err
+	}
+	for ts := start; ts < to; ts = nextStep(ts, step) {
+		point := ComparePoint{Timestamp: ts, PreviousTimestamp: ts - shift}
+		if rollup := currentSteps[ts]; rollup != nil {
+			point.Value = rangeValue([]*Rollup{rollup}, metric)
+		}
+		if rollup := previousSteps[ts-shift]; rollup != nil {
+			point.PreviousValue = rangeValue([]*Rollup{rollup}, metric)
+		}
+		point.Delta, point.DeltaPercent = deltas(point.Value, point.PreviousValue)
+		result.Points = append(result.Points, point)
+	}
+	return result, nil
+}
+
+// Обработчик /metrics/compare/:metric - метрика за диапазон ?from= ... ?to= (по умолчанию
+// с начала текущих суток до текущей минуты) против того же диапазона ?offset= назад
+func handleCompareMetrics(c *gin.Context) {
+	metric, ok := findHistoryMetric(c.Param("metric"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":        fmt.Sprintf("unknown metric: %q, valid metrics: %s", c.Param("metric"), strings.Join(historyMetricNames(), ", ")),
+			"validMetrics": historyMetricNames(),
+		})
+		return
+	}
+
+	offset, err := parseCompareOffset(c.Query("offset"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	to := bucketStart(now.Unix(), time.Minute)
+	if value := c.Query("to"); value != "" {
+		if to, err = parseTimeParam(value, now); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	from := bucketStart(now.Unix(), 24*time.Hour)
+	if value := c.Query("from"); value != "" {
+		if from, err = parseTimeParam(value, now); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if from >= to {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	var step time.Duration
+	if value := c.Query("step"); value != "" {
+		step, err = parseLongDuration(value)
+		if err != nil || step < tickInterval || step%tickInterval != 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid step: %q", value)})
+			return
+		}
+		if points := (to - from) / int64(step/time.Second); points > maxHistoryPoints {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("range contains %d points, at most %d allowed: increase step or narrow the range", points, maxHistoryPoints),
+			})
+			return
+		}
+	}
+
+	result, err := compareMetric(metricsStore, metric, from, to, offset, step)
+	if err != nil {
+		log.Printf("Error reading historical data: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read historical data"})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
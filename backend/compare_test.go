@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseCompareOffset(t *testing.T) {
+	cases := []struct {
+		value  string
+		offset time.Duration
+		valid  bool
+	}{
+		{"", week, true},
+		{"day", 24 * time.Hour, true},
+		{"week", week, true},
+		{"7d", week, true},
+		{"-7d", week, true},
+		{"36h", 36 * time.Hour, true},
+		{"1500ms", 0, false},
+		{"month", 0, false},
+	}
+	for _, c := range cases {
+		offset, err := parseCompareOffset(c.value)
+		if (err == nil) != c.valid || offset != c.offset {
+			t.Fatalf("%q: offset %v, error %v", c.value, offset, err)
+		}
+	}
+}
+
+func TestDeltas(t *testing.T) {
+	cases := []struct {
+		name              string
+		current, previous *float64
+		delta, percent    *float64
+	}{
+		{"no current value", nil, floatPtr(10), nil, nil},
+		{"no previous value", floatPtr(10), nil, nil, nil},
+		{"zero base", floatPtr(5), floatPtr(0), floatPtr(5), nil},
+		{"growth", floatPtr(15), floatPtr(10), floatPtr(5), floatPtr(50)},
+		{"decline", floatPtr(5), floatPtr(10), floatPtr(-5), floatPtr(-50)},
+	}
+	for _, c := range cases {
+		delta, percent := deltas(c.current, c.previous)
+		got, want := formatValues([]*float64{delta, percent}), formatValues([]*float64{c.delta, c.percent})
+		if got != want {
+			t.Fatalf("%s: delta and percent %s, want %s", c.name, got, want)
+		}
+	}
+}
+
+func TestCompareResolution(t *testing.T) {
+	useUTC(t)
+	resolutions := []time.Duration{time.Second, time.Minute, time.Hour, 24 * time.Hour}
+	day := int64(24 * 3600)
+	start := historyTestStart
+
+	cases := []struct {
+		name       string
+		from, to   int64
+		offset     time.Duration
+		resolution time.Duration
+	}{
+		{"whole days, day offset", start + day, start + 2*day, 24 * time.Hour, 24 * time.Hour},
+		{"whole days, week offset", start + 7*day, start + 8*day, week, 24 * time.Hour},
+		{"whole days, offset in hours", start + 2*day, start + 3*day, 36 * time.Hour, time.Hour},
+		{"whole hours", start + day + 3600, start + day + 3*3600, 24 * time.Hour, time.Hour},
+		{"whole minutes", start + day + 1800, start + day + 3660, 24 * time.Hour, time.Minute},
+		{"unaligned seconds", start + day + 1, start + day + 3600, 24 * time.Hour, time.Second},
+	}
+	for _, c := range cases {
+		if resolution := compareResolution(resolutions, c.from, c.to, c.offset); resolution != c.resolution {
+			t.Fatalf("%s: resolution %v, want %v", c.name, resolution, c.resolution)
+		}
+	}
+}
+
+func formatComparePoint(p ComparePoint) string {
+	return fmt.Sprintf("%d/%d %s", p.Timestamp, p.PreviousTimestamp, formatValues([]*float64{p.Value, p.PreviousValue, p.Delta, p.DeltaPercent}))
+}
+
+func TestCompareMetric(t *testing.T) {
+	useUTC(t)
+	// Продажи тика равны номеру часа от начала истории, в первый час - нулевые
+	store := newSeededTieredStore(t, 8*24, func(hour int) int { return hour })
+	sales, _ := findHistoryMetric("sales")
+	hour := int64(3600)
+	day := 24 * hour
+	start := historyTestStart
+
+	cases := []struct {
+		name     string
+		from, to int64
+		offset   string
+		step     time.Duration
+
+		resolution        int64
+		current, previous *float64
+		delta, percent    *float64
+		points            []ComparePoint
+	}{
+		{
+			name: "day offset by hour",
+			from: start + day, to: start + day + 3*hour, offset: "day", step: time.Hour,
+			resolution: 3600,
+			current:    floatPtr(300), previous: floatPtr(12),
+			delta: floatPtr(288), percent: floatPtr(2400),
+			points: []ComparePoint{
+				// Прошлый час с нулевыми продажами: разница есть, процента нет
+				{Timestamp: start + day, PreviousTimestamp: start, Value: floatPtr(96), PreviousValue: floatPtr(0), Delta: floatPtr(96)},
+				{Timestamp: start + day + hour, PreviousTimestamp: start + hour, Value: floatPtr(100), PreviousValue: floatPtr(4), Delta: floatPtr(96), DeltaPercent: floatPtr(2400)},
+				{Timestamp: start + day + 2*hour, PreviousTimestamp: start + 2*hour, Value: floatPtr(104), PreviousValue: floatPtr(8), Delta: floatPtr(96), DeltaPercent: floatPtr(1200)},
+			},
+		},
+		{
+			name: "week offset by hour",
+			from: start + 7*day, to: start + 7*day + 2*hour, offset: "week", step: time.Hour,
+			resolution: 3600,
+			current:    floatPtr(1348), previous: floatPtr(4),
+			delta: floatPtr(1344), percent: floatPtr(33600),
+			points: []ComparePoint{
+				{Timestamp: start + 7*day, PreviousTimestamp: start, Value: floatPtr(672), PreviousValue: floatPtr(0), Delta: floatPtr(672)},
+				{Timestamp: start + 7*day + hour, PreviousTimestamp: start + hour, Value: floatPtr(676), PreviousValue: floatPtr(4), Delta: floatPtr(672), DeltaPercent: floatPtr(16800)},
+			},
+		},
+		{
+			name: "relative week offset",
+			from: start + 7*day, to: start + 7*day + 2*hour, offset: "-7d",
+			resolution: 3600,
+			current:    floatPtr(1348), previous: floatPtr(4),
+			delta: floatPtr(1344), percent: floatPtr(33600),
+		},
+		{
+			name: "whole day by day",
+			from: start + day, to: start + 2*day, offset: "day", step: 24 * time.Hour,
+			resolution: 24 * 3600,
+			current:    floatPtr(3408), previous: floatPtr(1104),
+			delta: floatPtr(2304), percent: floatPtr(2304.0 / 1104 * 100),
+			points: []ComparePoint{
+				{Timestamp: start + day, PreviousTimestamp: start, Value: floatPtr(3408), PreviousValue: floatPtr(1104), Delta: floatPtr(2304), DeltaPercent: floatPtr(2304.0 / 1104 * 100)},
+			},
+		},
+		{
+			// Границы не выровнены по часу: диапазоны считаются по минутам, без соседних тиков
+			name: "unaligned range",
+			from: start + day + 1800, to: start + day + hour + 900, offset: "day",
+			resolution: 60,
+			current:    floatPtr(73), previous: floatPtr(1),
+			delta: floatPtr(72), percent: floatPtr(7200),
+		},
+		{
+			name: "no previous data",
+			from: start, to: start + 2*hour, offset: "day", step: time.Hour,
+			resolution: 3600,
+			current:    floatPtr(4),
+			points: []ComparePoint{
+				{Timestamp: start, PreviousTimestamp: start - day, Value: floatPtr(0)},
+				{Timestamp: start + hour, PreviousTimestamp: start + hour - day, Value: floatPtr(4)},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			offset, err := parseCompareOffset(c.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := compareMetric(store, sales, c.from, c.to, offset, c.step)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Offset != int64(offset/time.Second) || result.Resolution != c.resolution {
+				t.Fatalf("offset %d, resolution %d, want resolution %d", result.Offset, result.Resolution, c.resolution)
+			}
+			if result.Previous.From != c.from-result.Offset || result.Previous.To != c.to-result.Offset {
+				t.Fatalf("previous range %d..%d", result.Previous.From, result.Previous.To)
+			}
+			got := formatValues([]*float64{result.Current.Value, result.Previous.Value, result.Delta, result.DeltaPercent})
+			want := formatValues([]*float64{c.current, c.previous, c.delta, c.percent})
+			if got != want {
+				t.Fatalf("current, previous, delta, percent %s, want %s", got, want)
+			}
+
+			if len(result.Points) != len(c.points) {
+				t.Fatalf("expected %d points, got %d", len(c.points), len(result.Points))
+			}
+			for i, point := range result.Points {
+				if got, want := formatComparePoint(point), formatComparePoint(c.points[i]); got != want {
+					t.Fatalf("point %d: %s, want %s", i, got, want)
+				}
+			}
+		})
+	}
+}
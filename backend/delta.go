@@ -0,0 +1,153 @@
+package main
+
+import "strconv"
+
+// Вычисление дельт между соседними тиками. Для карт в дельту попадают
+// только измененные записи, удаленные ключи передаются как null
+
+// Измененные KPI верхнего уровня
+func kpiDelta(prev, cur *MetricsData) map[string]interface{} {
+	delta := make(map[string]interface{})
+	if prev.ActiveUsers != cur.ActiveUsers {
+		delta["activeUsers"] = cur.ActiveUsers
+	}
+	if prev.RequestsPerSecond != cur.RequestsPerSecond {
+		delta["requestsPerSecond"] = cur.RequestsPerSecond
+	}
+	if prev.ResponseTimeMs != cur.ResponseTimeMs {
+		delta["responseTimeMs"] = cur.ResponseTimeMs
+	}
+	if prev.Latency != cur.Latency {
+		delta["latency"] = cur.Latency
+	}
+	if prev.ConversionRate != cur.ConversionRate {
+		delta["conversionRate"] = cur.ConversionRate
+	}
+	if prev.Sales != cur.Sales {
+		delta["sales"] = cur.Sales
+	}
+	if prev.ServerLoad != cur.ServerLoad {
+		delta["serverLoad"] = cur.ServerLoad
+	}
+	if prev.DatabaseConnections != cur.DatabaseConnections {
+		delta["databaseConnections"] = cur.DatabaseConnections
+	}
+	return delta
+}
+
+// Изменения в секции ошибок
+func errorsDelta(prev, cur *MetricsData) map[string]interface{} {
+	delta := make(map[string]interface{})
+	if prev.ErrorRate != cur.ErrorRate {
+		delta["errorRate"] = cur.ErrorRate
+	}
+	if changed := intMapDelta(prev.ErrorsByType, cur.ErrorsByType); len(changed) > 0 {
+		delta["errorsByType"] = changed
+	}
+	return delta
+}
+
+// Изменения в воронке конверсии
+func funnelDelta(prev, cur *MetricsData) map[string]interface{} {
+	delta := make(map[string]interface{})
+	changed := make(map[string]interface{})
+	p, c := prev.ConversionFunnel, cur.ConversionFunnel
+	if p.Visitors != c.Visitors {
+		changed["visitors"] = c.Visitors
+	}
+	if p.ProductViews != c.ProductViews {
+		changed["productViews"] = c.ProductViews
+	}
+	if p.AddedToCart != c.AddedToCart {
+		changed["addedToCart"] = c.AddedToCart
+	}
+	if p.BeganCheckout != c.BeganCheckout {
+		changed["beganCheckout"] = c.BeganCheckout
+	}
+	if p.PurchasedItems != c.PurchasedItems {
+		changed["purchasedItems"] = c.PurchasedItems
+	}
+	if len(changed) > 0 {
+		delta["conversionFunnel"] = changed
+	}
+	return delta
+}
+
+// Изменения в региональных данных
+func regionalDelta(prev, cur *MetricsData) map[string]interface{} {
+	delta := make(map[string]interface{})
+	changed := make(map[string]interface{})
+	for key, value := range cur.RegionalData {
+		if old, ok := prev.RegionalData[key]; !ok || old != value {
+			changed[key] = value
+		}
+	}
+	for key := range prev.RegionalData {
+		if _, ok := cur.RegionalData[key]; !ok {
+			changed[key] = nil
+		}
+	}
+	if len(changed) > 0 {
+		delta["regionalData"] = changed
+	}
+	return delta
+}
+
+// Изменения в источниках трафика
+func sourcesDelta(prev, cur *MetricsData) map[string]interface{} {
+	delta := make(map[string]interface{})
+	if changed := intMapDelta(prev.SourcesData, cur.SourcesData); len(changed) > 0 {
+		delta["sourcesData"] = changed
+	}
+	return delta
+}
+
+// Изменения в одном историческом периоде
+func historyDelta(key string, prev, cur map[int64]HistoricalMetrics) map[string]interface{} {
+	delta := make(map[string]interface{})
+	changed := make(map[string]interface{})
+	for ts, value := range cur {
+		if old, ok := prev[ts]; !ok || old != value {
+			changed[strconv.FormatInt(ts, 10)] = value
+		}
+	}
+	for ts := range prev {
+		if _, ok := cur[ts]; !ok {
+			changed[strconv.FormatInt(ts, 10)] = nil
+		}
+	}
+	if len(changed) > 0 {
+		delta[key] = changed
+	}
+	return delta
+}
+
+// Изменения в карте счетчиков
+func intMapDelta(prev, cur map[string]int) map[string]interface{} {
+	changed := make(map[string]interface{})
+	for key, value := range cur {
+		if old, ok := prev[key]; !ok || old != value {
+			changed[key] = value
+		}
+	}
+	for key := range prev {
+		if _, ok := cur[key]; !ok {
+			changed[key] = nil
+		}
+	}
+	return changed
+}
+
+// Дельты всех секций. Пустая секция означает отсутствие изменений
+func deltaSections(prev, cur *MetricsData) [numTopics]section {
+	var sections [numTopics]section
+	sections[topicIndex(TopicKPI)] = sectionFromMap(kpiDelta(prev, cur))
+	sections[topicIndex(TopicErrors)] = sectionFromMap(errorsDelta(prev, cur))
+	sections[topicIndex(TopicRegional)] = sectionFromMap(regionalDelta(prev, cur))
+	sections[topicIndex(TopicSources)] = sectionFromMap(sourcesDelta(prev, cur))
+	sections[topicIndex(TopicFunnel)] = sectionFromMap(funnelDelta(prev, cur))
+	sections[topicIndex(TopicHistoricalHourly)] = sectionFromMap(historyDelta("hourly", prev.HistoricalData.Hourly, cur.HistoricalData.Hourly))
+	sections[topicIndex(TopicHistoricalDaily)] = sectionFromMap(historyDelta("daily", prev.HistoricalData.Daily, cur.HistoricalData.Daily))
+	sections[topicIndex(TopicHistoricalWeekly)] = sectionFromMap(historyDelta("weekly", prev.HistoricalData.Weekly, cur.HistoricalData.Weekly))
+	return sections
+}
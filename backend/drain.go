@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Причина закрытия при остановке. Клиент должен переподключиться, балансировщик
+// направит его на другой инстанс
+const drainCloseReason = "Server restarting, please reconnect"
+
+// Остановка приема клиентов и закрытие текущих соединений перед завершением работы.
+// Сначала /health начинает отвечать 503, и только через delay, когда балансировщик
+// уже вывел инстанс из ротации, клиенты закрываются: иначе переподключения могли бы
+// снова попасть на этот инстанс
+func drainClients(delay, timeout time.Duration) {
+	hub.StartDraining()
+	if delay > 0 {
+		log.Printf("Health check is failing, waiting %v before closing clients...", delay)
+		time.Sleep(delay)
+	}
+
+	log.Printf("Draining %d clients (timeout %v)...", hub.Count(), timeout)
+	started := time.Now()
+	result := hub.Drain(timeout, websocket.CloseServiceRestart, drainCloseReason)
+	log.Printf("Drain finished in %v: %d of %d clients closed cleanly",
+		time.Since(started).Round(time.Millisecond), result.Clean, result.Clients)
+}
+
+// Отказ в подключении во время остановки. true, если ответ уже отправлен
+func rejectWhileDraining(c *gin.Context) bool {
+	if !hub.Draining() {
+		return false
+	}
+	c.Header("Retry-After", "1")
+	c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is draining"})
+	return true
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Выгрузка читается частями, поэтому допускает больше интервалов, чем ответ API истории
+const maxExportPoints = 1000000
+
+// Интервалов в одной части выгрузки: столько сводок одновременно находится в памяти
+const exportChunkSteps = 500
+
+// Формат выгрузки: расширение файла и тип содержимого
+type exportFormat struct {
+	name        string
+	contentType string
+	newWriter   func(w io.Writer) exportWriter
+}
+
+var exportFormats = []exportFormat{
+	{"csv", "text/csv; charset=utf-8", newCSVExportWriter},
+	{"ndjson", "application/x-ndjson", newNDJSONExportWriter},
+	{"parquet", "application/vnd.apache.parquet", newParquetExportWriter},
+}
+
+// Строка выгрузки в длинном формате: значение одной серии за один интервал.
+// Для итога метрики Dimension и Key пусты
+type ExportRow struct {
+	Timestamp int64    `json:"timestamp"`
+	Time      string   `json:"time"`
+	Metric    string   `json:"metric"`
+	Dimension string   `json:"dimension,omitempty"`
+	Key       string   `json:"key,omitempty"`
+	Value     *float64 `json:"value"`
+}
+
+// Потоковая запись строк. Flush вызывается после каждой части выгрузки
+type exportWriter interface {
+	WriteRow(row ExportRow) error
+	Flush() error
+	Close() error
+}
+
+type csvExportWriter struct {
+	csv    *csv.Writer
+	header bool
+}
+
+func newCSVExportWriter(w io.Writer) exportWriter {
+	return &csvExportWriter{csv: csv.NewWriter(w)}
+}
+
+func (e *csvExportWriter) WriteRow(row ExportRow) error {
+	if !e.header {
+		e.header = true
+		if err := e.csv.Write([]string{"timestamp", "time", "metric", "dimension", "key", "value"}); err != nil {
+			return err
+		}
+	}
+	value := ""
+	if row.Value != nil {
+		value = strconv.FormatFloat(*row.Value, 'f', -1, 64)
+	}
+	return e.csv.Write([]string{strconv.FormatInt(row.Timestamp, 10), row.Time, row.Metric, row.Dimension, row.Key, value})
+}
+
+func (e *csvExportWriter) Flush() error {
+	e.csv.Flush()
+	return e.csv.Error()
+}
+
+func (e *csvExportWriter) Close() error {
+	return e.Flush()
+}
+
+type ndjsonExportWriter struct {
+	buf     *bufio.Writer
+	encoder *json.Encoder
+}
+
+func newNDJSONExportWriter(w io.Writer) exportWriter {
+	buf := bufio.NewWriter(w)
+	return &ndjsonExportWriter{buf: buf, encoder: json.NewEncoder(buf)}
+}
+
+func (e *ndjsonExportWriter) WriteRow(row ExportRow) error {
+	return e.encoder.Encode(row)
+}
+
+func (e *ndjsonExportWriter) Flush() error {
+	return e.buf.Flush()
+}
+
+func (e *ndjsonExportWriter) Close() error {
+	return e.Flush()
+}
+
+// Каждая часть выгрузки становится группой строк файла Parquet
+type parquetExportWriter struct {
+	parquet                                  *parquetWriter
+	timestamp, metric, dimension, key, value *parquetColumn
+}
+
+func newParquetExportWriter(w io.Writer) exportWriter {
+	e := &parquetExportWriter{
+		timestamp: newParquetColumn("timestamp", parquetInt64, false, parquetTimestampMillis),
+		metric:    newParquetColumn("metric", parquetByteArray, false, parquetUTF8),
+		dimension: newParquetColumn("dimension", parquetByteArray, true, parquetUTF8),
+		key:       newParquetColumn("key", parquetByteArray, true, parquetUTF8),
+		value:     newParquetColumn("value", parquetDouble, true, parquetNoConversion),
+	}
+	e.parquet = newParquetWriter(w, e.timestamp, e.metric, e.dimension, e.key, e.value)
+	return e
+}
+
+func (e *parquetExportWriter) WriteRow(row ExportRow) error {
+	e.timestamp.AppendInt64(row.Timestamp * 1000)
+	e.metric.AppendString(row.Metric)
+	appendOptionalString(e.dimension, row.Dimension)
+	appendOptionalString(e.key, row.Key)
+	if row.Value != nil {
+		e.value.AppendDouble(*row.Value)
+	} else {
+		e.value.AppendNull()
+	}
+	e.parquet.EndRow()
+	return nil
+}
+
+func appendOptionalString(column *parquetColumn, value string) {
+	if value == "" {
+		column.AppendNull()
+		return
+	}
+	column.AppendString(value)
+}
+
+func (e *parquetExportWriter) Flush() error {
+	return e.parquet.Flush()
+}
+
+func (e *parquetExportWriter) Close() error {
+	return e.parquet.Close()
+}
+
+// Выгрузка запроса истории построчно. Интервалы читаются частями по exportChunkSteps,
+// поэтому объем памяти не зависит от диапазона. Порядок строк: по времени, внутри
+// интервала - по метрикам запроса, итог метрики перед ее разложениями
+type historyExporter struct {
+	query    HistoryQuery
+	writer   exportWriter
+	cutoff   int64                         // Интервалы раньше cutoff не выгружаются, но учитываются для fill=previous
+	previous map[string]*float64           // Последнее значение серии для fill=previous
+	keys     map[string]map[string]float64 // Встреченные ключи разложений метрики по измерению
+}
+
+func exportHistory(store *TieredStore, query HistoryQuery, writer exportWriter) error {
+	exporter := &historyExporter{
+		query:    query,
+		writer:   writer,
+		cutoff:   math.MinInt64,
+		previous: make(map[string]*float64),
+		keys:     make(map[string]map[string]float64),
+	}
+
+	if query.Limit > 0 {
+		cutoff, err := exportCutoff(store, query)
+		if err != nil {
+			return err
+		}
+		exporter.cutoff = cutoff
+	}
+
+	return walkHistory(store, query, exporter.bucket, writer.Flush)
+}
+
+// Начало первого выгружаемого интервала при ограничении limit: последние limit точек оси.
+// Без заполнения на оси только интервалы с данными, и их приходится найти отдельным проходом
+func exportCutoff(store *TieredStore, query HistoryQuery) (int64, error) {
+	var starts []int64
+	var err error
+	if query.Fill == FillNone {
+		err = walkHistory(store, query, func(start int64, rollup *Rollup) error {
+			if rollup != nil {
+				starts = append(starts, start)
+			}
+			return nil
+		}, func() error { return nil })
+	} else {
+		for start := stepStart(query.From, query.Step); start < query.To; start = nextStep(start, query.Step) {
+			starts = append(starts, start)
+		}
+	}
+	if err != nil || len(starts) <= query.Limit {
+		return math.MinInt64, err
+	}
+	return starts[len(starts)-query.Limit], nil
+}
+
+// Обход интервалов запроса по возрастанию времени частями по exportChunkSteps.
+// rollup равен nil, если за интервал нет данных
+func walkHistory(store *TieredStore, query HistoryQuery, visit func(start int64, rollup *Rollup) error, chunkDone func() error) error {
+	for from := stepStart(query.From, query.Step); from < query.To; {
+		to := from
+		for i := 0; i < exportChunkSteps && to < query.To; i++ {
+			to = nextStep(to, query.Step)
+		}
+		if to > query.To {
+			to = query.To
+		}
+
+		rollups, err := historyRollupsFor(store, query.Step, from, to)
+		if err != nil {
+			return err
+		}
+		for start := from; start < to; start = nextStep(start, query.Step) {
+			if err := visit(start, rollups[start]); err != nil {
+				return err
+			}
+		}
+		if err := chunkDone(); err != nil {
+			return err
+		}
+		from = nextStep(stepStart(to-1, query.Step), query.Step)
+	}
+	return nil
+}
+
+// Строки одного интервала
+func (e *historyExporter) bucket(start int64, rollup *Rollup) error {
+	if rollup == nil && e.query.Fill == FillNone {
+		return nil
+	}
+
+	var metrics MetricsData
+	if rollup != nil {
+		metrics = rollup.Metrics()
+	}
+	emit := start >= e.cutoff
+	timestamp := time.Unix(start, 0).Format(time.RFC3339)
+
+	for _, metric := range e.query.Metrics {
+		row := ExportRow{Timestamp: start, Time: timestamp, Metric: metric.name}
+		var value float64
+		if rollup != nil {
+			value = metric.value(rollup, &metrics)
+		}
+		if err := e.row(row, value, rollup != nil, emit); err != nil {
+			return err
+		}
+
+		for _, dimension := range e.query.Dimensions {
+			split, ok := metric.breakdowns[dimension]
+			if !ok {
+				continue
+			}
+
+			series := metric.name + "/" + dimension
+			known := e.keys[series]
+			if known == nil {
+				known = make(map[string]float64)
+				e.keys[series] = known
+			}
+			var values map[string]float64
+			if rollup != nil {
+				values = split(&metrics)
+				for key := range values {
+					known[key] = 0
+				}
+			}
+
+			// Ключи, отсутствующие в интервале, заполняются по политике fill так же, как пропуски
+			for _, key := range dimensionKeys([]map[string]float64{known}, dimension) {
+				value, ok := values[key]
+				row := ExportRow{Timestamp: start, Time: timestamp, Metric: metric.name, Dimension: dimension, Key: key}
+				if err := e.row(row, value, ok, emit); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Запись значения серии или заполнение пропуска по политике fill
+func (e *historyExporter) row(row ExportRow, value float64, ok bool, emit bool) error {
+	series := row.Metric + "/" + row.Dimension + "/" + row.Key
+	if ok {
+		row.Value = &value
+		e.previous[series] = row.Value
+	} else {
+		switch e.query.Fill {
+		case FillNone:
+			return nil
+		case FillZero:
+			zero := 0.0
+			row.Value = &zero
+		case FillPrevious:
+			row.Value = e.previous[series]
+		}
+	}
+
+	if !emit {
+		return nil
+	}
+	return e.writer.WriteRow(row)
+}
+
+// Имя файла выгрузки с периодом и диапазоном
+func exportFilename(period string, query HistoryQuery, format exportFormat) string {
+	const layout = "20060102T1504"
+	return fmt.Sprintf("metrics-%s-%s-%s.%s", period,
+		time.Unix(query.From, 0).Format(layout), time.Unix(query.To, 0).Format(layout), format.name)
+}
+
+func findExportFormat(name string) (exportFormat, bool) {
+	for _, format := range exportFormats {
+		if format.name == name {
+			return format, true
+		}
+	}
+	return exportFormat{}, false
+}
+
+func exportFormatNames() []string {
+	names := make([]string, len(exportFormats))
+	for i, format := range exportFormats {
+		names[i] = format.name
+	}
+	return names
+}
+
+// Обработчик /metrics/export?format=csv|ndjson|parquet&period=...&metrics=...&dimensions=...
+// Принимает те же параметры диапазона и фильтры, что и API истории; без ?metrics= выгружаются
+// все метрики. Ответ передается потоком по мере чтения истории
+func handleExportMetrics(c *gin.Context) {
+	format, ok := findExportFormat(c.DefaultQuery("format", "csv"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":        fmt.Sprintf("unknown format: %q, valid formats: %s", c.Query("format"), strings.Join(exportFormatNames(), ", ")),
+			"validFormats": exportFormatNames(),
+		})
+		return
+	}
+
+	period := c.DefaultQuery("period", "hourly")
+	query, err := parseHistoryQuery(c, time.Now(), historyQueryOptions{
+		period:     period,
+		maxPoints:  maxExportPoints,
+		allMetrics: true,
+	})
+	if err != nil {
+		historyQueryErrorResponse(c, err)
+		return
+	}
+
+	c.Header("Content-Type", format.contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(period, query, format)))
+	c.Status(http.StatusOK)
+
+	// Статус уже отправлен, поэтому ошибку чтения можно только записать в лог:
+	// выгрузка обрывается, а файл Parquet остается без футера и не откроется как целый
+	writer := format.newWriter(c.Writer)
+	err = exportHistory(metricsStore, query, &flushingExportWriter{exportWriter: writer, flusher: c.Writer})
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		log.Printf("Error exporting historical data: %v", err)
+	}
+}
+
+// Отправка клиенту каждой записанной части выгрузки
+type flushingExportWriter struct {
+	exportWriter
+	flusher http.Flusher
+}
+
+func (e *flushingExportWriter) Flush() error {
+	if err := e.exportWriter.Flush(); err != nil {
+		return err
+	}
+	e.flusher.Flush()
+	return nil
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Топики метрик, на которые может подписаться клиент (битовая маска)
+type Topic uint32
+
+const (
+	TopicKPI Topic = 1 << iota
+	TopicRegional
+	TopicSources
+	TopicFunnel
+	TopicErrors
+	TopicHistoricalHourly
+	TopicHistoricalDaily
+	TopicHistoricalWeekly
+
+	numTopics = iota
+)
+
+const (
+	TopicHistorical = TopicHistoricalHourly | TopicHistoricalDaily | TopicHistoricalWeekly
+	AllTopics       = Topic(1<<numTopics - 1)
+)
+
+// Имена топиков в протоколе
+var topicNames = map[Topic]string{
+	TopicKPI:              "kpi",
+	TopicRegional:         "regional",
+	TopicSources:          "sources",
+	TopicFunnel:           "funnel",
+	TopicErrors:           "errors",
+	TopicHistoricalHourly: "historical:hourly",
+	TopicHistoricalDaily:  "historical:daily",
+	TopicHistoricalWeekly: "historical:weekly",
+}
+
+// Разбор списка имен топиков. "historical" означает все исторические периоды
+func ParseTopics(names []string) (Topic, error) {
+	var topics Topic
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "historical" {
+			topics |= TopicHistorical
+			continue
+		}
+
+		found := false
+		for topic, topicName := range topicNames {
+			if topicName == name {
+				topics |= topic
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown topic: %q", name)
+		}
+	}
+	return topics, nil
+}
+
+// Имена топиков из маски в стабильном порядке
+func (t Topic) Names() []string {
+	names := make([]string, 0, numTopics)
+	for i := 0; i < numTopics; i++ {
+		topic := Topic(1 << i)
+		if t&topic != 0 {
+			names = append(names, topicNames[topic])
+		}
+	}
+	return names
+}
+
+// Формат кадров на проводе
+type WireFormat int
+
+const (
+	FormatJSON WireFormat = iota
+	FormatMsgpack
+)
+
+// Поле секции кадра
+type field struct {
+	name  string
+	value interface{}
+}
+
+// Секция кадра - упорядоченный список полей верхнего уровня
+type section []field
+
+// Секция из карты изменений с детерминированным порядком полей
+func sectionFromMap(values map[string]interface{}) section {
+	sec := make(section, 0, len(values))
+	for name, value := range values {
+		sec = append(sec, field{name: name, value: value})
+	}
+	sort.Slice(sec, func(i, j int) bool {
+		return sec[i].name < sec[j].name
+	})
+	return sec
+}
+
+// Полные секции метрик по топикам
+func fullSections(metrics *MetricsData) [numTopics]section {
+	var sections [numTopics]section
+	sections[topicIndex(TopicKPI)] = section{
+		{"activeUsers", metrics.ActiveUsers},
+		{"requestsPerSecond", metrics.RequestsPerSecond},
+		{"responseTimeMs", metrics.ResponseTimeMs},
+		{"latency", metrics.Latency},
+		{"conversionRate", metrics.ConversionRate},
+		{"sales", metrics.Sales},
+		{"serverLoad", metrics.ServerLoad},
+		{"databaseConnections", metrics.DatabaseConnections},
+	}
+	sections[topicIndex(TopicErrors)] = section{
+		{"errorRate", metrics.ErrorRate},
+		{"errorsByType", metrics.ErrorsByType},
+	}
+	sections[topicIndex(TopicRegional)] = section{{"regionalData", metrics.RegionalData}}
+	sections[topicIndex(TopicSources)] = section{{"sourcesData", metrics.SourcesData}}
+	sections[topicIndex(TopicFunnel)] = section{{"conversionFunnel", metrics.ConversionFunnel}}
+	sections[topicIndex(TopicHistoricalHourly)] = section{{"hourly", nonNilHistory(metrics.HistoricalData.Hourly)}}
+	sections[topicIndex(TopicHistoricalDaily)] = section{{"daily", nonNilHistory(metrics.HistoricalData.Daily)}}
+	sections[topicIndex(TopicHistoricalWeekly)] = section{{"weekly", nonNilHistory(metrics.HistoricalData.Weekly)}}
+	return sections
+}
+
+// Порядковый номер топика в массиве секций
+func topicIndex(topic Topic) int {
+	for i := 0; i < numTopics; i++ {
+		if topic == Topic(1<<i) {
+			return i
+		}
+	}
+	panic(fmt.Sprintf("not a single topic: %d", topic))
+}
+
+// Неизменяемый кадр метрик одного тика. Каждая секция сериализуется один раз
+// на формат, а итоговое сообщение собирается из готовых фрагментов под маску топиков клиента
+type Frame struct {
+	Seq      uint64
+	Origin   string        // Инстанс-источник, пустой для локальных метрик
+	Epoch    string        // Эпоха нумерации хаба, опубликовавшего кадр
+	Interval time.Duration // Интервал потока: базовый тик или окно агрегации
+	Metrics  MetricsData
+	full     [numTopics]section // Полные секции
+	delta    [numTopics]section // Изменения относительно предыдущего кадра, пустая секция - без изменений
+
+	mu        sync.Mutex
+	fragments map[fragmentKey]*[numTopics][]byte
+	cache     map[frameKey][]byte
+}
+
+// Позиция кадра в его потоке
+func (f *Frame) Position() StreamPosition {
+	return StreamPosition{Epoch: f.Epoch, Interval: f.Interval, Seq: f.Seq}
+}
+
+// Ключ кэша сериализованных фрагментов
+type fragmentKey struct {
+	format WireFormat
+	delta  bool
+}
+
+// Ключ кэша собранных сообщений
+type frameKey struct {
+	format WireFormat
+	topics Topic
+	delta  bool
+}
+
+// Создание кадра с дельтой относительно предыдущего тика. JSON-фрагменты
+// сериализуются сразу, остальные форматы - при первом обращении.
+// Без предыдущего кадра дельта совпадает с полным снимком
+func NewFrame(seq uint64, metrics MetricsData, prev *Frame) (*Frame, error) {
+	frame := &Frame{
+		Seq:       seq,
+		Metrics:   metrics,
+		fragments: make(map[fragmentKey]*[numTopics][]byte),
+		cache:     make(map[frameKey][]byte),
+	}
+
+	frame.full = fullSections(&frame.Metrics)
+	if prev == nil {
+		frame.delta = frame.full
+	} else {
+		frame.delta = deltaSections(&prev.Metrics, &frame.Metrics)
+	}
+
+	frame.mu.Lock()
+	defer frame.mu.Unlock()
+	if _, err := frame.fragmentsFor(fragmentKey{format: FormatJSON}); err != nil {
+		return nil, err
+	}
+	if _, err := frame.fragmentsFor(fragmentKey{format: FormatJSON, delta: true}); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// Представление кадра в заданном формате для маски топиков: полный снимок или дельта.
+// Результат кэшируется и разделяется между всеми клиентами с той же подпиской
+func (f *Frame) Encode(format WireFormat, topics Topic, delta bool) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := frameKey{format: format, topics: topics, delta: delta}
+	if data, ok := f.cache[key]; ok {
+		return data, nil
+	}
+
+	fragments, err := f.fragmentsFor(fragmentKey{format: format, delta: delta})
+	if err != nil {
+		return nil, err
+	}
+
+	frameType := "snapshot"
+	sections := &f.full
+	if delta {
+		frameType = "delta"
+		sections = &f.delta
+	}
+
+	header, err := encodeFragment(format, section{
+		{"type", frameType},
+		{"seq", f.Seq},
+		{"epoch", f.Epoch},
+		{"interval", int64(f.Interval / time.Second)},
+		{"timestamp", f.Metrics.Timestamp},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	if format == FormatMsgpack {
+		data = assembleMsgpack(header, 5, fragments, sections, topics)
+	} else {
+		data = assembleJSON(header, fragments, topics)
+	}
+
+	f.cache[key] = data
+	return data, nil
+}
+
+// JSON-представление кадра
+func (f *Frame) JSON(topics Topic, delta bool) []byte {
+	data, err := f.Encode(FormatJSON, topics, delta)
+	if err != nil {
+		// JSON-фрагменты сериализованы при создании кадра, сборка не может завершиться ошибкой
+		panic(err)
+	}
+	return data
+}
+
+// Сериализованные фрагменты секций. Вызывается под f.mu
+func (f *Frame) fragmentsFor(key fragmentKey) (*[numTopics][]byte, error) {
+	if fragments, ok := f.fragments[key]; ok {
+		return fragments, nil
+	}
+
+	sections := &f.full
+	if key.delta {
+		sections = &f.delta
+	}
+
+	fragments := new([numTopics][]byte)
+	for i := 0; i < numTopics; i++ {
+		data, err := encodeFragment(key.format, sections[i])
+		if err != nil {
+			return nil, err
+		}
+		fragments[i] = data
+	}
+
+	f.fragments[key] = fragments
+	return fragments, nil
+}
+
+// Сериализация полей секции без обрамления объекта/карты:
+// для JSON - "key":value через запятую, для MessagePack - подряд идущие пары ключ-значение
+func encodeFragment(format WireFormat, sec section) ([]byte, error) {
+	if format == FormatMsgpack {
+		w := &msgpackWriter{}
+		for _, f := range sec {
+			w.WriteString(f.name)
+			if err := w.Write(f.value); err != nil {
+				return nil, err
+			}
+		}
+		return w.Bytes(), nil
+	}
+
+	var buf bytes.Buffer
+	for i, f := range sec {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(f.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	return buf.Bytes(), nil
+}
+
+// Сборка JSON-объекта из фрагментов секций. Пустые фрагменты пропускаются
+func assembleJSON(header []byte, fragments *[numTopics][]byte, topics Topic) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	buf.Write(header)
+
+	for i := 0; i < numTopics; i++ {
+		topic := Topic(1 << i)
+		if topics&topic == 0 || topic&TopicHistorical != 0 || len(fragments[i]) == 0 {
+			continue
+		}
+		buf.WriteByte(',')
+		buf.Write(fragments[i])
+	}
+
+	// Исторические периоды объединяются в один объект historicalData
+	first := true
+	for i := 0; i < numTopics; i++ {
+		topic := Topic(1 << i)
+		if topics&topic == 0 || topic&TopicHistorical == 0 || len(fragments[i]) == 0 {
+			continue
+		}
+		if first {
+			buf.WriteString(`,"historicalData":{`)
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.Write(fragments[i])
+		first = false
+	}
+	if !first {
+		buf.WriteByte('}')
+	}
+
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// Сборка карты MessagePack из фрагментов секций. Число полей карты
+// известно заранее по длине секций, поэтому фрагменты просто склеиваются
+func assembleMsgpack(header []byte, headerFields int, fragments *[numTopics][]byte, sections *[numTopics]section, topics Topic) []byte {
+	fields := headerFields
+	historicalFields := 0
+	for i := 0; i < numTopics; i++ {
+		topic := Topic(1 << i)
+		if topics&topic == 0 {
+			continue
+		}
+		if topic&TopicHistorical != 0 {
+			historicalFields += len(sections[i])
+		} else {
+			fields += len(sections[i])
+		}
+	}
+	if historicalFields > 0 {
+		fields++
+	}
+
+	w := &msgpackWriter{}
+	w.WriteMapHeader(fields)
+	w.buf = append(w.buf, header...)
+
+	for i := 0; i < numTopics; i++ {
+		topic := Topic(1 << i)
+		if topics&topic == 0 || topic&TopicHistorical != 0 {
+			continue
+		}
+		w.buf = append(w.buf, fragments[i]...)
+	}
+
+	if historicalFields > 0 {
+		w.WriteString("historicalData")
+		w.WriteMapHeader(historicalFields)
+		for i := 0; i < numTopics; i++ {
+			topic := Topic(1 << i)
+			if topics&topic == 0 || topic&TopicHistorical == 0 {
+				continue
+			}
+			w.buf = append(w.buf, fragments[i]...)
+		}
+	}
+
+	return w.Bytes()
+}
+
+// Сериализация отдельного сообщения (например, управляющего ответа) в формате клиента
+func encodeMessage(format WireFormat, v interface{}) ([]byte, error) {
+	if format == FormatMsgpack {
+		w := &msgpackWriter{}
+		if err := w.Write(v); err != nil {
+			return nil, err
+		}
+		return w.Bytes(), nil
+	}
+	return json.Marshal(v)
+}
+
+// Пустая карта вместо nil, чтобы период всегда присутствовал в historicalData
+func nonNilHistory(history map[int64]HistoricalMetrics) map[int64]HistoricalMetrics {
+	if history == nil {
+		return map[int64]HistoricalMetrics{}
+	}
+	return history
+}
+
+// Отсортированные имена топиков для сообщений об ошибках
+func validTopicNames() []string {
+	names := make([]string, 0, len(topicNames)+1)
+	for _, name := range topicNames {
+		names = append(names, name)
+	}
+	names = append(names, "historical")
+	sort.Strings(names)
+	return names
+}
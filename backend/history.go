@@ -0,0 +1,167 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Окна истории, которые отдаются в кадрах и графиках
+const (
+	hourlyHistoryWindow = 7 * 24 * time.Hour
+	dailyHistoryWindow  = 30 * 24 * time.Hour
+	weeklyHistoryWindow = 12 * 7 * 24 * time.Hour
+)
+
+// Сводки исторических периодов по началу периода. Часы читаются из уровней хранения,
+// дни и недели сворачиваются из часов, поэтому все три представления согласованы
+type historyRollups struct {
+	hourly map[int64]*Rollup
+	daily  map[int64]*Rollup
+	weekly map[int64]*Rollup
+}
+
+func newHistoryRollups() historyRollups {
+	return historyRollups{
+		hourly: make(map[int64]*Rollup),
+		daily:  make(map[int64]*Rollup),
+		weekly: make(map[int64]*Rollup),
+	}
+}
+
+// Начало недели: понедельник, местная полночь
+func weekStart(ts int64) int64 {
+	day := time.Unix(bucketStart(ts, 24*time.Hour), 0)
+	offset := (int(day.Weekday()) + 6) % 7
+	return time.Date(day.Year(), day.Month(), day.Day()-offset, 0, 0, 0, 0, day.Location()).Unix()
+}
+
+// Сводки за окна истории из хранилища
+func loadHistoryRollups(store *TieredStore, now time.Time) (historyRollups, error) {
+	rollups := newHistoryRollups()
+
+	from := weekStart(now.Add(-weeklyHistoryWindow).Unix())
+	hours, err := store.Buckets(time.Hour, from, now.Unix()+1)
+	if err != nil {
+		return rollups, err
+	}
+	for _, hour := range hours {
+		rollups.hourly[hour.Start] = hour
+		rollups.period(rollups.daily, bucketStart(hour.Start, 24*time.Hour)).Merge(hour)
+		rollups.period(rollups.weekly, weekStart(hour.Start)).Merge(hour)
+	}
+
+	rollups.prune(now.Unix())
+	return rollups, nil
+}
+
+func (h historyRollups) period(periods map[int64]*Rollup, start int64) *Rollup {
+	rollup := periods[start]
+	if rollup == nil {
+		rollup = newRollup(start)
+		periods[start] = rollup
+	}
+	return rollup
+}
+
+// Учет нового тика в сводках открытых периодов. Возвращает начала часа, дня и недели тика
+func (h historyRollups) add(metrics MetricsData, weight float64) (hour, day, week int64) {
+	hour = bucketStart(metrics.Timestamp, time.Hour)
+	day = bucketStart(metrics.Timestamp, 24*time.Hour)
+	week = weekStart(metrics.Timestamp)
+
+	h.period(h.hourly, hour).Add(metrics, weight)
+	h.period(h.daily, day).Add(metrics, weight)
+	h.period(h.weekly, week).Add(metrics, weight)
+	return hour, day, week
+}
+
+// Учет тика в сводках и обновление исторических карт history: пересчитываются только
+// периоды тика, периоды, вышедшие за окна истории, удаляются и из сводок, и из карт
+func (h historyRollups) update(history HistoricalData, metrics MetricsData, weight float64) {
+	hour, day, week := h.add(metrics, weight)
+	history.Hourly[hour] = h.hourly[hour].Historical()
+	history.Daily[day] = h.daily[day].Historical()
+	history.Weekly[week] = h.weekly[week].Historical()
+
+	h.prune(metrics.Timestamp)
+	pruneHistory(history.Hourly, h.hourly)
+	pruneHistory(history.Daily, h.daily)
+	pruneHistory(history.Weekly, h.weekly)
+}
+
+func pruneHistory(history map[int64]HistoricalMetrics, periods map[int64]*Rollup) {
+	for start := range history {
+		if _, ok := periods[start]; !ok {
+			delete(history, start)
+		}
+	}
+}
+
+// Удаление периодов, целиком вышедших за окна истории
+func (h historyRollups) prune(now int64) {
+	hourStart := func(ts int64) int64 { return bucketStart(ts, time.Hour) }
+	dayStart := func(ts int64) int64 { return bucketStart(ts, 24*time.Hour) }
+	windows := []struct {
+		periods map[int64]*Rollup
+		window  time.Duration
+		align   func(ts int64) int64
+	}{
+		{h.hourly, hourlyHistoryWindow, hourStart},
+		{h.daily, dailyHistoryWindow, dayStart},
+		{h.weekly, weeklyHistoryWindow, weekStart},
+	}
+	for _, w := range windows {
+		before := w.align(now - int64(w.window/time.Second))
+		for start := range w.periods {
+			if start < before {
+				delete(w.periods, start)
+			}
+		}
+	}
+}
+
+// Исторические карты для кадров и графиков
+func (h historyRollups) historical() HistoricalData {
+	return HistoricalData{
+		Hourly: historicalMap(h.hourly),
+		Daily:  historicalMap(h.daily),
+		Weekly: historicalMap(h.weekly),
+	}
+}
+
+func historicalMap(periods map[int64]*Rollup) map[int64]HistoricalMetrics {
+	result := make(map[int64]HistoricalMetrics, len(periods))
+	for start, rollup := range periods {
+		result[start] = rollup.Historical()
+	}
+	return result
+}
+
+// История источника метрик: сводки периодов и исторические карты, которые растут с каждым тиком
+type historyTracker struct {
+	rollups historyRollups
+	history HistoricalData
+}
+
+// История, продолжающая данные хранилища
+func loadHistoryTracker(store *TieredStore, now time.Time) *historyTracker {
+	rollups, err := loadHistoryRollups(store, now)
+	if err != nil {
+		log.Printf("Error loading historical data: %v", err)
+	}
+	return &historyTracker{rollups: rollups, history: rollups.historical()}
+}
+
+// Учет тика и копии исторических карт в его метриках. У источника за MergedSource трекера
+// нет: история строится по объединенным тикам
+func (t *historyTracker) add(metrics *MetricsData) {
+	if t == nil {
+		return
+	}
+	t.rollups.update(t.history, *metrics, tickInterval.Seconds())
+	metrics.HistoricalData = HistoricalData{
+		Hourly: copyHistory(t.history.Hourly),
+		Daily:  copyHistory(t.history.Daily),
+		Weekly: copyHistory(t.history.Weekly),
+	}
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Максимум точек в ответе на запрос истории до применения limit
+const maxHistoryPoints = 10000
+
+const week = 7 * 24 * time.Hour
+
+// Период истории: шаг и диапазон по умолчанию
+type historyPeriod struct {
+	name   string
+	step   time.Duration
+	window time.Duration
+}
+
+var historyPeriods = []historyPeriod{
+	{"hourly", time.Hour, hourlyHistoryWindow},
+	{"daily", 24 * time.Hour, dailyHistoryWindow},
+	{"weekly", week, weeklyHistoryWindow},
+}
+
+// Метрика истории и способ получить ее значение из сводки
+type historyMetric struct {
+	name       string
+	value      func(r *Rollup, m *MetricsData) float64
+	breakdowns map[string]breakdown // Разложения по измерениям
+}
+
+// Значения метрики по ключам измерения за интервал
+type breakdown func(m *MetricsData) map[string]float64
+
+// Измерения, по которым серии раскладываются на ключи
+const (
+	DimensionRegion      = "region"
+	DimensionSource      = "source"
+	DimensionErrorType   = "errorType"
+	DimensionFunnelStage = "funnelStage"
+)
+
+var historyDimensions = []string{DimensionRegion, DimensionSource, DimensionErrorType, DimensionFunnelStage}
+
+// Этапы воронки в порядке прохождения; ключи остальных измерений сортируются по алфавиту
+var funnelStages = []string{"visitors", "productViews", "addedToCart", "beganCheckout", "purchasedItems"}
+
+var historyMetrics = []historyMetric{
+	{
+		name:  "activeUsers",
+		value: func(r *Rollup, m *MetricsData) float64 { return float64(m.ActiveUsers) },
+		breakdowns: map[string]breakdown{
+			DimensionRegion: regionBreakdown(func(region Region) float64 { return float64(region.ActiveUsers) }),
+			DimensionSource: func(m *MetricsData) map[string]float64 { return intBreakdown(m.SourcesData) },
+		},
+	},
+	{name: "peakActiveUsers", value: func(r *Rollup, m *MetricsData) float64 { return float64(r.PeakActiveUsers) }},
+	{
+		name:  "sales",
+		value: func(r *Rollup, m *MetricsData) float64 { return float64(m.Sales) },
+		breakdowns: map[string]breakdown{
+			DimensionRegion: regionBreakdown(func(region Region) float64 { return float64(region.Sales) }),
+		},
+	},
+	{
+		name:  "conversionRate",
+		value: func(r *Rollup, m *MetricsData) float64 { return m.ConversionRate },
+		breakdowns: map[string]breakdown{
+			DimensionRegion: regionBreakdown(func(region Region) float64 { return region.ConversionRate }),
+		},
+	},
+	{name: "responseTime", value: func(r *Rollup, m *MetricsData) float64 { return m.ResponseTimeMs }},
+	{name: "responseTimeP50", value: func(r *Rollup, m *MetricsData) float64 { return m.Latency.P50 }},
+	{name: "responseTimeP90", value: func(r *Rollup, m *MetricsData) float64 { return m.Latency.P90 }},
+	{name: "responseTimeP95", value: func(r *Rollup, m *MetricsData) float64 { return m.Latency.P95 }},
+	{name: "responseTimeP99", value: func(r *Rollup, m *MetricsData) float64 { return m.Latency.P99 }},
+	{name: "requestsPerSecond", value: func(r *Rollup, m *MetricsData) float64 { return m.RequestsPerSecond }},
+	{name: "errorRate", value: func(r *Rollup, m *MetricsData) float64 { return m.ErrorRate }},
+	{
+		name: "errors",
+		value: func(r *Rollup, m *MetricsData) float64 {
+			total := 0
+			for _, count := range m.ErrorsByType {
+				total += count
+			}
+			return float64(total)
+		},
+		breakdowns: map[string]breakdown{
+			DimensionErrorType: func(m *MetricsData) map[string]float64 { return intBreakdown(m.ErrorsByType) },
+		},
+	},
+	{
+		name:  "funnel",
+		value: func(r *Rollup, m *MetricsData) float64 { return float64(m.ConversionFunnel.Visitors) },
+		breakdowns: map[string]breakdown{
+			DimensionFunnelStage: func(m *MetricsData) map[string]float64 {
+				f := m.ConversionFunnel
+				values := []int{f.Visitors, f.ProductViews, f.AddedToCart, f.BeganCheckout, f.PurchasedItems}
+				result := make(map[string]float64, len(funnelStages))
+				for i, stage := range funnelStages {
+					result[stage] = float64(values[i])
+				}
+				return result
+			},
+		},
+	},
+	{name: "serverLoad", value: func(r *Rollup, m *MetricsData) float64 { return m.ServerLoad }},
+	{name: "databaseConnections", value: func(r *Rollup, m *MetricsData) float64 { return float64(m.DatabaseConnections) }},
+}
+
+func regionBreakdown(value func(region Region) float64) breakdown {
+	return func(m *MetricsData) map[string]float64 {
+		result := make(map[string]float64, len(m.RegionalData))
+		for name, region := range m.RegionalData {
+			result[name] = value(region)
+		}
+		return result
+	}
+}
+
+func intBreakdown(values map[string]int) map[string]float64 {
+	result := make(map[string]float64, len(values))
+	for key, value := range values {
+		result[key] = float64(value)
+	}
+	return result
+}
+
+// Заполнение интервалов без данных
+type FillPolicy string
+
+const (
+	FillNone     FillPolicy = "none"     // Интервалы без данных пропускаются
+	FillNull     FillPolicy = "null"     // Точка со значением null
+	FillZero     FillPolicy = "zero"     // Точка со значением 0
+	FillPrevious FillPolicy = "previous" // Значение предыдущей точки, до первой точки - null
+)
+
+var fillPolicies = []FillPolicy{FillNone, FillNull, FillZero, FillPrevious}
+
+// Запрос истории: метрики за интервалы с шагом Step, начинающиеся в [From, To)
+type HistoryQuery struct {
+	Metrics    []historyMetric
+	Dimensions []string // Измерения, по которым метрики раскладываются дополнительно к итогу
+	From       int64
+	To         int64
+	Step       time.Duration
+	Limit      int // Максимум точек, берутся последние; 0 - без ограничения
+	Fill       FillPolicy
+}
+
+// Точка истории. Value равен nil для интервала без данных при заполнении null
+type HistoryPoint struct {
+	Timestamp int64    `json:"timestamp"`
+	Value     *float64 `json:"value"`
+}
+
+// Серия значений метрики на общей оси времени. Для разложения по измерению
+// заданы Dimension и Key, например region и Moscow
+type HistorySeries struct {
+	Metric    string     `json:"metric"`
+	Dimension string     `json:"dimension,omitempty"`
+	Key       string     `json:"key,omitempty"`
+	Values    []*float64 `json:"values"`
+}
+
+// Результат запроса истории: выровненные серии с общей осью времени
+type HistoryResult struct {
+	Step       int64           `json:"step"` // Шаг в секундах
+	Timestamps []int64         `json:"timestamps"`
+	Series     []HistorySeries `json:"series"`
+}
+
+// Ошибка разбора запроса истории с допустимыми значениями параметра
+type historyQueryError struct {
+	message string
+	field   string
+	valid   []string
+}
+
+func (e *historyQueryError) Error() string {
+	return e.message
+}
+
+// Параметры разбора, которые различаются у обработчиков истории
+type historyQueryOptions struct {
+	period     string // Имя периода из пути или параметра запроса
+	maxPoints  int64  // Максимум интервалов в диапазоне
+	allMetrics bool   // Без ?metrics= выбираются все метрики
+}
+
+// Разбор запроса истории. Период задает шаг и диапазон по умолчанию,
+// параметры from, to, step, limit и fill их уточняют. Метрика берется из пути,
+// а если ее там нет - из списка ?metrics= вместе с измерениями ?dimensions=
+func parseHistoryQuery(c *gin.Context, now time.Time, options historyQueryOptions) (HistoryQuery, error) {
+	var query HistoryQuery
+
+	period, ok := findHistoryPeriod(options.period)
+	if !ok {
+		return query, &historyQueryError{
+			message: fmt.Sprintf("unknown period: %q, valid periods: %s", options.period, strings.Join(historyPeriodNames(), ", ")),
+			field:   "validPeriods",
+			valid:   historyPeriodNames(),
+		}
+	}
+
+	names := []string{c.Param("metric")}
+	if names[0] == "" {
+		names = splitList(c.Query("metrics"))
+	}
+	if len(names) == 0 && options.allMetrics {
+		names = historyMetricNames()
+	}
+	if len(names) == 0 {
+		return query, &historyQueryError{
+			message: fmt.Sprintf("no metrics requested, valid metrics: %s", strings.Join(historyMetricNames(), ", ")),
+			field:   "validMetrics",
+			valid:   historyMetricNames(),
+		}
+	}
+	for _, name := range names {
+		metric, ok := findHistoryMetric(name)
+		if !ok {
+			return query, &historyQueryError{
+				message: fmt.Sprintf("unknown metric: %q, valid metrics: %s", name, strings.Join(historyMetricNames(), ", ")),
+				field:   "validMetrics",
+				valid:   historyMetricNames(),
+			}
+		}
+		query.Metrics = append(query.Metrics, metric)
+	}
+
+	for _, dimension := range splitList(c.Query("dimensions")) {
+		if !containsString(historyDimensions, dimension) {
+			return query, &historyQueryError{
+				message: fmt.Sprintf("unknown dimension: %q, valid dimensions: %s", dimension, strings.Join(historyDimensions, ", ")),
+				field:   "validDimensions",
+				valid:   historyDimensions,
+			}
+		}
+		query.Dimensions = append(query.Dimensions, dimension)
+	}
+
+	query.Step = period.step
+	if value := c.Query("step"); value != "" {
+		step, err := parseLongDuration(value)
+		if err != nil || step < tickInterval || step%tickInterval != 0 {
+			return query, fmt.Errorf("invalid step: %q", value)
+		}
+		query.Step = step
+	}
+
+	var err error
+	query.To = now.Unix() + 1
+	if value := c.Query("to"); value != "" {
+		if query.To, err = parseTimeParam(value, now); err != nil {
+			return query, err
+		}
+	}
+	query.From = query.To - int64(period.window/time.Second)
+	if value := c.Query("from"); value != "" {
+		if query.From, err = parseTimeParam(value, now); err != nil {
+			return query, err
+		}
+	}
+	if query.From >= query.To {
+		return query, fmt.Errorf("from must be before to")
+	}
+	if points := (query.To - query.From) / int64(query.Step/time.Second); points > options.maxPoints {
+		return query, fmt.Errorf("range contains %d points, at most %d allowed: increase step or narrow the range", points, options.maxPoints)
+	}
+
+	if value := c.Query("limit"); value != "" {
+		if query.Limit, err = strconv.Atoi(value); err != nil || query.Limit <= 0 {
+			return query, fmt.Errorf("invalid limit: %q", value)
+		}
+	}
+
+	query.Fill = FillNone
+	if value := c.Query("fill"); value != "" {
+		query.Fill = FillPolicy(value)
+		if !validFillPolicy(query.Fill) {
+			names := make([]string, len(fillPolicies))
+			for i, policy := range fillPolicies {
+				names[i] = string(policy)
+			}
+			return query, &historyQueryError{
+				message: fmt.Sprintf("unknown fill policy: %q, valid policies: %s", value, strings.Join(names, ", ")),
+				field:   "validFills",
+				valid:   names,
+			}
+		}
+	}
+	return query, nil
+}
+
+// Момент времени: unix-секунды, ISO-8601 (RFC 3339 или дата), now
+// или смещение от текущего момента вида -24h, -7d, +1h
+func parseTimeParam(value string, now time.Time) (int64, error) {
+	if value == "now" {
+		return now.Unix(), nil
+	}
+	if value[0] == '-' || value[0] == '+' {
+		offset, err := parseLongDuration(value[1:])
+		if err != nil {
+			return 0, fmt.Errorf("invalid relative time: %q", value)
+		}
+		if value[0] == '-' {
+			offset = -offset
+		}
+		return now.Add(offset).Unix(), nil
+	}
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ts, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Unix(), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, now.Location()); err == nil {
+		return t.Unix(), nil
+	}
+	return 0, fmt.Errorf("invalid time: %q, expected unix seconds, ISO-8601 or relative time like -24h", value)
+}
+
+// Список через запятую без пустых элементов
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func findHistoryPeriod(name string) (historyPeriod, bool) {
+	for _, period := range historyPeriods {
+		if period.name == name {
+			return period, true
+		}
+	}
+	return historyPeriod{}, false
+}
+
+func findHistoryMetric(name string) (historyMetric, bool) {
+	for _, metric := range historyMetrics {
+		if metric.name == name {
+			return metric, true
+		}
+	}
+	return historyMetric{}, false
+}
+
+func historyPeriodNames() []string {
+	names := make([]string, len(historyPeriods))
+	for i, period := range historyPeriods {
+		names[i] = period.name
+	}
+	return names
+}
+
+func historyMetricNames() []string {
+	names := make([]string, len(historyMetrics))
+	for i, metric := range historyMetrics {
+		names[i] = metric.name
+	}
+	return names
+}
+
+func validFillPolicy(policy FillPolicy) bool {
+	for _, valid := range fillPolicies {
+		if policy == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// Начало интервала шага step. Сутки выравниваются по местной полуночи, недели - по понедельнику
+func stepStart(ts int64, step time.Duration) int64 {
+	if step == week {
+		return weekStart(ts)
+	}
+	return bucketStart(ts, step)
+}
+
+// Начало следующего интервала шага step
+func nextStep(start int64, step time.Duration) int64 {
+	if step == week {
+		t := time.Unix(start, 0)
+		return time.Date(t.Year(), t.Month(), t.Day()+7, 0, 0, 0, 0, t.Location()).Unix()
+	}
+	return bucketEnd(start, step)
+}
+
+// Сводки с шагом step, начинающиеся в [from, to). Недели сворачиваются из суток
+func historyRollupsFor(store *TieredStore, step time.Duration, from, to int64) (map[int64]*Rollup, error) {
+	result := make(map[int64]*Rollup)
+	if step != week {
+		rollups, err := store.Buckets(step, from, to)
+		for _, rollup := range rollups {
+			result[rollup.Start] = rollup
+		}
+		return result, err
+	}
+
+	days, err := store.Buckets(24*time.Hour, from, to)
+	for _, day := range days {
+		start := weekStart(day.Start)
+		if result[start] == nil {
+			result[start] = newRollup(start)
+		}
+		result[start].Merge(day)
+	}
+	return result, err
+}
+
+// Интервал на оси времени запроса. rollup равен nil, если данных за интервал нет
+type historyBucket struct {
+	index   int // Позиция на оси
+	rollup  *Rollup
+	metrics MetricsData
+}
+
+// Выполнение запроса истории: серии по возрастанию времени с заполнением пропусков.
+// Без заполнения на оси остаются только интервалы с данными
+func queryHistory(store *TieredStore, query HistoryQuery) (HistoryResult, error) {
+	result := HistoryResult{Step: int64(query.Step / time.Second)}
+
+	from := stepStart(query.From, query.Step)
+	rollups, err := historyRollupsFor(store, query.Step, from, query.To)
+	if err != nil {
+		return result, err
+	}
+
+	var buckets []historyBucket
+	for start := from; start < query.To; start = nextStep(start, query.Step) {
+		rollup := rollups[start]
+		if rollup == nil && query.Fill == FillNone {
+			continue
+		}
+
+		bucket := historyBucket{index: len(buckets), rollup: rollup}
+		if rollup != nil {
+			bucket.metrics = rollup.Metrics()
+		}
+		buckets = append(buckets, bucket)
+		result.Timestamps = append(result.Timestamps, start)
+	}
+
+	for _, metric := range query.Metrics {
+		metric := metric
+		result.Series = append(result.Series, HistorySeries{
+			Metric: metric.name,
+			Values: seriesValues(buckets, query.Fill, func(b *historyBucket) (float64, bool) {
+				return metric.value(b.rollup, &b.metrics), true
+			}),
+		})
+
+		for _, dimension := range query.Dimensions {
+			split, ok := metric.breakdowns[dimension]
+			if !ok {
+				continue
+			}
+
+			// Разложение считаем один раз на интервал, а не на каждую серию
+			values := make([]map[string]float64, len(buckets))
+			for i := range buckets {
+				if buckets[i].rollup != nil {
+					values[i] = split(&buckets[i].metrics)
+				}
+			}
+
+			for _, key := range dimensionKeys(values, dimension) {
+				key := key
+				result.Series = append(result.Series, HistorySeries{
+					Metric:    metric.name,
+					Dimension: dimension,
+					Key:       key,
+					Values: seriesValues(buckets, query.Fill, func(b *historyBucket) (float64, bool) {
+						v, ok := values[b.index][key]
+						return v, ok
+					}),
+				})
+			}
+		}
+	}
+
+	// Ограничение применяем после заполнения, чтобы previous учитывал более ранние точки
+	if query.Limit > 0 && len(result.Timestamps) > query.Limit {
+		cut := len(result.Timestamps) - query.Limit
+		result.Timestamps = result.Timestamps[cut:]
+		for i := range result.Series {
+			result.Series[i].Values = result.Series[i].Values[cut:]
+		}
+	}
+	return result, nil
+}
+
+// Значения серии по интервалам оси. Пропуски заполняются по политике fill;
+// на общей оси пропуск без заполнения - null
+func seriesValues(buckets []historyBucket, fill FillPolicy, value func(b *historyBucket) (float64, bool)) []*float64 {
+	values := make([]*float64, len(buckets))
+	var previous *float64
+	for i := range buckets {
+		if buckets[i].rollup != nil {
+			if v, ok := value(&buckets[i]); ok {
+				values[i] = &v
+				previous = values[i]
+				continue
+			}
+		}
+
+		switch fill {
+		case FillZero:
+			zero := 0.0
+			values[i] = &zero
+		case FillPrevious:
+			values[i] = previous
+		}
+	}
+	return values
+}
+
+// Ключи измерения, встречающиеся в интервалах: этапы воронки по порядку, остальные по алфавиту
+func dimensionKeys(values []map[string]float64, dimension string) []string {
+	seen := make(map[string]bool)
+	for _, bucket := range values {
+		for key := range bucket {
+			seen[key] = true
+		}
+	}
+
+	if dimension == DimensionFunnelStage {
+		var keys []string
+		for _, stage := range funnelStages {
+			if seen[stage] {
+				keys = append(keys, stage)
+			}
+		}
+		return keys
+	}
+
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Ответ 400 на ошибку разбора запроса истории со списком допустимых значений
+func historyQueryErrorResponse(c *gin.Context, err error) {
+	response := gin.H{"error": err.Error()}
+	if queryErr, ok := err.(*historyQueryError); ok {
+		response[queryErr.field] = queryErr.valid
+	}
+	c.JSON(http.StatusBadRequest, response)
+}
+
+// Разбор и выполнение запроса истории, ошибки разбора отдаются клиенту как 400
+func runHistoryQuery(c *gin.Context) (HistoryResult, bool) {
+	query, err := parseHistoryQuery(c, time.Now(), historyQueryOptions{
+		period:    c.Param("period"),
+		maxPoints: maxHistoryPoints,
+	})
+	if err != nil {
+		historyQueryErrorResponse(c, err)
+		return HistoryResult{}, false
+	}
+
+	result, err := queryHistory(metricsStore, query)
+	if err != nil {
+		log.Printf("Error reading historical data: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read historical data"})
+		return HistoryResult{}, false
+	}
+	return result, true
+}
+
+// Обработчик /metrics/historical/:period/:metric - одна метрика в виде точек
+func handleHistoricalMetrics(c *gin.Context) {
+	result, ok := runHistoryQuery(c)
+	if !ok {
+		return
+	}
+
+	points := make([]HistoryPoint, len(result.Timestamps))
+	for i, ts := range result.Timestamps {
+		points[i] = HistoryPoint{Timestamp: ts, Value: result.Series[0].Values[i]}
+	}
+	c.JSON(http.StatusOK, points)
+}
+
+// Обработчик /metrics/historical/:period?metrics=...&dimensions=... - несколько
+// метрик и их разложения по регионам и источникам на общей оси времени
+func handleHistoricalSeries(c *gin.Context) {
+	if result, ok := runHistoryQuery(c); ok {
+		c.JSON(http.StatusOK, result)
+	}
+}
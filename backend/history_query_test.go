@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Полночь понедельника: от нее отсчитываются тики тестовой истории
+var historyTestStart = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+// Сутки и недели выравниваются по местной полуночи, поэтому тесты истории
+// идут в UTC, где нет перехода на летнее время
+func useUTC(t *testing.T) {
+	t.Helper()
+	local := time.Local
+	time.Local = time.UTC
+	t.Cleanup(func() { time.Local = local })
+}
+
+// Хранилище с сырыми тиками каждые 15 минут за hours часов от historyTestStart.
+// sales(hour) задает продажи каждого тика часа, отрицательное значение - час без данных
+func newSeededTieredStore(t *testing.T, hours int, sales func(hour int) int) *TieredStore {
+	t.Helper()
+	store := newTestTieredStore(t)
+	for hour := 0; hour < hours; hour++ {
+		value := sales(hour)
+		if value < 0 {
+			continue
+		}
+		for minute := 0; minute < 60; minute += 15 {
+			tick := testTick(historyTestStart + int64(hour*3600+minute*60))
+			tick.Sales = value
+			if err := store.Append(tick); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return store
+}
+
+// Продажи тиков по часам: 1, 2, два часа без данных, 5, 6
+func seededHistorySales(hour int) int {
+	return []int{1, 2, -1, -1, 5, 6}[hour]
+}
+
+func floatPtr(value float64) *float64 {
+	return &value
+}
+
+func formatValues(values []*float64) string {
+	result := "["
+	for i, value := range values {
+		if i > 0 {
+			result += " "
+		}
+		if value == nil {
+			result += "null"
+		} else {
+			result += fmt.Sprint(*value)
+		}
+	}
+	return result + "]"
+}
+
+func TestQueryHistory(t *testing.T) {
+	useUTC(t)
+	store := newSeededTieredStore(t, 6, seededHistorySales)
+	sales, _ := findHistoryMetric("sales")
+	hour := int64(3600)
+	start := historyTestStart
+
+	cases := []struct {
+		name       string
+		from, to   int64
+		step       time.Duration
+		fill       FillPolicy
+		limit      int
+		timestamps []int64
+		values     []*float64
+	}{
+		{
+			name: "no fill skips gaps",
+			from: start, to: start + 6*hour, step: time.Hour, fill: FillNone,
+			timestamps: []int64{start, start + hour, start + 4*hour, start + 5*hour},
+			values:     []*float64{floatPtr(4), floatPtr(8), floatPtr(20), floatPtr(24)},
+		},
+		{
+			name: "fill null",
+			from: start, to: start + 6*hour, step: time.Hour, fill: FillNull,
+			timestamps: []int64{start, start + hour, start + 2*hour, start + 3*hour, start + 4*hour, start + 5*hour},
+			values:     []*float64{floatPtr(4), floatPtr(8), nil, nil, floatPtr(20), floatPtr(24)},
+		},
+		{
+			name: "fill zero",
+			from: start, to: start + 6*hour, step: time.Hour, fill: FillZero,
+			timestamps: []int64{start, start + hour, start + 2*hour, start + 3*hour, start + 4*hour, start + 5*hour},
+			values:     []*float64{floatPtr(4), floatPtr(8), floatPtr(0), floatPtr(0), floatPtr(20), floatPtr(24)},
+		},
+		{
+			name: "fill previous across gaps",
+			from: start, to: start + 6*hour, step: time.Hour, fill: FillPrevious,
+			timestamps: []int64{start, start + hour, start + 2*hour, start + 3*hour, start + 4*hour, start + 5*hour},
+			values:     []*float64{floatPtr(4), floatPtr(8), floatPtr(8), floatPtr(8), floatPtr(20), floatPtr(24)},
+		},
+		{
+			name: "fill previous before the first point",
+			from: start - 2*hour, to: start + hour, step: time.Hour, fill: FillPrevious,
+			timestamps: []int64{start - 2*hour, start - hour, start},
+			values:     []*float64{nil, nil, floatPtr(4)},
+		},
+		{
+			// from округляется вниз до начала интервала, последний интервал обрезается по to
+			name: "unaligned from and to",
+			from: start + 1800, to: start + 4*hour + 1, step: time.Hour, fill: FillNone,
+			timestamps: []int64{start, start + hour, start + 4*hour},
+			values:     []*float64{floatPtr(4), floatPtr(8), floatPtr(5)},
+		},
+		{
+			name: "limit keeps the last points",
+			from: start, to: start + 6*hour, step: time.Hour, fill: FillNone, limit: 2,
+			timestamps: []int64{start + 4*hour, start + 5*hour},
+			values:     []*float64{floatPtr(20), floatPtr(24)},
+		},
+		{
+			name: "limit applies after fill previous",
+			from: start, to: start + 4*hour, step: time.Hour, fill: FillPrevious, limit: 2,
+			timestamps: []int64{start + 2*hour, start + 3*hour},
+			values:     []*float64{floatPtr(8), floatPtr(8)},
+		},
+		{
+			name: "daily step",
+			from: start + 5*hour, to: start + 24*hour, step: 24 * time.Hour, fill: FillNone,
+			timestamps: []int64{start},
+			values:     []*float64{floatPtr(56)},
+		},
+		{
+			name: "weekly step aligns to monday",
+			from: start + 3*24*hour, to: start + int64(week/time.Second), step: week, fill: FillNone,
+			timestamps: []int64{start},
+			values:     []*float64{floatPtr(56)},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result, err := queryHistory(store, HistoryQuery{
+				Metrics: []historyMetric{sales},
+				From:    c.from,
+				To:      c.to,
+				Step:    c.step,
+				Limit:   c.limit,
+				Fill:    c.fill,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Step != int64(c.step/time.Second) {
+				t.Fatalf("step %d, want %d", result.Step, int64(c.step/time.Second))
+			}
+			if !reflect.DeepEqual(result.Timestamps, c.timestamps) {
+				t.Fatalf("timestamps %v, want %v", result.Timestamps, c.timestamps)
+			}
+			if len(result.Series) != 1 {
+				t.Fatalf("expected one series, got %d", len(result.Series))
+			}
+			if got, want := formatValues(result.Series[0].Values), formatValues(c.values); got != want {
+				t.Fatalf("values %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestParseHistoryQueryRange(t *testing.T) {
+	useUTC(t)
+	gin.SetMode(gin.TestMode)
+	now := time.Unix(historyTestStart+10*3600+123, 0)
+	day := int64(24 * 3600)
+
+	cases := []struct {
+		name     string
+		query    string
+		from, to int64
+		step     time.Duration
+	}{
+		{"default window", "", now.Unix() + 1 - 7*day, now.Unix() + 1, time.Hour},
+		{"relative from", "from=-7d", now.Unix() - 7*day, now.Unix() + 1, time.Hour},
+		{"relative to", "from=-2h&to=-1h", now.Unix() - 7200, now.Unix() - 3600, time.Hour},
+		{"unaligned unix seconds", "from=1704067230&to=1704070805", 1704067230, 1704070805, time.Hour},
+		{"dates", "from=2023-12-31&to=2024-01-01&step=15m", historyTestStart - day, historyTestStart, 15 * time.Minute},
+		{"rfc3339", "from=2024-01-01T01:00:00Z&to=now", historyTestStart + 3600, now.Unix(), time.Hour},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+			ctx.Request = httptest.NewRequest(http.MethodGet, "/metrics/historical/hourly/sales?"+c.query, nil)
+			ctx.Params = gin.Params{{Key: "period", Value: "hourly"}, {Key: "metric", Value: "sales"}}
+
+			query, err := parseHistoryQuery(ctx, now, historyQueryOptions{period: "hourly", maxPoints: maxHistoryPoints})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if query.From != c.from || query.To != c.to || query.Step != c.step {
+				t.Fatalf("range %d..%d step %v, want %d..%d step %v", query.From, query.To, query.Step, c.from, c.to, c.step)
+			}
+		})
+	}
+}
+
+// Ответ /metrics/historical/:period/:metric остается массивом точек {timestamp, value}
+func TestHistoricalMetricsShape(t *testing.T) {
+	useUTC(t)
+	gin.SetMode(gin.TestMode)
+	store := newSeededTieredStore(t, 6, seededHistorySales)
+	previous := metricsStore
+	metricsStore = store
+	t.Cleanup(func() { metricsStore = previous })
+
+	r := gin.New()
+	r.GET("/metrics/historical/:period/:metric", handleHistoricalMetrics)
+	url := fmt.Sprintf("/metrics/historical/hourly/sales?from=%d&to=%d&fill=null", historyTestStart, historyTestStart+4*3600)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+
+	var points []map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &points); err != nil {
+		t.Fatalf("response is not an array of points: %v", err)
+	}
+	expected := []string{"4", "8", "null", "null"}
+	if len(points) != len(expected) {
+		t.Fatalf("expected %d points, got %d", len(expected), len(points))
+	}
+	for i, point := range points {
+		if len(point) != 2 {
+			t.Fatalf("point %d has fields %v, want timestamp and value", i, point)
+		}
+		if ts := string(point["timestamp"]); ts != fmt.Sprint(historyTestStart+int64(i)*3600) {
+			t.Fatalf("point %d: timestamp %s", i, ts)
+		}
+		if value := string(point["value"]); value != expected[i] {
+			t.Fatalf("point %d: value %s, want %s", i, value, expected[i])
+		}
+	}
+}
@@ -0,0 +1,758 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/gorilla/websocket"
+)
+
+// Политика обработки медленных клиентов, у которых переполнилась очередь отправки
+type SlowConsumerPolicy string
+
+const (
+	PolicyDropNewest SlowConsumerPolicy = "drop-newest" // Отбрасываем новый кадр, очередь не трогаем
+	PolicyDropOldest SlowConsumerPolicy = "drop-oldest" // Вытесняем самый старый кадр, клиент получает только свежие данные
+	PolicyDisconnect SlowConsumerPolicy = "disconnect"  // Отключаем клиента
+)
+
+// Конфигурация хаба рассылки
+type HubConfig struct {
+	SendQueueSize      int
+	SlowConsumerPolicy SlowConsumerPolicy
+	SnapshotInterval   int // Через сколько дельта-кадров клиент получает полный снимок
+	ReplayBufferSize   int // Сколько последних кадров хранится для докачки после переподключения
+
+	// Контроль живости соединений
+	PingInterval time.Duration // Интервал ping-фреймов WebSocket
+	PongTimeout  time.Duration // Сколько ждать pong или любое сообщение клиента до разрыва
+	WriteTimeout time.Duration // Таймаут записи одного сообщения
+	MaxLifetime  time.Duration // Максимальное время жизни соединения, 0 - без ограничения
+
+	// Интервалы тиков, которые могут выбрать клиенты. Базовый тик доступен всегда
+	Intervals []time.Duration
+}
+
+// Базовый интервал тика: с такой частотой генерируются и приходят из Redis метрики
+const tickInterval = time.Second
+
+// Статистика хаба
+type HubStats struct {
+	Clients         int    `json:"clients"`
+	FramesSent      uint64 `json:"framesSent"`
+	FramesDropped   uint64 `json:"framesDropped"`
+	SlowDisconnects uint64 `json:"slowDisconnects"`
+	ReapedIdle      uint64 `json:"reapedIdle"`     // Разорваны по таймауту pong или записи
+	ReapedLifetime  uint64 `json:"reapedLifetime"` // Закрыты по истечении времени жизни
+}
+
+// Получатель готовых кадров помимо клиентов хаба (Redis и т.п.).
+// Consume вызывается синхронно при публикации и не должен блокироваться
+type FrameSink interface {
+	Consume(frame *Frame)
+}
+
+// Хаб рассылки метрик: у каждого клиента своя ограниченная очередь и своя горутина записи
+type Hub struct {
+	// Счетчики идут первыми для выравнивания 64-битных атомарных операций
+	framesSent      uint64
+	framesDropped   uint64
+	slowDisconnects uint64
+	reapedIdle      uint64
+	reapedLifetime  uint64
+	draining        uint32 // Флаг остановки: новые клиенты не принимаются
+
+	config  HubConfig
+	mu      sync.RWMutex
+	clients map[*Client]struct{}
+
+	// Эпоха нумерации кадров, новая при каждом запуске: номера кадров после перезапуска
+	// начинаются заново, и позиция из прошлой эпохи не указывает на тот же кадр
+	epoch string
+
+	// Потоки кадров по интервалам, первый - базовый. Состояние потоков и получатели
+	// защищены publishMu, сам список после создания хаба не меняется
+	publishMu sync.Mutex
+	streams   []*stream
+	sinks     []FrameSink
+}
+
+// Поток кадров с одним интервалом тиков: своя нумерация, предыдущий кадр
+// для вычисления дельт и кольцевой буфер последних кадров для докачки
+type stream struct {
+	interval time.Duration
+	window   *windowAggregator // nil для базового потока
+	seq      uint64
+	last     *Frame
+	replay   []*Frame
+}
+
+// Размер очереди управляющих ответов клиента
+const controlQueueSize = 8
+
+// Клиент хаба. Не зависит от транспорта: кадры читаются из send, done закрывается при отключении
+type Client struct {
+	interval     int64 // Интервал тиков (time.Duration), атомарный, идет первым для выравнивания
+	topicsMu     sync.Mutex
+	topics       Topic // Маска подписки, меняется из цикла чтения вместе с needSnapshot под topicsMu
+	needSnapshot bool  // Флаг запроса полного снимка
+	hub          *Hub
+	send         chan *Frame
+	control      chan []byte // Ответы на управляющие сообщения, отправляются вне очереди кадров
+	done         chan struct{}
+	closeOnce    sync.Once
+	closeCode    int    // Код close-фрейма, выставляется до закрытия done
+	closeText    string // Причина закрытия
+	clean        uint32 // Флаг корректного закрытия: клиент подтвердил close-фрейм
+	format       WireFormat
+
+	// Кадры для докачки, отправляются горутиной записи перед живым потоком
+	backlog []*Frame
+
+	// Состояние дельта-режима, используется только горутиной записи
+	delta         bool
+	lastSeq       uint64
+	lastInterval  time.Duration
+	sinceSnapshot int
+}
+
+// Создание хаба с проверкой конфигурации
+func NewHub(config HubConfig) (*Hub, error) {
+	if config.SendQueueSize <= 0 {
+		return nil, fmt.Errorf("invalid send queue size: %d", config.SendQueueSize)
+	}
+	if config.SnapshotInterval <= 0 {
+		return nil, fmt.Errorf("invalid snapshot interval: %d", config.SnapshotInterval)
+	}
+	if config.ReplayBufferSize < 0 {
+		return nil, fmt.Errorf("invalid replay buffer size: %d", config.ReplayBufferSize)
+	}
+	if config.PingInterval <= 0 || config.PongTimeout <= config.PingInterval {
+		return nil, fmt.Errorf("pong timeout (%v) must exceed a positive ping interval (%v)", config.PongTimeout, config.PingInterval)
+	}
+	if config.WriteTimeout <= 0 {
+		return nil, fmt.Errorf("invalid write timeout: %v", config.WriteTimeout)
+	}
+	if config.MaxLifetime < 0 {
+		return nil, fmt.Errorf("invalid max lifetime: %v", config.MaxLifetime)
+	}
+
+	switch config.SlowConsumerPolicy {
+	case PolicyDropNewest, PolicyDropOldest, PolicyDisconnect:
+	default:
+		return nil, fmt.Errorf("unknown slow consumer policy: %q", config.SlowConsumerPolicy)
+	}
+
+	intervals := append([]time.Duration{tickInterval}, config.Intervals...)
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+
+	var streams []*stream
+	for _, interval := range intervals {
+		if interval <= 0 || interval%tickInterval != 0 {
+			return nil, fmt.Errorf("invalid tick interval %v: must be a positive multiple of %v", interval, tickInterval)
+		}
+		if len(streams) > 0 && streams[len(streams)-1].interval == interval {
+			continue
+		}
+
+		s := &stream{interval: interval, replay: make([]*Frame, config.ReplayBufferSize)}
+		if interval != tickInterval {
+			s.window = newWindowAggregator(int64(interval / time.Second))
+		}
+		streams = append(streams, s)
+	}
+	if streams[0].interval != tickInterval {
+		return nil, fmt.Errorf("tick intervals must not be shorter than %v", tickInterval)
+	}
+
+	return &Hub{
+		config:  config,
+		clients: make(map[*Client]struct{}),
+		epoch:   gofakeit.UUID()[:8],
+		streams: streams,
+	}, nil
+}
+
+// Доступные интервалы тиков по возрастанию
+func (h *Hub) Intervals() []time.Duration {
+	intervals := make([]time.Duration, len(h.streams))
+	for i, s := range h.streams {
+		intervals[i] = s.interval
+	}
+	return intervals
+}
+
+// Поток с заданным интервалом, nil если интервал не поддерживается
+func (h *Hub) streamFor(interval time.Duration) *stream {
+	for _, s := range h.streams {
+		if s.interval == interval {
+			return s
+		}
+	}
+	return nil
+}
+
+// Параметры подключения клиента
+type ClientOptions struct {
+	Topics   Topic         // Начальная подписка
+	Delta    bool          // Полный снимок, а затем только изменения
+	Format   WireFormat    // Формат кадров, согласованный через подпротокол
+	Interval time.Duration // Интервал тиков, по умолчанию базовый
+}
+
+// Регистрация нового клиента. Клиент сразу получает последний кадр своего потока,
+// чтобы не ждать закрытия окна на длинных интервалах
+func (h *Hub) Register(options ClientOptions) *Client {
+	h.publishMu.Lock()
+	defer h.publishMu.Unlock()
+
+	client := h.register(options)
+	if last := h.streamFor(client.Interval()).last; last != nil {
+		client.backlog = []*Frame{last}
+	}
+	return client
+}
+
+// Регистрация клиента без начальных кадров, вызывается под publishMu
+func (h *Hub) register(options ClientOptions) *Client {
+	if h.streamFor(options.Interval) == nil {
+		options.Interval = tickInterval
+	}
+
+	client := &Client{
+		interval: int64(options.Interval),
+		topics:   options.Topics,
+		hub:      h,
+		send:     make(chan *Frame, h.config.SendQueueSize),
+		control:  make(chan []byte, controlQueueSize),
+		done:     make(chan struct{}),
+		format:   options.Format,
+		delta:    options.Delta,
+	}
+
+	h.mu.Lock()
+	h.clients[client] = struct{}{}
+	h.mu.Unlock()
+
+	return client
+}
+
+// Регистрация клиента, продолжающего поток после кадра since.
+// Пропущенные кадры из буфера отправляются до живых; если разрыв старше буфера,
+// since относится к потоку другого интервала или к прошлому запуску сервера,
+// клиент сразу получает актуальный полный снимок
+func (h *Hub) Resume(options ClientOptions, since StreamPosition) *Client {
+	// Пока держим publishMu, новые кадры не публикуются, и докачка стыкуется с живым потоком
+	h.publishMu.Lock()
+	defer h.publishMu.Unlock()
+
+	client := h.register(options)
+	s := h.streamFor(client.Interval())
+
+	if frames, ok := s.framesSince(since); ok && since.Epoch == h.epoch {
+		client.backlog = frames
+		// Клиент уже имеет состояние на момент since, дельты продолжаются без снимка
+		client.lastSeq = since.Seq
+		client.lastInterval = s.interval
+	} else if s.last != nil {
+		client.backlog = []*Frame{s.last}
+	}
+
+	return client
+}
+
+// Кадры после since из кольцевого буфера. false, если часть кадров уже вытеснена
+// или since не относится к текущему потоку
+func (s *stream) framesSince(since StreamPosition) ([]*Frame, bool) {
+	if since.Interval != s.interval || since.Seq > s.seq {
+		return nil, false
+	}
+
+	missed := s.seq - since.Seq
+	if missed > uint64(len(s.replay)) {
+		return nil, false
+	}
+
+	frames := make([]*Frame, 0, missed)
+	for seq := since.Seq + 1; seq <= s.seq; seq++ {
+		frame := s.replay[seq%uint64(len(s.replay))]
+		if frame == nil || frame.Seq != seq {
+			return nil, false
+		}
+		frames = append(frames, frame)
+	}
+	return frames, true
+}
+
+// Удаление клиента из хаба
+func (h *Hub) Unregister(client *Client) {
+	h.mu.Lock()
+	delete(h.clients, client)
+	h.mu.Unlock()
+
+	client.Close()
+}
+
+// Подключение дополнительного получателя кадров
+func (h *Hub) AddSink(sink FrameSink) {
+	h.publishMu.Lock()
+	defer h.publishMu.Unlock()
+	h.sinks = append(h.sinks, sink)
+}
+
+// Публикация метрик очередного тика: присваивает номер, вычисляет дельту
+// относительно предыдущего кадра, рассылает кадр клиентам и получателям.
+// Локальный тик также попадает в окна агрегированных потоков, закрывшиеся окна публикуются в своих потоках.
+// origin - идентификатор инстанса-источника, пустой для локальных метрик.
+// Возвращает кадр базового потока
+func (h *Hub) Publish(metrics MetricsData, origin string) (*Frame, error) {
+	h.publishMu.Lock()
+	defer h.publishMu.Unlock()
+
+	frame, err := h.publishTo(h.streams[0], metrics, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	// Получатели (Redis и т.п.) работают только с базовым потоком,
+	// агрегаты каждый инстанс считает сам
+	for _, sink := range h.sinks {
+		sink.Consume(frame)
+	}
+
+	// Кадры других инстансов в окна не попадают: они дублировали бы тики той же секунды,
+	// и суммы продаж и ошибок в сводке увеличивались бы в число инстансов
+	if origin != "" {
+		return frame, nil
+	}
+	for _, s := range h.streams[1:] {
+		for _, aggregated := range s.window.Add(metrics) {
+			if _, err := h.publishTo(s, aggregated, ""); err != nil {
+				log.Printf("Error encoding %v metrics frame: %v", s.interval, err)
+			}
+		}
+	}
+	return frame, nil
+}
+
+// Публикация кадра в потоке, вызывается под publishMu
+func (h *Hub) publishTo(s *stream, metrics MetricsData, origin string) (*Frame, error) {
+	frame, err := NewFrame(s.seq+1, metrics, s.last)
+	if err != nil {
+		return nil, err
+	}
+	frame.Origin = origin
+	frame.Epoch = h.epoch
+	frame.Interval = s.interval
+
+	s.seq = frame.Seq
+	s.last = frame
+	if len(s.replay) > 0 {
+		s.replay[frame.Seq%uint64(len(s.replay))] = frame
+	}
+	h.Broadcast(frame)
+	return frame, nil
+}
+
+// Рассылка кадра клиентам его потока. Никогда не блокируется на медленных клиентах
+func (h *Hub) Broadcast(frame *Frame) {
+	var slow []*Client
+
+	h.mu.RLock()
+	for client := range h.clients {
+		if client.Interval() != frame.Interval {
+			continue
+		}
+		if !client.enqueue(frame) {
+			slow = append(slow, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	// Отключаем медленных клиентов вне блокировки чтения
+	for _, client := range slow {
+		atomic.AddUint64(&h.slowDisconnects, 1)
+		log.Printf("Disconnecting slow client: send queue is full")
+		client.CloseWith(websocket.CloseTryAgainLater, "Slow consumer")
+		h.Unregister(client)
+	}
+}
+
+// Количество подключенных клиентов
+func (h *Hub) Count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+// Снимок статистики хаба
+func (h *Hub) Stats() HubStats {
+	return HubStats{
+		Clients:         h.Count(),
+		FramesSent:      atomic.LoadUint64(&h.framesSent),
+		FramesDropped:   atomic.LoadUint64(&h.framesDropped),
+		SlowDisconnects: atomic.LoadUint64(&h.slowDisconnects),
+		ReapedIdle:      atomic.LoadUint64(&h.reapedIdle),
+		ReapedLifetime:  atomic.LoadUint64(&h.reapedLifetime),
+	}
+}
+
+// Результат остановки хаба
+type DrainResult struct {
+	Clients int // Сколько клиентов было подключено в начале остановки
+	Clean   int // Сколько из них закрылись корректно до истечения таймаута
+}
+
+// Начало остановки: новые клиенты больше не принимаются, /health отвечает 503,
+// подключенные клиенты продолжают получать кадры
+func (h *Hub) StartDraining() {
+	atomic.StoreUint32(&h.draining, 1)
+}
+
+// Остановка хаба перед завершением работы: новые клиенты больше не принимаются,
+// всем подключенным отправляется close-фрейм с подсказкой переподключиться.
+// Ждет отключения клиентов не дольше timeout
+func (h *Hub) Drain(timeout time.Duration, code int, text string) DrainResult {
+	h.StartDraining()
+
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		client.CloseWith(code, text)
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(50 * time.Millisecond)
+	defer poll.Stop()
+
+	for h.Count() > 0 {
+		select {
+		case <-poll.C:
+		case <-deadline.C:
+			log.Printf("Drain timeout (%v) expired with %d clients still connected", timeout, h.Count())
+			return h.drainResult(clients)
+		}
+	}
+	return h.drainResult(clients)
+}
+
+func (h *Hub) drainResult(clients []*Client) DrainResult {
+	result := DrainResult{Clients: len(clients)}
+	for _, client := range clients {
+		if atomic.LoadUint32(&client.clean) == 1 {
+			result.Clean++
+		}
+	}
+	return result
+}
+
+// Идет ли остановка хаба
+func (h *Hub) Draining() bool {
+	return atomic.LoadUint32(&h.draining) == 1
+}
+
+// Учет соединения, разорванного по таймауту
+func (h *Hub) countIdleReaped() {
+	atomic.AddUint64(&h.reapedIdle, 1)
+}
+
+// Таймер ограничения времени жизни соединения. nil-канал, если ограничения нет
+func (h *Hub) lifetimeTimer() (<-chan time.Time, func()) {
+	if h.config.MaxLifetime == 0 {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(h.config.MaxLifetime)
+	return timer.C, func() { timer.Stop() }
+}
+
+// Отметка о корректном закрытии соединения
+func (c *Client) markClean() {
+	atomic.StoreUint32(&c.clean, 1)
+}
+
+// Закрыт ли клиент
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Закрытие клиента по истечении времени жизни. Клиент может сразу переподключиться с ?since=
+func (c *Client) expire() {
+	atomic.AddUint64(&c.hub.reapedLifetime, 1)
+	c.CloseWith(websocket.CloseGoingAway, "Max connection lifetime reached")
+}
+
+// Постановка кадра в очередь клиента согласно политике.
+// Возвращает false, если клиента нужно отключить
+func (c *Client) enqueue(frame *Frame) bool {
+	select {
+	case <-c.done:
+		return true
+	case c.send <- frame:
+		return true
+	default:
+	}
+
+	// Очередь переполнена
+	switch c.hub.config.SlowConsumerPolicy {
+	case PolicyDisconnect:
+		return false
+	case PolicyDropOldest:
+		select {
+		case <-c.send:
+			atomic.AddUint64(&c.hub.framesDropped, 1)
+		default:
+		}
+		select {
+		case c.send <- frame:
+			return true
+		default:
+		}
+	}
+
+	atomic.AddUint64(&c.hub.framesDropped, 1)
+	return true
+}
+
+// Текущая подписка клиента
+func (c *Client) Topics() Topic {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	return c.topics
+}
+
+// Замена подписки клиента. Для новых секций дельта неприменима, поэтому запрашиваем снимок.
+// Маска и флаг меняются под одной блокировкой: горутина записи, увидевшая новую секцию,
+// увидит и запрос снимка
+func (c *Client) SetTopics(topics Topic) {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	if topics&^c.topics != 0 {
+		c.needSnapshot = true
+	}
+	c.topics = topics
+}
+
+// Текущий интервал тиков клиента
+func (c *Client) Interval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.interval))
+}
+
+// Переключение клиента на поток с другим интервалом. Последний кадр нового потока
+// отправляется сразу, дальше клиент получает кадры с новой частотой
+func (c *Client) SetInterval(interval time.Duration) error {
+	h := c.hub
+	s := h.streamFor(interval)
+	if s == nil {
+		return fmt.Errorf("unsupported interval: %v", interval)
+	}
+
+	// Под publishMu кадр нового потока не может проскочить между сменой интервала и отправкой last
+	h.publishMu.Lock()
+	defer h.publishMu.Unlock()
+
+	if time.Duration(atomic.SwapInt64(&c.interval, int64(interval))) == interval {
+		return nil
+	}
+	if s.last != nil && !c.enqueue(s.last) {
+		log.Printf("Send queue is full, client will get the %v stream with the next frame", interval)
+	}
+	return nil
+}
+
+// Запрос полного снимка вместо следующей дельты
+func (c *Client) RequestSnapshot() {
+	c.topicsMu.Lock()
+	c.needSnapshot = true
+	c.topicsMu.Unlock()
+}
+
+// Подписка для очередного кадра и снятый вместе с ней флаг запроса снимка
+func (c *Client) takeTopics() (Topic, bool) {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	requested := c.needSnapshot
+	c.needSnapshot = false
+	return c.topics, requested
+}
+
+// Выбор представления кадра для клиента. В дельта-режиме снимок отправляется
+// первым кадром, по запросу, каждые SnapshotInterval кадров, после пропуска кадров
+// и при смене интервала (у каждого потока своя цепочка дельт)
+func (c *Client) encode(frame *Frame) ([]byte, error) {
+	topics, requested := c.takeTopics()
+	if !c.delta {
+		return frame.Encode(c.format, topics, false)
+	}
+
+	snapshot := requested ||
+		c.lastSeq == 0 ||
+		frame.Interval != c.lastInterval ||
+		frame.Seq != c.lastSeq+1 ||
+		c.sinceSnapshot >= c.hub.config.SnapshotInterval
+
+	c.lastSeq = frame.Seq
+	c.lastInterval = frame.Interval
+	if snapshot {
+		c.sinceSnapshot = 0
+		return frame.Encode(c.format, topics, false)
+	}
+
+	c.sinceSnapshot++
+	return frame.Encode(c.format, topics, true)
+}
+
+// Отправка управляющего ответа клиенту. Если очередь ответов заполнена, ответ отбрасывается
+func (c *Client) Reply(reply interface{}) {
+	data, err := encodeMessage(c.format, reply)
+	if err != nil {
+		log.Printf("Error marshaling control reply: %v", err)
+		return
+	}
+
+	select {
+	case c.control <- data:
+	default:
+		log.Printf("Control queue is full, dropping reply")
+	}
+}
+
+// Закрытие клиента. Безопасно вызывать несколько раз
+func (c *Client) Close() {
+	c.CloseWith(websocket.CloseNormalClosure, "")
+}
+
+// Закрытие клиента с указанием кода и причины для close-фрейма.
+// Учитывается только первый вызов
+func (c *Client) CloseWith(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeText = text
+		close(c.done)
+	})
+}
+
+// Горутина записи кадров клиента в WebSocket. Также отправляет ping-фреймы
+// и закрывает соединение по истечении времени жизни.
+// При ошибке записи закрывает соединение, чтобы цикл чтения тоже завершился.
+// После отправки close-фрейма соединение остается открытым: цикл чтения ждет
+// ответный close-фрейм клиента, но не дольше WriteTimeout
+func (c *Client) writeWebSocket(ws *websocket.Conn) {
+	handshake := false
+	defer func() {
+		if !handshake {
+			ws.Close()
+		}
+	}()
+
+	messageType := websocket.TextMessage
+	if c.format == FormatMsgpack {
+		messageType = websocket.BinaryMessage
+	}
+
+	pingTicker := time.NewTicker(c.hub.config.PingInterval)
+	defer pingTicker.Stop()
+
+	expired, stopLifetime := c.hub.lifetimeTimer()
+	defer stopLifetime()
+
+	// Сначала докачиваем пропущенные кадры
+	for _, frame := range c.backlog {
+		if !c.writeFrame(ws, messageType, frame) {
+			return
+		}
+	}
+	c.backlog = nil
+
+	for {
+		select {
+		case data := <-c.control:
+			if !c.writeMessage(ws, messageType, data) {
+				return
+			}
+
+		case frame := <-c.send:
+			if !c.writeFrame(ws, messageType, frame) {
+				return
+			}
+
+		case <-pingTicker.C:
+			if !c.writeMessage(ws, websocket.PingMessage, nil) {
+				return
+			}
+
+		case <-expired:
+			c.expire()
+
+		case <-c.done:
+			handshake = c.writeClose(ws)
+			return
+		}
+	}
+}
+
+// Отправка close-фрейма. true, если фрейм отправлен и цикл чтения должен дождаться ответа клиента
+func (c *Client) writeClose(ws *websocket.Conn) bool {
+	deadline := time.Now().Add(c.hub.config.WriteTimeout)
+	ws.SetWriteDeadline(deadline)
+	if err := ws.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(c.closeCode, c.closeText)); err != nil {
+		return false
+	}
+	// Ограничиваем ожидание ответного close-фрейма
+	ws.SetReadDeadline(deadline)
+	return true
+}
+
+// Запись одного кадра. false, если соединение нужно закрыть
+func (c *Client) writeFrame(ws *websocket.Conn, messageType int, frame *Frame) bool {
+	data, err := c.encode(frame)
+	if err != nil {
+		// Кадр не удалось сериализовать, пропускаем его
+		log.Printf("Error encoding metrics frame %d: %v", frame.Seq, err)
+		return true
+	}
+
+	if !c.writeMessage(ws, messageType, data) {
+		return false
+	}
+	atomic.AddUint64(&c.hub.framesSent, 1)
+	return true
+}
+
+// Запись сообщения с таймаутом. Зависшее на записи соединение считается мертвым
+func (c *Client) writeMessage(ws *websocket.Conn, messageType int, data []byte) bool {
+	ws.SetWriteDeadline(time.Now().Add(c.hub.config.WriteTimeout))
+	if err := ws.WriteMessage(messageType, data); err != nil {
+		if isTimeout(err) {
+			c.hub.countIdleReaped()
+		}
+		log.Printf("Error writing to WebSocket: %v", err)
+		c.Close()
+		return false
+	}
+	return true
+}
+
+// Ошибка истекшего дедлайна чтения или записи
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestHub(t testing.TB, config HubConfig) *Hub {
+	t.Helper()
+	if config.SendQueueSize == 0 {
+		config.SendQueueSize = 16
+	}
+	if config.SlowConsumerPolicy == "" {
+		config.SlowConsumerPolicy = PolicyDropOldest
+	}
+	if config.SnapshotInterval == 0 {
+		config.SnapshotInterval = 30
+	}
+	if config.ReplayBufferSize == 0 {
+		config.ReplayBufferSize = 64
+	}
+	config.PingInterval = 30 * time.Second
+	config.PongTimeout = time.Minute
+	config.WriteTimeout = 10 * time.Second
+
+	hub, err := NewHub(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hub
+}
+
+// Последовательность тиков генератора с историческими картами, как в рабочей рассылке
+func benchmarkTicks(n int) []MetricsData {
+	generator := NewCoherentDataGenerator(nil)
+	generator.source = newGeneratorSource(1)
+	generator.rng = rand.New(generator.source)
+
+	ticks := make([]MetricsData, n)
+	for i := range ticks {
+		ticks[i] = generator.GenerateMetrics()
+	}
+	return ticks
+}
+
+// Подписки клиентов: большинство на все топики, остальные на типичные наборы панелей
+var benchmarkSubscriptions = []Topic{
+	AllTopics,
+	AllTopics,
+	TopicKPI | TopicErrors,
+	TopicKPI | TopicRegional | TopicSources,
+	TopicHistorical,
+}
+
+var benchmarkFormats = []struct {
+	name   string
+	format WireFormat
+}{
+	{"json", FormatJSON},
+	{"msgpack", FormatMsgpack},
+}
+
+// Публикация тика с раздачей кадра всем клиентам. Горутины записи заменены последовательной
+// выборкой из очередей и сериализацией, чтобы учитывалась стоимость кадра для каждого клиента.
+// baseline повторяет исходную рассылку: каждый клиент получает собственную сериализацию тика
+func BenchmarkHubPublish(b *testing.B) {
+	ticks := benchmarkTicks(64)
+	for _, clients := range []int{1000, 10000} {
+		b.Run(fmt.Sprintf("clients=%d/baseline", clients), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				tick := ticks[i%len(ticks)]
+				for c := 0; c < clients; c++ {
+					if _, err := json.Marshal(tick); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+
+		for _, format := range benchmarkFormats {
+			b.Run(fmt.Sprintf("clients=%d/%s", clients, format.name), func(b *testing.B) {
+				hub := newTestHub(b, HubConfig{})
+				registered := make([]*Client, clients)
+				for i := range registered {
+					registered[i] = hub.Register(ClientOptions{
+						Topics: benchmarkSubscriptions[i%len(benchmarkSubscriptions)],
+						Delta:  true,
+						Format: format.format,
+					})
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := hub.Publish(ticks[i%len(ticks)], ""); err != nil {
+						b.Fatal(err)
+					}
+					for _, client := range registered {
+						if _, err := client.encode(<-client.send); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// Создание кадра и сборка сообщений под подписки клиентов, снимков и дельт.
+// Клиенты с одинаковой подпиской разделяют одно закэшированное сообщение
+func BenchmarkFrameEncode(b *testing.B) {
+	ticks := benchmarkTicks(64)
+	for _, clients := range []int{1000, 10000} {
+		for _, format := range benchmarkFormats {
+			b.Run(fmt.Sprintf("clients=%d/%s", clients, format.name), func(b *testing.B) {
+				b.ReportAllocs()
+				var prev *Frame
+				for i := 0; i < b.N; i++ {
+					frame, err := NewFrame(uint64(i+1), ticks[i%len(ticks)], prev)
+					if err != nil {
+						b.Fatal(err)
+					}
+					for c := 0; c < clients; c++ {
+						topics := benchmarkSubscriptions[c%len(benchmarkSubscriptions)]
+						if _, err := frame.Encode(format.format, topics, c%10 != 0); err != nil {
+							b.Fatal(err)
+						}
+					}
+					prev = frame
+				}
+			})
+		}
+	}
+}
+
+// Смена подписки во время рассылки: дельта никогда не содержит секцию,
+// которой не было в последнем полученном клиентом снимке
+func TestSetTopicsWhilePublishing(t *testing.T) {
+	hub := newTestHub(t, HubConfig{SendQueueSize: 1024, SnapshotInterval: 1 << 30})
+	client := hub.Register(ClientOptions{Topics: TopicKPI, Delta: true})
+	ticks := benchmarkTicks(32)
+
+	const frames = 2000
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i < frames; i++ {
+			if _, err := hub.Publish(ticks[i%len(ticks)], ""); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// Переключаем подписку, пока идет рассылка
+	toggled := make(chan struct{})
+	go func() {
+		defer close(toggled)
+		subscriptions := []Topic{TopicKPI, TopicKPI | TopicRegional, TopicKPI | TopicErrors | TopicFunnel, TopicSources, AllTopics}
+		for i := 0; ; i++ {
+			select {
+			case <-published:
+				return
+			default:
+			}
+			client.SetTopics(subscriptions[i%len(subscriptions)])
+		}
+	}()
+
+	// Горутина записи: кадры сериализуются по мере поступления, ключи дельт сверяются со снимком
+	known := map[string]bool{}
+	snapshots, deltas := 0, 0
+	for received := 0; received < frames; received++ {
+		data, err := client.encode(<-client.send)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var message map[string]json.RawMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(message["type"]) == `"snapshot"` {
+			snapshots++
+			known = map[string]bool{}
+			for key := range message {
+				known[key] = true
+			}
+			continue
+		}
+		deltas++
+		for key := range message {
+			if !known[key] {
+				t.Fatalf("delta %s has section %q missing from the last snapshot", message["seq"], key)
+			}
+		}
+	}
+	<-toggled
+
+	if snapshots < 2 || deltas == 0 {
+		t.Fatalf("expected both snapshots and deltas, got %d and %d", snapshots, deltas)
+	}
+}
+
+// Кадры других инстансов идут в секундный поток, но не в окна агрегированных потоков:
+// иначе продажи за окно умножались бы на число инстансов
+func TestRemoteFramesSkipWindows(t *testing.T) {
+	hub := newTestHub(t, HubConfig{Intervals: []time.Duration{5 * time.Second}})
+	base := hub.Register(ClientOptions{Topics: AllTopics})
+	windowed := hub.Register(ClientOptions{Topics: AllTopics, Interval: 5 * time.Second})
+
+	start := int64(1700000000) // Кратно 5 секундам
+	for ts := start; ts < start+5; ts++ {
+		for _, origin := range []string{"", "instance-b"} {
+			if _, err := hub.Publish(testTick(ts), origin); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if len(base.send) != 10 {
+		t.Fatalf("base stream got %d frames, want 10", len(base.send))
+	}
+	if len(windowed.send) != 1 {
+		t.Fatalf("5s stream got %d frames, want 1", len(windowed.send))
+	}
+	if frame := <-windowed.send; frame.Metrics.Sales != 5*3 || frame.Origin != "" {
+		t.Fatalf("5s window: sales %d from origin %q, want 15 from local ticks", frame.Metrics.Sales, frame.Origin)
+	}
+}
+
+// Медленный клиент с переполненной очередью: какие кадры остаются в очереди
+// и отключается ли клиент, зависит от политики
+func TestSlowConsumerPolicies(t *testing.T) {
+	tests := []struct {
+		policy       SlowConsumerPolicy
+		queued       []uint64 // Номера кадров, оставшихся в очереди
+		dropped      uint64
+		disconnected bool
+	}{
+		{PolicyDropNewest, []uint64{1, 2, 3}, 2, false},
+		{PolicyDropOldest, []uint64{3, 4, 5}, 2, false},
+		{PolicyDisconnect, []uint64{1, 2, 3}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			hub := newTestHub(t, HubConfig{SendQueueSize: 3, SlowConsumerPolicy: tt.policy})
+			client := hub.Register(ClientOptions{Topics: AllTopics})
+
+			// Клиент ничего не читает: очередь заполняют первые три кадра
+			start := int64(1700000000)
+			for ts := start; ts < start+5; ts++ {
+				if _, err := hub.Publish(testTick(ts), ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var queued []uint64
+			for len(client.send) > 0 {
+				queued = append(queued, (<-client.send).Seq)
+			}
+			if fmt.Sprint(queued) != fmt.Sprint(tt.queued) {
+				t.Fatalf("queued frames %v, want %v", queued, tt.queued)
+			}
+
+			stats := hub.Stats()
+			if stats.FramesDropped != tt.dropped {
+				t.Fatalf("dropped %d frames, want %d", stats.FramesDropped, tt.dropped)
+			}
+
+			select {
+			case <-client.done:
+				if !tt.disconnected {
+					t.Fatal("client was disconnected")
+				}
+				if client.closeCode != websocket.CloseTryAgainLater || stats.SlowDisconnects != 1 || stats.Clients != 0 {
+					t.Fatalf("close code %d, %d slow disconnects, %d clients left", client.closeCode, stats.SlowDisconnects, stats.Clients)
+				}
+			default:
+				if tt.disconnected {
+					t.Fatal("slow client is still connected")
+				}
+				if stats.SlowDisconnects != 0 || stats.Clients != 1 {
+					t.Fatalf("%d slow disconnects, %d clients left", stats.SlowDisconnects, stats.Clients)
+				}
+			}
+		})
+	}
+}
+
+// Докачка продолжается только в потоке и эпохе, из которых пришла позиция; номер кадра
+// чужого потока, прошлого запуска сервера или без интервала приводит к полному снимку
+func TestResumeChecksStream(t *testing.T) {
+	hub := newTestHub(t, HubConfig{Intervals: []time.Duration{5 * time.Second}})
+	start := int64(1700000000)
+	for ts := start; ts < start+20; ts++ {
+		if _, err := hub.Publish(testTick(ts), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		since    string   // E заменяется эпохой хаба
+		backlog  []uint64 // Номера кадров, досылаемых клиенту
+		lastSeq  uint64   // 0 - первым уходит полный снимок
+	}{
+		{"same stream", tickInterval, "E:1:17", []uint64{18, 19, 20}, 17},
+		{"aggregated stream", 5 * time.Second, "E:5:2", []uint64{3, 4}, 2},
+		{"base position on aggregated stream", 5 * time.Second, "E:1:2", []uint64{4}, 0},
+		{"aggregated position on base stream", tickInterval, "E:5:3", []uint64{20}, 0},
+		{"previous epoch", tickInterval, "E0:1:17", []uint64{20}, 0},
+		{"position without epoch", tickInterval, "1:17", []uint64{20}, 0},
+		{"legacy seq", tickInterval, "17", []uint64{20}, 0},
+		{"future seq", tickInterval, "E:1:21", []uint64{20}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			since, err := parseStreamPosition(strings.Replace(tt.since, "E", hub.epoch, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := hub.Resume(ClientOptions{Topics: AllTopics, Delta: true, Interval: tt.interval}, since)
+			defer hub.Unregister(client)
+
+			var backlog []uint64
+			for _, frame := range client.backlog {
+				backlog = append(backlog, frame.Seq)
+			}
+			if fmt.Sprint(backlog) != fmt.Sprint(tt.backlog) || client.lastSeq != tt.lastSeq {
+				t.Fatalf("backlog %v after seq %d, want %v after %d", backlog, client.lastSeq, tt.backlog, tt.lastSeq)
+			}
+		})
+	}
+}
+
+func TestParseStreamPosition(t *testing.T) {
+	for value, want := range map[string]StreamPosition{
+		"3f9a1c2e:5:42": {Epoch: "3f9a1c2e", Interval: 5 * time.Second, Seq: 42},
+		"3f9a1c2e:1:0":  {Epoch: "3f9a1c2e", Interval: time.Second},
+		"5:42":          {Interval: 5 * time.Second, Seq: 42},
+		"42":            {Seq: 42},
+	} {
+		got, err := parseStreamPosition(value)
+		if err != nil || got != want {
+			t.Errorf("%q: got %+v, %v, want %+v", value, got, err, want)
+		}
+		if want.Epoch != "" && got.String() != value {
+			t.Errorf("%q formats back as %q", value, got.String())
+		}
+	}
+	for _, value := range []string{"", ":42", "5:", "0:42", "-5:42", "5s:42", "5:-1", ":5:42", "e:0:42", "e:5:", "e:5:4:2"} {
+		if _, err := parseStreamPosition(value); err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+}
+
+// Запрос снимка имеет смысл только в дельта-режиме: в полном режиме клиент получает ошибку,
+// в дельта-режиме ответом служит следующий кадр-снимок
+func TestSnapshotAction(t *testing.T) {
+	hub := newTestHub(t, HubConfig{})
+
+	full := hub.Register(ClientOptions{Topics: AllTopics})
+	handleControlMessage(full, []byte(`{"action": "snapshot"}`))
+	select {
+	case data := <-full.control:
+		var reply ControlReply
+		if err := json.Unmarshal(data, &reply); err != nil || reply.Type != "error" {
+			t.Fatalf("full mode reply %s", data)
+		}
+	default:
+		t.Fatal("full mode snapshot request got no reply")
+	}
+
+	delta := hub.Register(ClientOptions{Topics: AllTopics, Delta: true})
+	handleControlMessage(delta, []byte(`{"action": "snapshot"}`))
+	if len(delta.control) != 0 {
+		t.Fatalf("delta mode snapshot request got a reply: %s", <-delta.control)
+	}
+	if _, requested := delta.takeTopics(); !requested {
+		t.Fatal("delta mode snapshot request was not recorded")
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Метрики, которые принимает API приема
+const (
+	IngestActiveUsers         = "activeUsers"         // Текущее число пользователей, последнее значение серии
+	IngestServerLoad          = "serverLoad"          // Нагрузка, %, последнее значение серии
+	IngestDatabaseConnections = "databaseConnections" // Подключения к БД, последнее значение серии
+	IngestSales               = "sales"               // Число продаж с прошлой отправки
+	IngestErrors              = "errors"              // Число ошибок типа errorType с прошлой отправки
+	IngestResponseTime        = "responseTime"        // Время ответа в мс для count запросов
+)
+
+// Метки, допустимые для каждой метрики
+var ingestMetricLabels = map[string][]string{
+	IngestActiveUsers:         {"region", "source"},
+	IngestServerLoad:          nil,
+	IngestDatabaseConnections: nil,
+	IngestSales:               {"region"},
+	IngestErrors:              {"errorType"},
+	IngestResponseTime:        nil,
+}
+
+// Поля выборки, в которые можно направить метку внешнего формата (тег StatsD, метку Prometheus)
+var ingestLabelFields = []string{"region", "source", "errorType", "service"}
+
+// Выборка метрики с метками из labels (поле -> значение). Метки, не допустимые для метрики,
+// игнорируются: во внешних форматах у серий обычно есть лишние метки
+func ingestSampleTemplate(metric string, labels map[string]string) IngestSample {
+	sample := IngestSample{Metric: metric}
+	for _, label := range ingestMetricLabels[metric] {
+		switch label {
+		case "region":
+			sample.Region = labels["region"]
+		case "source":
+			sample.Source = labels["source"]
+		case "errorType":
+			sample.ErrorType = labels["errorType"]
+		}
+	}
+	return sample
+}
+
+// Разбор соответствия вида name=target,... с проверкой допустимых целей
+func parseNameMapping(spec string, valid []string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, item := range splitList(spec) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid mapping %q, expected name=target", item)
+		}
+		if !containsString(valid, parts[1]) {
+			return nil, fmt.Errorf("invalid mapping target %q, valid targets: %s", parts[1], strings.Join(valid, ", "))
+		}
+		mapping[parts[0]] = parts[1]
+	}
+	return mapping, nil
+}
+
+// Максимальная длина имени сервиса и значения метки
+const maxIngestLabelLength = 128
+
+// Выборка метрики от сервиса. Метки, не заданные для метрики, должны быть пустыми
+type IngestSample struct {
+	Metric    string  `json:"metric"`
+	Value     float64 `json:"value"`
+	Count     float64 `json:"count,omitempty"` // Для responseTime: число запросов с этим временем, по умолчанию 1
+	Region    string  `json:"region,omitempty"`
+	Source    string  `json:"source,omitempty"`
+	ErrorType string  `json:"errorType,omitempty"`
+
+	relative bool // Value - изменение последнего значения серии, а не само значение (gauge StatsD со знаком)
+}
+
+// Пакет выборок. Service отличает серии последних значений разных сервисов
+type IngestBatch struct {
+	Service string         `json:"service"`
+	Samples []IngestSample `json:"samples"`
+}
+
+// Ошибка проверки выборки с ее позицией в пакете. Index -1 - ошибка пакета целиком
+type IngestSampleError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+type IngestConfig struct {
+	MaxBodyBytes   int64         // Максимальный размер тела запроса
+	MaxSamples     int           // Максимум выборок в пакете
+	MaxLabelValues int           // Максимум различных значений одной метки
+	GaugeTTL       time.Duration // Серия последних значений без обновлений дольше TTL не учитывается
+}
+
+// Серия последних значений: метрика, сервис и метки
+type ingestGaugeKey struct {
+	metric, service, region, source string
+}
+
+type ingestGauge struct {
+	value   float64
+	updated time.Time
+}
+
+// Агрегатор принятых выборок. Каждый тик выборки сворачиваются в MetricsData той же формы,
+// что строит генератор: счетчики суммируются за тик, последние значения складываются
+// по сервисам и меткам, время ответа попадает в скетч распределения
+type IngestAggregator struct {
+	mu     sync.Mutex
+	config IngestConfig
+
+	gauges      map[ingestGaugeKey]ingestGauge
+	sales       int
+	regionSales map[string]int
+	errors      map[string]int
+	latency     *LatencySketch
+	requests    float64
+	latencySum  float64
+	labels      map[string]map[string]time.Time // Значения меток и время последней выборки с ними, для ограничения кардинальности
+
+	store       *TieredStore
+	history     *historyTracker // nil - история ведется объединяющим источником
+	lastMetrics MetricsData
+}
+
+func NewIngestAggregator(store *TieredStore, config IngestConfig) *IngestAggregator {
+	a := &IngestAggregator{
+		config:      config,
+		gauges:      make(map[ingestGaugeKey]ingestGauge),
+		regionSales: make(map[string]int),
+		errors:      make(map[string]int),
+		latency:     &LatencySketch{},
+		labels:      make(map[string]map[string]time.Time),
+		store:       store,
+		history:     &historyTracker{rollups: newHistoryRollups()},
+	}
+	a.lastMetrics = a.metrics(time.Now())
+	return a
+}
+
+func (a *IngestAggregator) Name() string {
+	return "ingest"
+}
+
+// История продолжается с данных, накопленных в хранилище
+func (a *IngestAggregator) Start(ctx context.Context) error {
+	if a.history == nil {
+		return nil
+	}
+	history := loadHistoryTracker(a.store, time.Now())
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.history = history
+	return nil
+}
+
+func (a *IngestAggregator) disableHistory() {
+	a.history = nil
+}
+
+func (a *IngestAggregator) Stop() error {
+	return nil
+}
+
+// Прошлых данных у приема нет: история появляется по мере поступления выборок
+func (a *IngestAggregator) Backfill(now time.Time) error {
+	return nil
+}
+
+// Проверка выборки. Возвращает пустую строку для корректной выборки. pending - новые
+// значения меток из уже проверенных выборок пакета, они тоже учитываются в ограничении
+func (a *IngestAggregator) validate(sample IngestSample, pending map[string]map[string]bool) string {
+	labels, ok := ingestMetricLabels[sample.Metric]
+	if !ok {
+		return fmt.Sprintf("unknown metric: %q, valid metrics: %s", sample.Metric, strings.Join(ingestMetricNames(), ", "))
+	}
+	if sample.relative {
+		return fmt.Sprintf("relative values are only allowed for %s, %s and %s", IngestActiveUsers, IngestServerLoad, IngestDatabaseConnections)
+	}
+	if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) || sample.Value < 0 {
+		return fmt.Sprintf("invalid value: %v, must be a non-negative number", sample.Value)
+	}
+	if sample.Metric == IngestServerLoad && sample.Value > 100 {
+		return fmt.Sprintf("invalid value: %v, serverLoad is a percentage", sample.Value)
+	}
+	if sample.Count < 0 || (sample.Count != 0 && sample.Metric != IngestResponseTime) {
+		return "count is only allowed for responseTime and must be positive"
+	}
+
+	values := map[string]string{"region": sample.Region, "source": sample.Source, "errorType": sample.ErrorType}
+	for _, label := range []string{"region", "source", "errorType"} {
+		value := values[label]
+		if value == "" {
+			continue
+		}
+		if !containsString(labels, label) {
+			return fmt.Sprintf("label %s is not allowed for %s", label, sample.Metric)
+		}
+		if len(value) > maxIngestLabelLength {
+			return fmt.Sprintf("label %s is longer than %d bytes", label, maxIngestLabelLength)
+		}
+		seen := a.labels[label]
+		if _, ok := seen[value]; ok || pending[label][value] {
+			continue
+		}
+		if len(seen)+len(pending[label]) >= a.config.MaxLabelValues {
+			return fmt.Sprintf("too many distinct %s values, at most %d allowed", label, a.config.MaxLabelValues)
+		}
+		if pending[label] == nil {
+			pending[label] = make(map[string]bool)
+		}
+		pending[label][value] = true
+	}
+	if sample.Metric == IngestErrors && sample.ErrorType == "" {
+		return "errorType is required for errors"
+	}
+	return ""
+}
+
+// Проверка сервиса пакета: длина имени и число различных сервисов, как у значений меток
+func (a *IngestAggregator) validateService(service string) string {
+	if service == "" {
+		return ""
+	}
+	if len(service) > maxIngestLabelLength {
+		return fmt.Sprintf("service is longer than %d bytes", maxIngestLabelLength)
+	}
+	if _, ok := a.labels["service"][service]; !ok && len(a.labels["service"]) >= a.config.MaxLabelValues {
+		return fmt.Sprintf("too many distinct services, at most %d allowed", a.config.MaxLabelValues)
+	}
+	return ""
+}
+
+// Метрика, которую сервис присылает последним значением серии
+func isIngestGauge(metric string) bool {
+	return metric == IngestActiveUsers || metric == IngestServerLoad || metric == IngestDatabaseConnections
+}
+
+// Последнее значение серии; 0 для серии без значений или устаревшей дольше GaugeTTL
+func (a *IngestAggregator) gaugeValue(key ingestGaugeKey, now time.Time) float64 {
+	gauge, ok := a.gauges[key]
+	if !ok || now.Sub(gauge.updated) > a.config.GaugeTTL {
+		return 0
+	}
+	return gauge.value
+}
+
+// Перевод относительных изменений последних значений в сами значения. Изменения применяются
+// к значениям серий в агрегаторе и к более ранним выборкам пакета; значение не опускается ниже нуля
+func (a *IngestAggregator) resolveRelative(batch IngestBatch, now time.Time) []IngestSample {
+	var samples []IngestSample
+	resolved := make(map[ingestGaugeKey]float64)
+	for i, sample := range batch.Samples {
+		if !isIngestGauge(sample.Metric) {
+			continue
+		}
+		key := ingestGaugeKey{metric: sample.Metric, service: batch.Service, region: sample.Region, source: sample.Source}
+		if !sample.relative {
+			resolved[key] = sample.Value
+			continue
+		}
+
+		if samples == nil {
+			samples = append([]IngestSample(nil), batch.Samples...)
+		}
+		value, ok := resolved[key]
+		if !ok {
+			value = a.gaugeValue(key, now)
+		}
+		value = math.Max(value+sample.Value, 0)
+		resolved[key] = value
+		samples[i].Value = value
+		samples[i].relative = false
+	}
+	if samples == nil {
+		return batch.Samples
+	}
+	return samples
+}
+
+// Прием пакета. Пакет принимается целиком или отклоняется целиком со списком ошибок выборок
+func (a *IngestAggregator) Ingest(batch IngestBatch, now time.Time) []IngestSampleError {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if problem := a.validateService(batch.Service); problem != "" {
+		return []IngestSampleError{{Index: -1, Error: problem}}
+	}
+	batch.Samples = a.resolveRelative(batch, now)
+
+	var problems []IngestSampleError
+	pending := make(map[string]map[string]bool)
+	for i, sample := range batch.Samples {
+		if problem := a.validate(sample, pending); problem != "" {
+			problems = append(problems, IngestSampleError{Index: i, Error: problem})
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+
+	a.rememberLabel("service", batch.Service, now)
+	for _, sample := range batch.Samples {
+		a.rememberLabel("region", sample.Region, now)
+		a.rememberLabel("source", sample.Source, now)
+		a.rememberLabel("errorType", sample.ErrorType, now)
+
+		switch sample.Metric {
+		case IngestActiveUsers, IngestServerLoad, IngestDatabaseConnections:
+			key := ingestGaugeKey{metric: sample.Metric, service: batch.Service, region: sample.Region, source: sample.Source}
+			a.gauges[key] = ingestGauge{value: sample.Value, updated: now}
+		case IngestSales:
+			count := roundInt(sample.Value)
+			a.sales += count
+			if sample.Region != "" {
+				a.regionSales[sample.Region] += count
+			}
+		case IngestErrors:
+			a.errors[sample.ErrorType] += roundInt(sample.Value)
+		case IngestResponseTime:
+			count := sample.Count
+			if count == 0 {
+				count = 1
+			}
+			a.latency.AddN(sample.Value, count)
+			a.requests += count
+			a.latencySum += sample.Value * count
+		}
+	}
+	return nil
+}
+
+func (a *IngestAggregator) rememberLabel(label, value string, now time.Time) {
+	if value == "" {
+		return
+	}
+	if a.labels[label] == nil {
+		a.labels[label] = make(map[string]time.Time)
+	}
+	a.labels[label][value] = now
+}
+
+// Метрики тика из накопленных выборок. Счетчики за тик сбрасываются
+func (a *IngestAggregator) Next(now time.Time) MetricsData {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	metrics := a.metrics(now)
+	a.history.add(&metrics)
+
+	a.sales = 0
+	a.regionSales = make(map[string]int)
+	a.errors = make(map[string]int)
+	a.latency = &LatencySketch{}
+	a.requests = 0
+	a.latencySum = 0
+
+	a.lastMetrics = metrics
+	return metrics
+}
+
+func (a *IngestAggregator) metrics(now time.Time) MetricsData {
+	metrics := MetricsData{
+		Timestamp:     now.Unix(),
+		Sales:         a.sales,
+		ErrorsByType:  make(map[string]int, len(a.errors)),
+		RegionalData:  make(map[string]Region),
+		SourcesData:   make(map[string]int),
+		LatencySketch: a.latency,
+		Latency:       a.latency.Percentiles(),
+	}
+
+	// Последние значения складываются по сервисам и меткам, устаревшие серии удаляются
+	regionUsers := make(map[string]float64)
+	var users, load, connections float64
+	loadSeries := 0
+	for key, gauge := range a.gauges {
+		if now.Sub(gauge.updated) > a.config.GaugeTTL {
+			delete(a.gauges, key)
+			continue
+		}
+		switch key.metric {
+		case IngestActiveUsers:
+			users += gauge.value
+			if key.region != "" {
+				regionUsers[key.region] += gauge.value
+			}
+			if key.source != "" {
+				metrics.SourcesData[key.source] += roundInt(gauge.value)
+			}
+		case IngestServerLoad:
+			load += gauge.value
+			loadSeries++
+		case IngestDatabaseConnections:
+			connections += gauge.value
+		}
+	}
+	// Значения меток устаревают вместе с сериями: место в лимите кардинальности освобождается
+	for label, seen := range a.labels {
+		for value, updated := range seen {
+			if now.Sub(updated) > a.config.GaugeTTL {
+				delete(seen, value)
+			}
+		}
+		if len(seen) == 0 {
+			delete(a.labels, label)
+		}
+	}
+
+	metrics.ActiveUsers = roundInt(users)
+	if loadSeries > 0 {
+		metrics.ServerLoad = load / float64(loadSeries) // Нагрузка в процентах усредняется по сервисам
+	}
+	metrics.DatabaseConnections = roundInt(connections)
+	metrics.ConversionRate = percent(float64(metrics.Sales), users)
+
+	// Регион с продажами, но без данных о пользователях, тоже попадает в разбивку
+	for region := range a.regionSales {
+		if _, ok := regionUsers[region]; !ok {
+			regionUsers[region] = 0
+		}
+	}
+	for region, users := range regionUsers {
+		metrics.RegionalData[region] = Region{
+			ActiveUsers:    roundInt(users),
+			Sales:          a.regionSales[region],
+			ConversionRate: percent(float64(a.regionSales[region]), users),
+		}
+	}
+
+	totalErrors := 0
+	for errType, count := range a.errors {
+		metrics.ErrorsByType[errType] = count
+		totalErrors += count
+	}
+	metrics.RequestsPerSecond = a.requests / tickInterval.Seconds()
+	metrics.ErrorRate = percent(float64(totalErrors), a.requests)
+	if a.requests > 0 {
+		metrics.ResponseTimeMs = a.latencySum / a.requests
+	}
+	return metrics
+}
+
+// Доля в процентах; 0 при нулевом знаменателе
+func percent(part, total float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return part / total * 100
+}
+
+func (a *IngestAggregator) Current() MetricsData {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lastMetrics
+}
+
+func ingestMetricNames() []string {
+	names := make([]string, 0, len(ingestMetricLabels))
+	for name := range ingestMetricLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Проверка API-ключа из заголовка Authorization: Bearer <ключ> или X-API-Key.
+// Ключи сравниваются за постоянное время. Без настроенных ключей прием закрыт
+func APIKeyMiddleware(keys []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("X-API-Key")
+		if header := c.GetHeader("Authorization"); key == "" && strings.HasPrefix(header, "Bearer ") {
+			key = strings.TrimPrefix(header, "Bearer ")
+		}
+
+		valid := false
+		for _, candidate := range keys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(candidate)) == 1 {
+				valid = true
+			}
+		}
+		if key == "" || !valid {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or missing API key"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Обработчик POST /api/ingest: пакет выборок в JSON
+func handleIngest(aggregator *IngestAggregator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if aggregator == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Ingest source is not enabled, add ingest to METRICS_SOURCE"})
+			return
+		}
+
+		// Читаем на байт больше лимита, чтобы отличить тело ровно по лимиту от превышения
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, aggregator.config.MaxBodyBytes+1))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			return
+		}
+		if int64(len(body)) > aggregator.config.MaxBodyBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("request body exceeds %d bytes", aggregator.config.MaxBodyBytes)})
+			return
+		}
+
+		var batch IngestBatch
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&batch); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid JSON: %v", err)})
+			return
+		}
+
+		if len(batch.Samples) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "batch contains no samples"})
+			return
+		}
+		if len(batch.Samples) > aggregator.config.MaxSamples {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("batch contains %d samples, at most %d allowed", len(batch.Samples), aggregator.config.MaxSamples)})
+			return
+		}
+		if problems := aggregator.Ingest(batch, time.Now()); problems != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":        "batch rejected: invalid samples",
+				"samples":      problems,
+				"validMetrics": ingestMetricNames(),
+			})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"accepted": len(batch.Samples)})
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestIngestAggregator(t *testing.T, maxLabelValues int) *IngestAggregator {
+	t.Helper()
+	a := NewIngestAggregator(newTestTieredStore(t), IngestConfig{
+		MaxBodyBytes:   1 << 20,
+		MaxSamples:     100,
+		MaxLabelValues: maxLabelValues,
+		GaugeTTL:       time.Minute,
+	})
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestIngestValidate(t *testing.T) {
+	long := strings.Repeat("x", maxIngestLabelLength)
+	cases := []struct {
+		name    string
+		sample  IngestSample
+		problem string // Фрагмент ошибки, пустой для корректной выборки
+	}{
+		{"valid gauge", IngestSample{Metric: IngestActiveUsers, Value: 10, Region: "Москва", Source: "ads"}, ""},
+		{"valid latency count", IngestSample{Metric: IngestResponseTime, Value: 120, Count: 5}, ""},
+		{"zero value", IngestSample{Metric: IngestSales, Value: 0}, ""},
+		{"unknown metric", IngestSample{Metric: "revenue", Value: 1}, "unknown metric"},
+		{"NaN", IngestSample{Metric: IngestSales, Value: math.NaN()}, "invalid value"},
+		{"+Inf", IngestSample{Metric: IngestSales, Value: math.Inf(1)}, "invalid value"},
+		{"-Inf", IngestSample{Metric: IngestSales, Value: math.Inf(-1)}, "invalid value"},
+		{"negative", IngestSample{Metric: IngestActiveUsers, Value: -1}, "invalid value"},
+		{"load over 100", IngestSample{Metric: IngestServerLoad, Value: 101}, "percentage"},
+		{"count on counter", IngestSample{Metric: IngestSales, Value: 1, Count: 2}, "count is only allowed"},
+		{"negative count", IngestSample{Metric: IngestResponseTime, Value: 1, Count: -1}, "count is only allowed"},
+		{"label at limit", IngestSample{Metric: IngestSales, Value: 1, Region: long}, ""},
+		{"label over limit", IngestSample{Metric: IngestSales, Value: 1, Region: long + "x"}, "longer than 128 bytes"},
+		{"multibyte label over limit", IngestSample{Metric: IngestErrors, Value: 1, ErrorType: strings.Repeat("ж", 65)}, "longer than 128 bytes"},
+		{"label not allowed", IngestSample{Metric: IngestSales, Value: 1, Source: "ads"}, "label source is not allowed"},
+		{"missing errorType", IngestSample{Metric: IngestErrors, Value: 1}, "errorType is required"},
+		{"relative counter", IngestSample{Metric: IngestSales, Value: 1, relative: true}, "relative values are only allowed"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a := newTestIngestAggregator(t, 10)
+			problem := a.validate(c.sample, make(map[string]map[string]bool))
+			if c.problem == "" && problem != "" || !strings.Contains(problem, c.problem) {
+				t.Fatalf("problem %q, want %q", problem, c.problem)
+			}
+		})
+	}
+}
+
+// Лимит различных значений метки учитывает значения из того же пакета, а устаревшие
+// вместе с сериями значения освобождают место
+func TestIngestLabelCardinality(t *testing.T) {
+	a := newTestIngestAggregator(t, 2)
+	now := time.Unix(1700000000, 0)
+	sample := func(region string) IngestSample {
+		return IngestSample{Metric: IngestActiveUsers, Value: 1, Region: region}
+	}
+
+	// Третье значение в одном пакете отклоняет пакет целиком
+	problems := a.Ingest(IngestBatch{Service: "web", Samples: []IngestSample{sample("a"), sample("b"), sample("c")}}, now)
+	if len(problems) != 1 || problems[0].Index != 2 || !strings.Contains(problems[0].Error, "too many distinct region values") {
+		t.Fatalf("problems %+v", problems)
+	}
+	if problems := a.Ingest(IngestBatch{Service: "web", Samples: []IngestSample{sample("a"), sample("b")}}, now); problems != nil {
+		t.Fatalf("problems %+v", problems)
+	}
+	if problems := a.Ingest(IngestBatch{Service: "web", Samples: []IngestSample{sample("c")}}, now); len(problems) != 1 {
+		t.Fatalf("new region over the limit accepted: %+v", problems)
+	}
+
+	// Значение a обновляется, b устаревает вместе со своей серией
+	later := now.Add(45 * time.Second)
+	if problems := a.Ingest(IngestBatch{Service: "web", Samples: []IngestSample{sample("a")}}, later); problems != nil {
+		t.Fatalf("problems %+v", problems)
+	}
+	expired := now.Add(time.Minute + time.Second)
+	metrics := a.Next(expired)
+	if _, ok := metrics.RegionalData["b"]; ok {
+		t.Fatal("expired series is still counted")
+	}
+	if problems := a.Ingest(IngestBatch{Service: "web", Samples: []IngestSample{sample("c")}}, expired); problems != nil {
+		t.Fatalf("expired region still counts towards the limit: %+v", problems)
+	}
+	if problems := a.Ingest(IngestBatch{Service: "web", Samples: []IngestSample{sample("b")}}, expired); len(problems) != 1 {
+		t.Fatalf("region over the limit accepted after expiry: %+v", problems)
+	}
+}
+
+// Сервис пакета проверяется самим агрегатором, а не только обработчиком POST /api/ingest:
+// длина имени и число различных сервисов, которые устаревают вместе с сериями
+func TestIngestServiceValidation(t *testing.T) {
+	a := newTestIngestAggregator(t, 2)
+	now := time.Unix(1700000000, 0)
+	batch := func(service string) IngestBatch {
+		return IngestBatch{Service: service, Samples: []IngestSample{{Metric: IngestServerLoad, Value: 10}}}
+	}
+
+	problems := a.Ingest(batch(strings.Repeat("x", maxIngestLabelLength+1)), now)
+	if len(problems) != 1 || problems[0].Index != -1 || !strings.Contains(problems[0].Error, "service is longer") {
+		t.Fatalf("problems %+v", problems)
+	}
+	for _, service := range []string{"web", "api", "web", ""} {
+		if problems := a.Ingest(batch(service), now); problems != nil {
+			t.Fatalf("service %q: problems %+v", service, problems)
+		}
+	}
+	problems = a.Ingest(batch("worker"), now)
+	if len(problems) != 1 || problems[0].Index != -1 || !strings.Contains(problems[0].Error, "too many distinct services") {
+		t.Fatalf("service over the limit: problems %+v", problems)
+	}
+
+	expired := now.Add(time.Minute + time.Second)
+	a.Next(expired)
+	if problems := a.Ingest(batch("worker"), expired); problems != nil {
+		t.Fatalf("expired services still count towards the limit: %+v", problems)
+	}
+}
+
+// Относительное изменение применяется к последнему значению серии в агрегаторе; отклоненный
+// пакет значение не меняет, устаревшая серия начинается с нуля
+func TestIngestRelativeGauge(t *testing.T) {
+	a := newTestIngestAggregator(t, 10)
+	now := time.Unix(1700000000, 0)
+	relative := func(value float64) IngestSample {
+		return IngestSample{Metric: IngestActiveUsers, Value: value, Region: "Москва", relative: true}
+	}
+	ingest := func(at time.Time, samples ...IngestSample) []IngestSampleError {
+		return a.Ingest(IngestBatch{Service: "web", Samples: samples}, at)
+	}
+
+	if problems := ingest(now, IngestSample{Metric: IngestActiveUsers, Value: 100, Region: "Москва"}, relative(20)); problems != nil {
+		t.Fatalf("problems %+v", problems)
+	}
+	if problems := ingest(now, relative(-5)); problems != nil {
+		t.Fatalf("problems %+v", problems)
+	}
+	if problems := ingest(now, relative(7), IngestSample{Metric: IngestErrors, Value: 1}); len(problems) != 1 {
+		t.Fatalf("invalid batch accepted: %+v", problems)
+	}
+	if users := a.Next(now).ActiveUsers; users != 115 {
+		t.Fatalf("active users %d, want 115", users)
+	}
+
+	if problems := ingest(now, relative(-500)); problems != nil {
+		t.Fatalf("problems %+v", problems)
+	}
+	if users := a.Next(now).ActiveUsers; users != 0 {
+		t.Fatalf("active users %d below zero clamp, want 0", users)
+	}
+
+	if problems := ingest(now, relative(40)); problems != nil {
+		t.Fatalf("problems %+v", problems)
+	}
+	expired := now.Add(time.Minute + time.Second)
+	if problems := ingest(expired, relative(3)); problems != nil {
+		t.Fatalf("problems %+v", problems)
+	}
+	if users := a.Next(expired).ActiveUsers; users != 3 {
+		t.Fatalf("active users %d, relative change of an expired series must start from zero", users)
+	}
+}
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cases := []struct {
+		name    string
+		keys    []string
+		headers map[string]string
+		status  int
+	}{
+		{"X-API-Key", []string{"k1", "k2"}, map[string]string{"X-API-Key": "k2"}, http.StatusOK},
+		{"bearer", []string{"k1"}, map[string]string{"Authorization": "Bearer k1"}, http.StatusOK},
+		{"X-API-Key wins over bearer", []string{"k1"}, map[string]string{"X-API-Key": "bad", "Authorization": "Bearer k1"}, http.StatusUnauthorized},
+		{"missing", []string{"k1"}, nil, http.StatusUnauthorized},
+		{"wrong key", []string{"k1"}, map[string]string{"X-API-Key": "k2"}, http.StatusUnauthorized},
+		{"key prefix", []string{"k1"}, map[string]string{"X-API-Key": "k"}, http.StatusUnauthorized},
+		{"basic scheme", []string{"k1"}, map[string]string{"Authorization": "Basic k1"}, http.StatusUnauthorized},
+		{"empty bearer", []string{"k1"}, map[string]string{"Authorization": "Bearer "}, http.StatusUnauthorized},
+		{"no keys configured", nil, map[string]string{"X-API-Key": "k1"}, http.StatusUnauthorized},
+		{"empty key configured", []string{""}, map[string]string{"X-API-Key": ""}, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := gin.New()
+			r.POST("/api/ingest", APIKeyMiddleware(c.keys), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			req := httptest.NewRequest(http.MethodPost, "/api/ingest", nil)
+			for name, value := range c.headers {
+				req.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != c.status {
+				t.Fatalf("status %d, want %d", w.Code, c.status)
+			}
+			if c.status != http.StatusUnauthorized {
+				return
+			}
+
+			var body map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] != "Invalid or missing API key" {
+				t.Fatalf("body %s", w.Body.String())
+			}
+		})
+	}
+}
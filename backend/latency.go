@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Скетч распределения времени ответа в стиле DDSketch: логарифмические корзины
+// с относительной погрешностью квантилей latencySketchAccuracy. Скетчи объединяются
+// сложением счетчиков корзин, поэтому перцентили сводок за час или по нескольким
+// инстансам точны в пределах той же погрешности, в отличие от усреднения средних
+const latencySketchAccuracy = 0.01
+
+var (
+	latencySketchGamma    = (1 + latencySketchAccuracy) / (1 - latencySketchAccuracy)
+	latencySketchLogGamma = math.Log(latencySketchGamma)
+)
+
+// Значения меньше этого (мс) попадают в нулевую корзину
+const latencySketchMinValue = 0.01
+
+// Значения больше этого (мс) попадают в последнюю корзину
+const latencySketchMaxValue = 1e7
+
+// Допустимый диапазон индексов корзин. Он ограничивает размер массива корзин
+// (около тысячи при точности 1%), в том числе для скетчей из Redis и с диска
+var (
+	latencySketchMinIndex = latencyIndex(latencySketchMinValue)
+	latencySketchMaxIndex = latencyIndex(latencySketchMaxValue)
+)
+
+// Счетчики корзин дробные: при малом RPS выборка генератора представляет долю запроса,
+// а вес тика в объединенном скетче должен соответствовать реальному числу запросов
+type LatencySketch struct {
+	Offset int32     `json:"offset"` // Индекс корзины Counts[0]
+	Counts []float64 `json:"counts"`
+	Zero   float64   `json:"zero"` // Значения меньше latencySketchMinValue
+}
+
+// Перцентили времени ответа, мс
+type LatencyPercentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+func latencyIndex(value float64) int32 {
+	return int32(math.Ceil(math.Log(value) / latencySketchLogGamma))
+}
+
+// Представитель корзины: середина интервала (gamma^(i-1), gamma^i] в смысле относительной погрешности
+func latencyValue(index int32) float64 {
+	return 2 * math.Pow(latencySketchGamma, float64(index)) / (latencySketchGamma + 1)
+}
+
+// Добавление count запросов со временем ответа value мс
+func (s *LatencySketch) AddN(value float64, count float64) {
+	if count <= 0 {
+		return
+	}
+	if value < latencySketchMinValue {
+		s.Zero += count
+		return
+	}
+	if value > latencySketchMaxValue {
+		value = latencySketchMaxValue
+	}
+	s.AddBucket(latencyIndex(value), count)
+}
+
+// Добавление count запросов в корзину с индексом index. Индексы вне допустимого
+// диапазона прижимаются к крайним корзинам
+func (s *LatencySketch) AddBucket(index int32, count float64) {
+	if index < latencySketchMinIndex {
+		index = latencySketchMinIndex
+	} else if index > latencySketchMaxIndex {
+		index = latencySketchMaxIndex
+	}
+	s.grow(index, index)
+	s.Counts[index-s.Offset] += count
+}
+
+// Расширение массива корзин до диапазона [low, high]
+func (s *LatencySketch) grow(low, high int32) {
+	if len(s.Counts) == 0 {
+		s.Offset = low
+		s.Counts = make([]float64, high-low+1)
+		return
+	}
+
+	last := s.Offset + int32(len(s.Counts)) - 1
+	if low >= s.Offset && high <= last {
+		return
+	}
+	if s.Offset < low {
+		low = s.Offset
+	}
+	if last > high {
+		high = last
+	}
+	counts := make([]float64, high-low+1)
+	copy(counts[s.Offset-low:], s.Counts)
+	s.Offset, s.Counts = low, counts
+}
+
+// Проверка диапазона корзин и счетчиков скетча, полученного извне
+func (s *LatencySketch) Validate() error {
+	if !validLatencyCount(s.Zero) {
+		return fmt.Errorf("invalid zero bucket count %v", s.Zero)
+	}
+	if len(s.Counts) == 0 {
+		return nil
+	}
+	last := int64(s.Offset) + int64(len(s.Counts)) - 1
+	if s.Offset < latencySketchMinIndex || last > int64(latencySketchMaxIndex) {
+		return fmt.Errorf("latency buckets %d..%d out of range %d..%d", s.Offset, last, latencySketchMinIndex, latencySketchMaxIndex)
+	}
+	for i, count := range s.Counts {
+		if !validLatencyCount(count) {
+			return fmt.Errorf("invalid count %v in latency bucket %d", count, int64(s.Offset)+int64(i))
+		}
+	}
+	return nil
+}
+
+func validLatencyCount(count float64) bool {
+	return count >= 0 && !math.IsInf(count, 1)
+}
+
+// Скетч из JSON (Redis, снимки, сводки хранилища) проверяется до использования
+func (s *LatencySketch) UnmarshalJSON(data []byte) error {
+	type plain LatencySketch
+	var decoded plain
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	sketch := LatencySketch(decoded)
+	if err := sketch.Validate(); err != nil {
+		return err
+	}
+	*s = sketch
+	return nil
+}
+
+// Объединение со скетчем другого тика, периода или инстанса.
+// Некорректный скетч отбрасывается целиком
+func (s *LatencySketch) Merge(other *LatencySketch) {
+	if other == nil || other.Validate() != nil {
+		return
+	}
+	s.Zero += other.Zero
+	if len(other.Counts) == 0 {
+		return
+	}
+	s.grow(other.Offset, other.Offset+int32(len(other.Counts))-1)
+	for i, count := range other.Counts {
+		s.Counts[other.Offset-s.Offset+int32(i)] += count
+	}
+}
+
+// Копия скетча со счетчиками, умноженными на factor
+func (s *LatencySketch) Scaled(factor float64) *LatencySketch {
+	scaled := &LatencySketch{Offset: s.Offset, Counts: make([]float64, len(s.Counts)), Zero: s.Zero * factor}
+	for i, count := range s.Counts {
+		scaled.Counts[i] = count * factor
+	}
+	return scaled
+}
+
+// Число запросов в скетче
+func (s *LatencySketch) Count() float64 {
+	total := s.Zero
+	for _, count := range s.Counts {
+		total += count
+	}
+	return total
+}
+
+// Квантиль q из [0, 1]; 0 для пустого скетча
+func (s *LatencySketch) Quantile(q float64) float64 {
+	total := s.Count()
+	if total == 0 {
+		return 0
+	}
+
+	rank := q * total
+	seen := s.Zero
+	if rank < seen {
+		return 0
+	}
+	last := int32(-1)
+	for i, count := range s.Counts {
+		if count == 0 {
+			continue
+		}
+		seen += count
+		last = int32(i)
+		if rank < seen {
+			return latencyValue(s.Offset + last)
+		}
+	}
+	if last < 0 {
+		return 0
+	}
+	return latencyValue(s.Offset + last)
+}
+
+func (s *LatencySketch) Percentiles() LatencyPercentiles {
+	return LatencyPercentiles{
+		P50: s.Quantile(0.50),
+		P90: s.Quantile(0.90),
+		P95: s.Quantile(0.95),
+		P99: s.Quantile(0.99),
+	}
+}
+
+// Число выборок, которыми генератор моделирует распределение тика.
+// Каждая выборка представляет requests/latencySamplesPerTick запросов
+const latencySamplesPerTick = 200
+
+// Синтетическое распределение времени ответа за тик: логнормальное со средним meanMs
+// и небольшой долей медленных запросов, которая и формирует хвост p99
+func generateLatencySketch(rng *rand.Rand, meanMs, requests float64) *LatencySketch {
+	sketch := &LatencySketch{}
+
+	if requests <= 0 {
+		return sketch
+	}
+	weight := requests / latencySamplesPerTick
+
+	const sigma = 0.45
+	const slowShare, slowFactor = 0.02, 4.0
+	median := meanMs / math.Exp(sigma*sigma/2) / (1 + slowShare*(slowFactor-1))
+	for i := 0; i < latencySamplesPerTick; i++ {
+		value := median * math.Exp(sigma*rng.NormFloat64())
+		if rng.Float64() < slowShare {
+			value *= slowFactor
+		}
+		sketch.AddN(value, weight)
+	}
+	return sketch
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Значения с разбросом на несколько порядков, включая нулевую корзину и значения сверх максимума
+func latencyTestValues(seed int64, n int) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = math.Exp(rng.NormFloat64()*2 + 4)
+	}
+	values[0] = latencySketchMinValue / 2
+	values[1] = latencySketchMaxValue * 10
+	return values
+}
+
+func latencyTestSketch(values []float64) *LatencySketch {
+	sketch := &LatencySketch{}
+	for _, value := range values {
+		sketch.AddN(value, 1)
+	}
+	return sketch
+}
+
+// Порядок объединения не влияет на результат, и он совпадает со скетчем всех значений сразу
+func TestLatencySketchMergeAssociative(t *testing.T) {
+	a, b, c := latencyTestValues(1, 500), latencyTestValues(2, 300), latencyTestValues(3, 700)
+
+	left := latencyTestSketch(a)
+	left.Merge(latencyTestSketch(b))
+	left.Merge(latencyTestSketch(c))
+
+	right := latencyTestSketch(b)
+	right.Merge(latencyTestSketch(c))
+	merged := latencyTestSketch(a)
+	merged.Merge(right)
+
+	all := latencyTestSketch(append(append(append([]float64{}, a...), b...), c...))
+	if !reflect.DeepEqual(left, merged) || !reflect.DeepEqual(left, all) {
+		t.Fatalf("merge depends on order:\n(a+b)+c %+v\na+(b+c) %+v\nall     %+v", left, merged, all)
+	}
+}
+
+// Квантили отличаются от точных не больше чем на заданную относительную погрешность
+func TestLatencySketchQuantileAccuracy(t *testing.T) {
+	values := latencyTestValues(4, 10000)[2:]
+	sketch := latencyTestSketch(values)
+	sort.Float64s(values)
+
+	for _, q := range []float64{0, 0.01, 0.25, 0.5, 0.75, 0.9, 0.95, 0.99, 0.999, 1} {
+		rank := int(q * float64(len(values)))
+		if rank >= len(values) {
+			rank = len(values) - 1
+		}
+		exact, estimate := values[rank], sketch.Quantile(q)
+		if relative := math.Abs(estimate-exact) / exact; relative > latencySketchAccuracy+1e-9 {
+			t.Errorf("q=%v: estimate %v, exact %v, relative error %v", q, estimate, exact, relative)
+		}
+	}
+}
+
+// Скетч с индексами корзин вне диапазона отвергается, а не растягивает массив корзин
+func TestLatencySketchRejectsHostileOffset(t *testing.T) {
+	hostile := []string{
+		`{"offset":2000000000,"counts":[1]}`,
+		`{"offset":-2147483648,"counts":[1]}`,
+		`{"offset":800,"counts":[1,1,1,1,1,1,1,1,1,1]}`,
+		`{"offset":0,"counts":[-1]}`,
+		`{"offset":0,"counts":[1],"zero":-5}`,
+	}
+	for _, data := range hostile {
+		var sketch LatencySketch
+		if err := json.Unmarshal([]byte(data), &sketch); err == nil {
+			t.Errorf("%s: accepted as %+v", data, sketch)
+		}
+	}
+
+	var envelope redisEnvelope
+	if err := json.Unmarshal([]byte(`{"origin":"b","frame":{},"latencySketch":{"offset":-2147483648,"counts":[1]}}`), &envelope); err == nil {
+		t.Error("Redis envelope with a hostile sketch accepted")
+	}
+
+	// Скетч, собранный в памяти в обход проверки, при объединении отбрасывается
+	sketch := latencyTestSketch(latencyTestValues(5, 100))
+	before := *sketch
+	sketch.Merge(&LatencySketch{Offset: math.MinInt32, Counts: []float64{1}, Zero: 1})
+	sketch.Merge(&LatencySketch{Offset: latencySketchMaxIndex, Counts: []float64{1, 1}})
+	sketch.Merge(&LatencySketch{Offset: 0, Counts: []float64{math.NaN()}})
+	if !reflect.DeepEqual(*sketch, before) {
+		t.Fatal("invalid sketch merged")
+	}
+	if len(sketch.Counts) > int(latencySketchMaxIndex-latencySketchMinIndex+1) {
+		t.Fatalf("sketch has %d buckets", len(sketch.Counts))
+	}
+
+	// То же для записи тика с диска
+	tick := testTick(segmentTestStart)
+	tick.LatencySketch = &LatencySketch{Offset: latencySketchMaxIndex + 1000, Counts: []float64{1}}
+	if _, err := decodeTick(encodeTick(nil, &tick)); err == nil {
+		t.Fatal("tick record with an out of range latency bucket decoded")
+	}
+}
@@ -4,14 +4,17 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"log"
 	"math"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
-	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -64,20 +67,28 @@ type CustomClaims struct {
 
 // Структура данных для метрик
 type MetricsData struct {
-	Timestamp           int64             `json:"timestamp"`
-	ActiveUsers         int               `json:"activeUsers"`
-	RequestsPerSecond   float64           `json:"requestsPerSecond"`
-	ResponseTimeMs      float64           `json:"responseTimeMs"`
-	ConversionRate      float64           `json:"conversionRate"`
-	Sales               int               `json:"sales"`
-	ErrorRate           float64           `json:"errorRate"`
-	ErrorsByType        map[string]int    `json:"errorsByType"`
-	ServerLoad          float64           `json:"serverLoad"`
-	DatabaseConnections int               `json:"databaseConnections"`
-	RegionalData        map[string]Region `json:"regionalData"`
-	SourcesData         map[string]int    `json:"sourcesData"`
-	ConversionFunnel    ConversionFunnel  `json:"conversionFunnel"`
-	HistoricalData      HistoricalData    `json:"historicalData"`
+	Timestamp           int64              `json:"timestamp"`
+	ActiveUsers         int                `json:"activeUsers"`
+	RequestsPerSecond   float64            `json:"requestsPerSecond"`
+	ResponseTimeMs      float64            `json:"responseTimeMs"`
+	Latency             LatencyPercentiles `json:"latency"`
+	ConversionRate      float64            `json:"conversionRate"`
+	Sales               int                `json:"sales"`
+	ErrorRate           float64            `json:"errorRate"`
+	ErrorsByType        map[string]int     `json:"errorsByType"`
+	ServerLoad          float64            `json:"serverLoad"`
+	DatabaseConnections int                `json:"databaseConnections"`
+	RegionalData        map[string]Region  `json:"regionalData"`
+	SourcesData         map[string]int     `json:"sourcesData"`
+	ConversionFunnel    ConversionFunnel   `json:"conversionFunnel"`
+	HistoricalData      HistoricalData     `json:"historicalData"`
+
+	// Распределение времени ответа для сводок и объединения инстансов. В кадры не попадает,
+	// между инстансами передается в конверте Redis
+	LatencySketch *LatencySketch `json:"-"`
+
+	// Максимум пользователей за период записи уровня сводок, у сырых тиков 0. В кадры не попадает
+	PeakActiveUsers int `json:"-"`
 }
 
 // Структура для региональных данных
@@ -105,10 +116,12 @@ type HistoricalData struct {
 
 // Структура для исторических метрик
 type HistoricalMetrics struct {
-	ActiveUsers    int     `json:"activeUsers"`
-	Sales          int     `json:"sales"`
-	ConversionRate float64 `json:"conversionRate"`
-	ResponseTimeMs float64 `json:"responseTimeMs"`
+	ActiveUsers     int                `json:"activeUsers"`     // Среднее за период
+	PeakActiveUsers int                `json:"peakActiveUsers"` // Максимум за период
+	Sales           int                `json:"sales"`           // Сумма за период
+	ConversionRate  float64            `json:"conversionRate"`  // Взвешена по числу пользователей
+	ResponseTimeMs  float64            `json:"responseTimeMs"`  // Взвешено по числу запросов
+	Latency         LatencyPercentiles `json:"latency"`         // Перцентили по объединенному распределению
 }
 
 // Согласованный генератор данных
@@ -133,6 +146,11 @@ type CoherentDataGenerator struct {
 	historicalHourly map[int64]HistoricalMetrics
 	historicalDaily  map[int64]HistoricalMetrics
 	historicalWeekly map[int64]HistoricalMetrics
+	rollups          historyRollups   // Сводки периодов истории, открытые периоды обновляются каждым тиком
+	mergedHistory    bool             // История ведется объединяющим источником, своя не обновляется
+	source           *generatorSource // Состояние случайной последовательности, сохраняется в снимок
+	rng              *rand.Rand
+	store            *TieredStore // Хранилище тиков и сводок, из которого строятся исторические данные
 }
 
 // Менеджер OIDC авторизации
@@ -153,14 +171,19 @@ var (
 			return true // Разрешаем любой источник для тестирования
 		},
 	}
-	clients      = make(map[*websocket.Conn]bool)
-	clientsMu    sync.Mutex
-	generator    *CoherentDataGenerator
-	oidcManager  *OIDCManager
-	redisClient  *redis.Client
-	ctx          context.Context
-	cancelFunc   context.CancelFunc
-	shutdownChan = make(chan bool)
+	hub           *Hub
+	generator     *CoherentDataGenerator
+	ingestor      *IngestAggregator  // Источник метрик от сервисов, если METRICS_SOURCE содержит ingest
+	remoteWriter  *RemoteWriteSource // Прием Prometheus remote_write, если METRICS_SOURCE содержит remote_write
+	metricsSource MetricsSource      // Источник метрик для рассылки, один или объединение нескольких
+	metricsStore  *TieredStore
+	oidcManager   *OIDCManager
+	redisClient   *redis.Client
+	redisPub      *RedisPublisher
+	instanceID    string
+	ctx           context.Context
+	cancelFunc    context.CancelFunc
+	shutdownChan  = make(chan bool)
 )
 
 // Инициализация OIDC менеджера
@@ -435,19 +458,96 @@ func initRedis(config RedisConfig) (*redis.Client, error) {
 	return client, nil
 }
 
-// Публикация метрик в Redis для других инстансов
-func publishMetricsToRedis(metrics MetricsData) error {
-	if redisClient == nil {
-		return nil // Redis не инициализирован, пропускаем
+// Канал Redis для обмена кадрами между инстансами
+const metricsChannel = "metrics_channel"
+
+// Конверт кадра в Redis. Кадр передается теми же байтами, что и WebSocket-клиентам,
+// а по origin инстанс узнает и пропускает собственные сообщения
+type redisEnvelope struct {
+	Origin        string          `json:"origin"`
+	Frame         json.RawMessage `json:"frame"`
+	LatencySketch *LatencySketch  `json:"latencySketch,omitempty"`
+}
+
+// Публикация локальных кадров в Redis для других инстансов. Запись идет в отдельной горутине,
+// чтобы медленный Redis не задерживал тик генератора
+type RedisPublisher struct {
+	publishErrors uint64
+	dropped       uint64
+
+	client *redis.Client
+	origin string
+	queue  chan *Frame
+}
+
+// Статистика публикации в Redis
+type RedisPublisherStats struct {
+	PublishErrors uint64 `json:"publishErrors"`
+	Dropped       uint64 `json:"dropped"`
+}
+
+// Создание публикатора с ограниченной очередью кадров
+func NewRedisPublisher(client *redis.Client, origin string, queueSize int) *RedisPublisher {
+	return &RedisPublisher{
+		client: client,
+		origin: origin,
+		queue:  make(chan *Frame, queueSize),
 	}
+}
 
-	data, err := json.Marshal(metrics)
-	if err != nil {
-		return err
+// Прием кадра из хаба. Кадры, пришедшие от других инстансов, повторно не публикуются
+func (p *RedisPublisher) Consume(frame *Frame) {
+	if frame.Origin != "" {
+		return
 	}
 
-	// Публикуем данные в Redis канал
-	return redisClient.Publish(context.Background(), "metrics_channel", data).Err()
+	select {
+	case p.queue <- frame:
+	default:
+		atomic.AddUint64(&p.dropped, 1)
+	}
+}
+
+// Снимок статистики публикации
+func (p *RedisPublisher) Stats() RedisPublisherStats {
+	return RedisPublisherStats{
+		PublishErrors: atomic.LoadUint64(&p.publishErrors),
+		Dropped:       atomic.LoadUint64(&p.dropped),
+	}
+}
+
+// Цикл публикации до отмены контекста
+func (p *RedisPublisher) Run(ctx context.Context) {
+	prefix := []byte(`{"origin":` + strconv.Quote(p.origin) + `,"frame":`)
+
+	for {
+		select {
+		case frame := <-p.queue:
+			// Полный JSON-кадр разделяется с клиентами, подписанными на все секции
+			data := frame.JSON(AllTopics, false)
+			payload := make([]byte, 0, len(prefix)+len(data)+1)
+			payload = append(payload, prefix...)
+			payload = append(payload, data...)
+
+			// Скетч задержек нужен другим инстансам для точных перцентилей в сводках
+			if frame.Metrics.LatencySketch != nil {
+				sketch, err := json.Marshal(frame.Metrics.LatencySketch)
+				if err == nil {
+					payload = append(payload, `,"latencySketch":`...)
+					payload = append(payload, sketch...)
+				}
+			}
+			payload = append(payload, '}')
+
+			if err := p.client.Publish(ctx, metricsChannel, payload).Err(); err != nil {
+				atomic.AddUint64(&p.publishErrors, 1)
+				log.Printf("Error publishing metrics to Redis: %v", err)
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
 // Подписка на метрики из Redis от других инстансов
@@ -456,36 +556,45 @@ func subscribeToMetricsFromRedis() {
 		return // Redis не инициализирован, пропускаем
 	}
 
-	pubsub := redisClient.Subscribe(context.Background(), "metrics_channel")
+	pubsub := redisClient.Subscribe(context.Background(), metricsChannel)
 	defer pubsub.Close()
 
 	ch := pubsub.Channel()
 
 	for msg := range ch {
+		payload := []byte(msg.Payload)
+
+		// Старые инстансы публикуют MetricsData без конверта
+		var envelope redisEnvelope
+		if err := json.Unmarshal(payload, &envelope); err != nil {
+			log.Printf("Error unmarshaling Redis metrics: %v", err)
+			continue
+		}
+		origin := "redis"
+		if envelope.Frame != nil {
+			if envelope.Origin == instanceID {
+				continue // Собственный кадр уже разослан локально
+			}
+			origin = envelope.Origin
+			payload = envelope.Frame
+		}
+
 		var metrics MetricsData
-		if err := json.Unmarshal([]byte(msg.Payload), &metrics); err != nil {
+		if err := json.Unmarshal(payload, &metrics); err != nil {
 			log.Printf("Error unmarshaling Redis metrics: %v", err)
 			continue
 		}
+		metrics.LatencySketch = envelope.LatencySketch
 
 		// Отправляем метрики клиентам так же, как и локально сгенерированные
-		data := []byte(msg.Payload)
-
-		clientsMu.Lock()
-		for client := range clients {
-			err := client.WriteMessage(websocket.TextMessage, data)
-			if err != nil {
-				log.Printf("Error sending Redis metrics: %v", err)
-				client.Close()
-				delete(clients, client)
-			}
+		if _, err := hub.Publish(metrics, origin); err != nil {
+			log.Printf("Error encoding Redis metrics: %v", err)
 		}
-		clientsMu.Unlock()
 	}
 }
 
 // Создание нового генератора согласованных данных
-func NewCoherentDataGenerator() *CoherentDataGenerator {
+func NewCoherentDataGenerator(store *TieredStore) *CoherentDataGenerator {
 	// Фиксируем базовое время для начала генерации данных
 	baseTime := time.Now().Add(-24 * 7 * time.Hour) // Неделя назад для исторических данных
 
@@ -553,18 +662,52 @@ func NewCoherentDataGenerator() *CoherentDataGenerator {
 		historicalHourly: make(map[int64]HistoricalMetrics),
 		historicalDaily:  make(map[int64]HistoricalMetrics),
 		historicalWeekly: make(map[int64]HistoricalMetrics),
+		rollups:          newHistoryRollups(),
+		store:            store,
 	}
+	generator.source = newGeneratorSource(time.Now().UnixNano())
+	generator.rng = rand.New(generator.source)
 
 	// Генерируем начальные метрики
 	initialMetrics := generator.generateInitialMetrics()
 	generator.lastMetrics = initialMetrics
 
-	// Генерируем исторические данные для заполнения графиков
-	generator.generateHistoricalData()
-
 	return generator
 }
 
+func (dg *CoherentDataGenerator) Name() string {
+	return "synthetic"
+}
+
+// Историю восстанавливаем из хранилища
+func (dg *CoherentDataGenerator) Start(ctx context.Context) error {
+	if !dg.mergedHistory {
+		dg.loadHistory()
+	}
+	return nil
+}
+
+func (dg *CoherentDataGenerator) disableHistory() {
+	dg.mergedHistory = true
+}
+
+func (dg *CoherentDataGenerator) Stop() error {
+	return nil
+}
+
+func (dg *CoherentDataGenerator) Next(now time.Time) MetricsData {
+	return dg.GenerateMetrics()
+}
+
+func (dg *CoherentDataGenerator) Current() MetricsData {
+	return dg.GetCurrentMetrics()
+}
+
+// Синтетическая неделя для заполнения графиков при первом запуске с пустым хранилищем
+func (dg *CoherentDataGenerator) Backfill(now time.Time) error {
+	return dg.generateHistoricalData(now)
+}
+
 // Генерация начальных метрик
 func (dg *CoherentDataGenerator) generateInitialMetrics() MetricsData {
 	// Создаем начальные региональные данные
@@ -578,7 +721,7 @@ func (dg *CoherentDataGenerator) generateInitialMetrics() MetricsData {
 		regionalUsers := int(float64(dg.baseActiveUsers) * weight)
 
 		// Конверсия немного различается по регионам
-		regionalConversion := 2.5 + (rand.Float64() - 0.5)
+		regionalConversion := 2.5 + (dg.rng.Float64() - 0.5)
 		regionalSales := int(float64(regionalUsers) * regionalConversion / 100)
 
 		regionalData[region] = Region{
@@ -636,74 +779,74 @@ func (dg *CoherentDataGenerator) generateInitialMetrics() MetricsData {
 	return metrics
 }
 
-// Генерация исторических данных
-func (dg *CoherentDataGenerator) generateHistoricalData() {
-	// Создаем исторические данные за последнюю неделю
-	currentTime := dg.baseDataTime
-	now := time.Now()
-
-	// Генерируем почасовые данные за неделю
-	for currentTime.Before(now) {
-		hourTimestamp := time.Date(
-			currentTime.Year(), currentTime.Month(), currentTime.Day(),
-			currentTime.Hour(), 0, 0, 0, currentTime.Location(),
-		).Unix()
+// Генерация исторических данных за прошедшую неделю. Каждый час - один тик генератора, записанный
+// сразу в уровень почасовых сводок со счетчиками, пересчитанными на весь час, чтобы продажи и ошибки
+// заполненных часов были сопоставимы с часами, собранными из живых тиков. Текущий неполный час
+// не заполняется: его наберут живые тики
+func (dg *CoherentDataGenerator) generateHistoricalData(now time.Time) error {
+	from := bucketEnd(dg.baseDataTime.Unix(), time.Hour)
+	end := bucketStart(now.Unix(), time.Hour)
 
+	return dg.store.Backfill(time.Hour, from, end, func(start int64, seconds float64) MetricsData {
 		// Генерируем метрики для этого часа
 		tempTime := dg.currentDataTime
-		dg.currentDataTime = currentTime
+		dg.currentDataTime = time.Unix(start, 0)
 		metrics := dg.GenerateMetrics()
 		dg.currentDataTime = tempTime
 
-		// Сохраняем почасовые метрики
-		dg.historicalHourly[hourTimestamp] = HistoricalMetrics{
-			ActiveUsers:    metrics.ActiveUsers,
-			Sales:          metrics.Sales,
-			ConversionRate: metrics.ConversionRate,
-			ResponseTimeMs: metrics.ResponseTimeMs,
-		}
+		return scaleCounters(metrics, seconds)
+	})
+}
 
-		// Если это начало дня, создаем запись для дневных метрик
-		if currentTime.Hour() == 0 {
-			dayTimestamp := time.Date(
-				currentTime.Year(), currentTime.Month(), currentTime.Day(),
-				0, 0, 0, 0, currentTime.Location(),
-			).Unix()
-
-			// Вычисляем среднее значение за день (приближение)
-			dailyActiveUsers := int(float64(metrics.ActiveUsers) * 16) // Примерно 16 часов активности
-			dailySales := int(float64(metrics.Sales) * 16)
-
-			dg.historicalDaily[dayTimestamp] = HistoricalMetrics{
-				ActiveUsers:    dailyActiveUsers,
-				Sales:          dailySales,
-				ConversionRate: metrics.ConversionRate,
-				ResponseTimeMs: metrics.ResponseTimeMs,
-			}
-		}
+// Тик, представляющий seconds секунд: счетчики событий умножаются на длительность,
+// мгновенные значения остаются как есть
+func scaleCounters(m MetricsData, seconds float64) MetricsData {
+	m.Sales = roundInt(float64(m.Sales) * seconds)
 
-		// Если это начало недели (понедельник), создаем запись для недельных метрик
-		if currentTime.Weekday() == time.Monday && currentTime.Hour() == 0 {
-			weekTimestamp := time.Date(
-				currentTime.Year(), currentTime.Month(), currentTime.Day(),
-				0, 0, 0, 0, currentTime.Location(),
-			).Unix()
-
-			// Вычисляем примерное среднее значение за неделю
-			weeklyActiveUsers := int(float64(metrics.ActiveUsers) * 16 * 5) // Учитываем рабочие дни
-			weeklySales := int(float64(metrics.Sales) * 16 * 5)
-
-			dg.historicalWeekly[weekTimestamp] = HistoricalMetrics{
-				ActiveUsers:    weeklyActiveUsers,
-				Sales:          weeklySales,
-				ConversionRate: metrics.ConversionRate,
-				ResponseTimeMs: metrics.ResponseTimeMs,
-			}
-		}
+	errors := make(map[string]int, len(m.ErrorsByType))
+	for errType, count := range m.ErrorsByType {
+		errors[errType] = roundInt(float64(count) * seconds)
+	}
+	m.ErrorsByType = errors
 
-		// Переходим к следующему часу
-		currentTime = currentTime.Add(1 * time.Hour)
+	regions := make(map[string]Region, len(m.RegionalData))
+	for name, region := range m.RegionalData {
+		region.Sales = roundInt(float64(region.Sales) * seconds)
+		regions[name] = region
 	}
+	m.RegionalData = regions
+
+	if m.LatencySketch != nil {
+		m.LatencySketch = m.LatencySketch.Scaled(seconds)
+	}
+	return m
+}
+
+// Загрузка исторических карт из хранилища
+func (dg *CoherentDataGenerator) loadHistory() {
+	rollups, err := loadHistoryRollups(dg.store, time.Now())
+	if err != nil {
+		log.Printf("Error loading historical data: %v", err)
+		return
+	}
+
+	history := rollups.historical()
+
+	dg.mu.Lock()
+	defer dg.mu.Unlock()
+	dg.rollups = rollups
+	dg.historicalHourly = history.Hourly
+	dg.historicalDaily = history.Daily
+	dg.historicalWeekly = history.Weekly
+}
+
+// Учет тика в сводках текущих часа, дня и недели и обновление исторических карт
+func (dg *CoherentDataGenerator) updateHistory(metrics MetricsData) {
+	dg.rollups.update(HistoricalData{
+		Hourly: dg.historicalHourly,
+		Daily:  dg.historicalDaily,
+		Weekly: dg.historicalWeekly,
+	}, metrics, tickInterval.Seconds())
 }
 
 // GenerateMetrics генерирует новые согласованные метрики
@@ -743,16 +886,16 @@ func (dg *CoherentDataGenerator) GenerateMetrics() MetricsData {
 	errorTrendFactor := 1.0 + dg.trends["errors"]*(daysSinceBase/30)
 
 	// Случайные флуктуации (меньше для более стабильных метрик)
-	userRandomFactor := 0.97 + 0.06*rand.Float64()
-	salesRandomFactor := 0.95 + 0.1*rand.Float64()
-	conversionRandomFactor := 0.98 + 0.04*rand.Float64()
+	userRandomFactor := 0.97 + 0.06*dg.rng.Float64()
+	salesRandomFactor := 0.95 + 0.1*dg.rng.Float64()
+	conversionRandomFactor := 0.98 + 0.04*dg.rng.Float64()
 
 	// Аномальное поведение с малой вероятностью
 	anomalyFactor := 1.0
-	if rand.Float64() < dg.anomalyChance {
+	if dg.rng.Float64() < dg.anomalyChance {
 		// Резкий скачок или падение
-		anomalyFactor = 0.7 + 0.6*rand.Float64()
-		if rand.Float64() < 0.5 {
+		anomalyFactor = 0.7 + 0.6*dg.rng.Float64()
+		if dg.rng.Float64() < 0.5 {
 			anomalyFactor = 1 / anomalyFactor // Иногда делаем падение вместо скачка
 		}
 	}
@@ -798,7 +941,7 @@ func (dg *CoherentDataGenerator) GenerateMetrics() MetricsData {
 		salesRandomFactor)
 
 	// Расчет RPS на основе активных пользователей
-	requestsPerSecond := float64(activeUsers) * (0.03 + 0.02*rand.Float64())
+	requestsPerSecond := float64(activeUsers) * (0.03 + 0.02*dg.rng.Float64())
 
 	// Время отклика зависит от RPS
 	baseResponseTime := dg.lastMetrics.ResponseTimeMs
@@ -807,7 +950,7 @@ func (dg *CoherentDataGenerator) GenerateMetrics() MetricsData {
 	}
 
 	responseTimeFactor := 1.0 + 0.3*math.Log10(requestsPerSecond/50+0.1)
-	responseTimeMs := baseResponseTime * responseTimeFactor * (0.95 + 0.1*rand.Float64())
+	responseTimeMs := baseResponseTime * responseTimeFactor * (0.95 + 0.1*dg.rng.Float64())
 
 	// Ограничения на время отклика
 	if responseTimeMs < 100 {
@@ -840,7 +983,7 @@ func (dg *CoherentDataGenerator) GenerateMetrics() MetricsData {
 		if i == len(dg.errorTypes)-1 {
 			errCount = remainingErrors
 		} else {
-			errCount = int(float64(totalErrors) * (0.1 + 0.3*rand.Float64()))
+			errCount = int(float64(totalErrors) * (0.1 + 0.3*dg.rng.Float64()))
 			if errCount > remainingErrors {
 				errCount = remainingErrors
 			}
@@ -853,12 +996,12 @@ func (dg *CoherentDataGenerator) GenerateMetrics() MetricsData {
 	}
 
 	// Нагрузка сервера и подключения к БД
-	serverLoad := 30 + 50*(requestsPerSecond/200) + 10*rand.Float64()
+	serverLoad := 30 + 50*(requestsPerSecond/200) + 10*dg.rng.Float64()
 	if serverLoad > 100 {
 		serverLoad = 100
 	}
 
-	dbConnections := int(20 + float64(activeUsers)/40 + rand.Float64()*30)
+	dbConnections := int(20 + float64(activeUsers)/40 + dg.rng.Float64()*30)
 
 	// Создаем региональные данные, распределяя пользователей и продажи по регионам
 	regionalData := make(map[string]Region)
@@ -869,12 +1012,12 @@ func (dg *CoherentDataGenerator) GenerateMetrics() MetricsData {
 		weight := dg.regionWeights[region]
 
 		// Добавляем небольшую случайность в региональные веса
-		adjustedWeight := weight * (0.9 + 0.2*rand.Float64())
+		adjustedWeight := weight * (0.9 + 0.2*dg.rng.Float64())
 
 		regionalUsers := int(float64(activeUsers) * adjustedWeight)
 
 		// Конверсия может немного отличаться по регионам
-		regionalConversion := conversionRate * (0.9 + 0.2*rand.Float64())
+		regionalConversion := conversionRate * (0.9 + 0.2*dg.rng.Float64())
 		regionalSales := int(float64(regionalUsers) * regionalConversion / 100)
 
 		regionalData[region] = Region{
@@ -912,7 +1055,7 @@ func (dg *CoherentDataGenerator) GenerateMetrics() MetricsData {
 		weight := dg.sourceWeights[source]
 
 		// Добавляем небольшую случайность в веса источников
-		adjustedWeight := weight * (0.85 + 0.3*rand.Float64())
+		adjustedWeight := weight * (0.85 + 0.3*dg.rng.Float64())
 
 		sourceUsers := int(float64(activeUsers) * adjustedWeight)
 		sourcesData[source] = sourceUsers
@@ -931,9 +1074,9 @@ func (dg *CoherentDataGenerator) GenerateMetrics() MetricsData {
 
 	// Создаем воронку конверсии
 	visitors := activeUsers
-	productViews := int(float64(visitors) * (0.65 + 0.1*rand.Float64()))
-	addedToCart := int(float64(productViews) * (0.25 + 0.1*rand.Float64()))
-	beganCheckout := int(float64(addedToCart) * (0.45 + 0.1*rand.Float64()))
+	productViews := int(float64(visitors) * (0.65 + 0.1*dg.rng.Float64()))
+	addedToCart := int(float64(productViews) * (0.25 + 0.1*dg.rng.Float64()))
+	beganCheckout := int(float64(addedToCart) * (0.45 + 0.1*dg.rng.Float64()))
 	purchased := sales // Используем рассчитанные продажи для согласованности
 
 	funnel := ConversionFunnel{
@@ -944,19 +1087,6 @@ func (dg *CoherentDataGenerator) GenerateMetrics() MetricsData {
 		PurchasedItems: purchased,
 	}
 
-	// Генерируем или обновляем исторические данные
-	hourTimestamp := time.Date(
-		now.Year(), now.Month(), now.Day(),
-		now.Hour(), 0, 0, 0, now.Location(),
-	).Unix()
-
-	dg.historicalHourly[hourTimestamp] = HistoricalMetrics{
-		ActiveUsers:    activeUsers,
-		Sales:          sales,
-		ConversionRate: conversionRate,
-		ResponseTimeMs: responseTimeMs,
-	}
-
 	// Создаем метрики с согласованными данными
 	metrics := MetricsData{
 		Timestamp:           now.Unix(),
@@ -972,73 +1102,32 @@ func (dg *CoherentDataGenerator) GenerateMetrics() MetricsData {
 		RegionalData:        regionalData,
 		SourcesData:         sourcesData,
 		ConversionFunnel:    funnel,
-		HistoricalData: HistoricalData{
-			Hourly: dg.historicalHourly,
-			Daily:  dg.historicalDaily,
-			Weekly: dg.historicalWeekly,
-		},
 	}
 
-	// Публикуем метрики в Redis для других инстансов
-	if err := publishMetricsToRedis(metrics); err != nil {
-		log.Printf("Error publishing metrics to Redis: %v", err)
+	// Распределение времени ответа за тик: перцентили для кадра, скетч для сводок
+	metrics.LatencySketch = generateLatencySketch(dg.rng, responseTimeMs, requestsPerSecond*tickInterval.Seconds())
+	metrics.Latency = metrics.LatencySketch.Percentiles()
+
+	// Обновляем исторические данные: сводки открытых периодов растут с каждым тиком
+	if !dg.mergedHistory {
+		dg.updateHistory(metrics)
+		metrics.HistoricalData = HistoricalData{
+			Hourly: copyHistory(dg.historicalHourly),
+			Daily:  copyHistory(dg.historicalDaily),
+			Weekly: copyHistory(dg.historicalWeekly),
+		}
 	}
 
 	dg.lastMetrics = metrics
 	return metrics
 }
 
-// Получение исторических данных для графиков
-func (dg *CoherentDataGenerator) GetHistoricalData(period string, metric string) []map[string]interface{} {
-	dg.mu.Lock()
-	defer dg.mu.Unlock()
-
-	var source map[int64]HistoricalMetrics
-
-	switch period {
-	case "hourly":
-		source = dg.historicalHourly
-	case "daily":
-		source = dg.historicalDaily
-	case "weekly":
-		source = dg.historicalWeekly
-	default:
-		source = dg.historicalHourly
-	}
-
-	result := make([]map[string]interface{}, 0, len(source))
-
-	// Сортируем ключи для хронологического порядка
-	var timestamps []int64
-	for ts := range source {
-		timestamps = append(timestamps, ts)
-	}
-	sort.Slice(timestamps, func(i, j int) bool {
-		return timestamps[i] < timestamps[j]
-	})
-
-	for _, ts := range timestamps {
-		data := source[ts]
-		item := map[string]interface{}{
-			"timestamp": ts,
-		}
-
-		switch metric {
-		case "activeUsers":
-			item["value"] = data.ActiveUsers
-		case "sales":
-			item["value"] = data.Sales
-		case "conversionRate":
-			item["value"] = data.ConversionRate
-		case "responseTime":
-			item["value"] = data.ResponseTimeMs
-		default:
-			item["value"] = data.ActiveUsers
-		}
-
-		result = append(result, item)
+// Копия исторической карты: снимок метрик не должен меняться вместе с генератором
+func copyHistory(source map[int64]HistoricalMetrics) map[int64]HistoricalMetrics {
+	result := make(map[int64]HistoricalMetrics, len(source))
+	for ts, data := range source {
+		result[ts] = data
 	}
-
 	return result
 }
 
@@ -1056,14 +1145,18 @@ func generateRandomState() string {
 
 // Обработчик WebSocket-соединений с проверкой JWT
 func handleConnections(c *gin.Context) {
+	// Во время остановки новые соединения не принимаем, клиент переподключится к другому инстансу
+	if rejectWhileDraining(c) {
+		return
+	}
+
 	// Проверяем наличие JWT в запросе
+	// Согласуем формат кадров через Sec-WebSocket-Protocol, там же может прийти токен
+	negotiated := negotiateSubprotocol(c.Request)
+
 	tokenString := c.Query("token")
 	if tokenString == "" {
-		// Пробуем получить из заголовка
-		authHeader := c.GetHeader("Sec-WebSocket-Protocol")
-		if authHeader != "" {
-			tokenString = authHeader
-		}
+		tokenString = negotiated.Token
 	}
 
 	// Проверяем токен, если требуется аутентификация
@@ -1081,70 +1174,117 @@ func handleConnections(c *gin.Context) {
 		}
 	}
 
-	// Апгрейд соединения до WebSocket
-	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	// Начальная подписка на секции метрик
+	topics, err := initialTopics(c.Query("topics"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "validTopics": validTopicNames()})
+		return
+	}
+
+	// Полные кадры или дельты
+	delta, err := parseFrameMode(c.Query("mode"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Частота кадров: базовый тик или окно агрегации
+	interval, err := parseInterval(c.Query("interval"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "validIntervals": validIntervalNames()})
+		return
+	}
+
+	// Номер последнего полученного кадра для продолжения потока после переподключения
+	var since StreamPosition
+	resume := c.Query("since") != ""
+	if resume {
+		since, err = parseStreamPosition(c.Query("since"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since parameter"})
+			return
+		}
+	}
+
+	// Апгрейд соединения до WebSocket, подтверждаем выбранный подпротокол
+	var responseHeader http.Header
+	if negotiated.Subprotocol != "" {
+		responseHeader = http.Header{"Sec-Websocket-Protocol": []string{negotiated.Subprotocol}}
+	}
+	ws, err := upgrader.Upgrade(c.Writer, c.Request, responseHeader)
 	if err != nil {
 		log.Printf("Error upgrading connection: %v", err)
 		return
 	}
 	defer ws.Close()
 
-	clientsMu.Lock()
-	clients[ws] = true
-	clientsMu.Unlock()
+	// Регистрируем клиента в хабе, запись идет в отдельной горутине
+	options := ClientOptions{Topics: topics, Delta: delta, Format: negotiated.Format, Interval: interval}
+
+	var client *Client
+	if resume {
+		client = hub.Resume(options, since)
+	} else {
+		client = hub.Register(options)
+	}
+	defer hub.Unregister(client)
+	go client.writeWebSocket(ws)
+
+	// Клиент должен отвечать на ping или присылать сообщения, иначе соединение считается мертвым
+	pongTimeout := hub.config.PongTimeout
+	ws.SetReadDeadline(time.Now().Add(pongTimeout))
+	ws.SetPongHandler(func(string) error {
+		if client.closed() {
+			return nil // Ждем ответный close-фрейм, дедлайн уже выставлен горутиной записи
+		}
+		return ws.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
 
-	// Читаем сообщения для обработки отключений
+	// Читаем управляющие сообщения клиента и отслеживаем отключение
 	for {
-		_, _, err := ws.ReadMessage()
+		messageType, message, err := ws.ReadMessage()
 		if err != nil {
-			clientsMu.Lock()
-			delete(clients, ws)
-			clientsMu.Unlock()
+			var closeErr *websocket.CloseError
+			switch {
+			case errors.As(err, &closeErr):
+				// Клиент прислал close-фрейм: сам или в ответ на наш
+				client.markClean()
+			case isTimeout(err) && !client.closed():
+				hub.countIdleReaped()
+				log.Printf("Reaping idle WebSocket connection: no pong within %v", pongTimeout)
+			}
 			break
 		}
+		if client.closed() {
+			continue // Соединение закрывается, сообщения клиента больше не обрабатываем
+		}
+		ws.SetReadDeadline(time.Now().Add(pongTimeout))
 
-		// Проверяем состояние сервера
-		select {
-		case <-ctx.Done():
-			// Сервер завершает работу, закрываем соединение
-			ws.WriteMessage(websocket.CloseMessage,
-				websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server shutting down"))
-			return
-		default:
-			// Продолжаем работу
+		// Управляющие сообщения всегда передаются текстом в JSON, независимо от формата кадров
+		if messageType == websocket.TextMessage {
+			handleControlMessage(client, message)
 		}
 	}
 }
 
 // Отправка метрик всем подключенным клиентам
 func broadcastMetrics() {
-	ticker := time.NewTicker(1 * time.Second)
+	ticker := time.NewTicker(tickInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
+		case tick := <-ticker.C:
 			// Генерируем новые метрики
-			metrics := generator.GenerateMetrics()
+			started := time.Now()
+			metrics := metricsSource.Next(started)
+			storeTick(metricsStore, metrics)
 
-			// Сериализуем метрики в JSON
-			data, err := json.Marshal(metrics)
-			if err != nil {
+			// Сериализуем кадр один раз и разделяем его между клиентами и остальными получателями
+			if _, err := hub.Publish(metrics, ""); err != nil {
 				log.Printf("Error marshaling metrics: %v", err)
-				continue
 			}
-
-			// Отправляем всем подключенным клиентам
-			clientsMu.Lock()
-			for client := range clients {
-				err := client.WriteMessage(websocket.TextMessage, data)
-				if err != nil {
-					log.Printf("Error sending metrics: %v", err)
-					client.Close()
-					delete(clients, client)
-				}
-			}
-			clientsMu.Unlock()
+			serverStats.ObserveTick(metrics, started.Sub(tick), time.Since(started))
 
 		case <-ctx.Done():
 			// Сигнал завершения работы
@@ -1155,7 +1295,7 @@ func broadcastMetrics() {
 }
 
 // Graceful shutdown
-func setupGracefulShutdown(server *http.Server) {
+func setupGracefulShutdown(server *http.Server, drainDelay, drainTimeout time.Duration, snapshotPath string) {
 	// Канал для получения сигналов завершения
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -1164,9 +1304,21 @@ func setupGracefulShutdown(server *http.Server) {
 		sig := <-sigChan
 		log.Printf("Received signal: %v. Starting graceful shutdown...", sig)
 
-		// Сначала отменяем контекст, чтобы остановить фоновые горутины
+		// Закрываем WebSocket и SSE соединения: Shutdown не отслеживает перехваченные соединения
+		drainClients(drainDelay, drainTimeout)
+
+		// Затем отменяем контекст, чтобы остановить фоновые горутины
 		cancelFunc()
 
+		// Генерация остановлена, сохраняем итоговое состояние генератора
+		if snapshotPath != "" && generator != nil {
+			if err := generator.SaveSnapshot(snapshotPath); err != nil {
+				log.Printf("Generator snapshot error: %v", err)
+			} else {
+				log.Printf("Generator snapshot saved to %s", snapshotPath)
+			}
+		}
+
 		// Устанавливаем таймаут на завершение
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 15*time.Second)
 		defer shutdownCancel()
@@ -1176,6 +1328,16 @@ func setupGracefulShutdown(server *http.Server) {
 			log.Printf("HTTP server shutdown error: %v", err)
 		}
 
+		// Останавливаем источники метрик
+		if err := metricsSource.Stop(); err != nil {
+			log.Printf("Metrics source stop error: %v", err)
+		}
+
+		// Закрываем хранилище, чтобы активный сегмент получил индекс
+		if err := metricsStore.Close(); err != nil {
+			log.Printf("Metrics store close error: %v", err)
+		}
+
 		// Закрываем Redis, если используется
 		if redisClient != nil {
 			if err := redisClient.Close(); err != nil {
@@ -1189,13 +1351,133 @@ func setupGracefulShutdown(server *http.Server) {
 }
 
 func main() {
+	// Снимок состояния генератора: восстановление при запуске и сохранение при остановке
+	restorePath := flag.String("restore", getEnv("GENERATOR_RESTORE", ""), "restore generator state from a snapshot file at startup")
+	snapshotPath := flag.String("snapshot", getEnv("GENERATOR_SNAPSHOT", ""), "save generator state to a snapshot file on shutdown")
+	flag.Parse()
+
 	// Создаем контекст с возможностью отмены
 	ctx, cancelFunc = context.WithCancel(context.Background())
 
 	// Инициализация генератора данных
 	gofakeit.Seed(time.Now().UnixNano())
-	rand.Seed(time.Now().UnixNano())
-	generator = NewCoherentDataGenerator()
+	// Хранилище тиков: при недоступности каталога работаем в памяти, как раньше
+	retention, retentionErr := parseRetention(getEnv("METRICS_RETENTION", defaultRetention))
+	if retentionErr != nil {
+		log.Fatalf("Invalid METRICS_RETENTION: %v", retentionErr)
+	}
+
+	var storeErr error
+	metricsStore, storeErr = openTieredStore(getEnv("METRICS_STORE", "disk"), getEnv("METRICS_STORE_DIR", "data/metrics"), retention)
+	if storeErr != nil {
+		log.Printf("Warning: metrics store initialization failed: %v. Historical data will not survive restarts.", storeErr)
+		metricsStore, _ = openTieredStore("memory", "", retention)
+	}
+
+	// Источники метрик: синтетический генератор, выборки от сервисов по HTTP или StatsD,
+	// воспроизведение записи. Несколько источников через запятую объединяются
+	ingestConfig := IngestConfig{
+		MaxBodyBytes:   int64(getEnvInt("INGEST_MAX_BODY_BYTES", 1<<20)),
+		MaxSamples:     getEnvInt("INGEST_MAX_SAMPLES", 5000),
+		MaxLabelValues: getEnvInt("INGEST_MAX_LABEL_VALUES", 100),
+		GaugeTTL:       getEnvDuration("INGEST_GAUGE_TTL", time.Minute),
+	}
+	var sources []MetricsSource
+	for _, name := range splitList(getEnv("METRICS_SOURCE", "synthetic")) {
+		for _, source := range sources {
+			if source.Name() == name {
+				log.Fatalf("Invalid METRICS_SOURCE: %s is listed twice", name)
+			}
+		}
+		switch name {
+		case "synthetic":
+			generator = NewCoherentDataGenerator(metricsStore)
+			sources = append(sources, generator)
+		case "ingest":
+			ingestor = NewIngestAggregator(metricsStore, ingestConfig)
+			sources = append(sources, ingestor)
+		case "statsd":
+			statsd, err := NewStatsdSource(metricsStore, getEnv("STATSD_ADDR", ":8125"),
+				getEnv("STATSD_MAPPING", defaultStatsdMapping), getEnv("STATSD_TAGS", defaultStatsdTags), ingestConfig)
+			if err != nil {
+				log.Fatalf("Invalid StatsD configuration: %v", err)
+			}
+			sources = append(sources, statsd)
+		case "remote_write":
+			var err error
+			remoteWriter, err = NewRemoteWriteSource(metricsStore,
+				getEnv("REMOTE_WRITE_MAPPING", defaultRemoteWriteMapping), getEnv("REMOTE_WRITE_LABELS", defaultRemoteWriteLabels), ingestConfig)
+			if err != nil {
+				log.Fatalf("Invalid remote write configuration: %v", err)
+			}
+			sources = append(sources, remoteWriter)
+		case "replay":
+			path := getEnv("REPLAY_FILE", "")
+			if path == "" {
+				log.Fatalf("METRICS_SOURCE=replay requires REPLAY_FILE")
+			}
+			sources = append(sources, NewReplaySource(metricsStore, path, getEnv("REPLAY_LOOP", "true") == "true"))
+		default:
+			log.Fatalf("Invalid METRICS_SOURCE: %q, valid sources: %s", name, strings.Join(metricsSourceNames, ", "))
+		}
+	}
+	switch len(sources) {
+	case 0:
+		log.Fatalf("Invalid METRICS_SOURCE: no sources configured, valid sources: %s", strings.Join(metricsSourceNames, ", "))
+	case 1:
+		metricsSource = sources[0]
+	default:
+		metricsSource = NewMergedSource(metricsStore, sources...)
+	}
+	if generator == nil && (*restorePath != "" || *snapshotPath != "") {
+		log.Fatalf("Generator snapshots require the synthetic source in METRICS_SOURCE")
+	}
+
+	// Прошлые данные пишем только при первом запуске с пустым хранилищем
+	if _, _, ok := metricsStore.Bounds(); !ok {
+		if err := metricsSource.Backfill(time.Now()); err != nil {
+			log.Printf("Warning: historical backfill failed: %v", err)
+		}
+	}
+	if err := metricsSource.Start(ctx); err != nil {
+		log.Fatalf("Failed to start metrics source %s: %v", metricsSource.Name(), err)
+	}
+	log.Printf("Metrics source: %s", metricsSource.Name())
+
+	if generator != nil && *restorePath != "" {
+		// Отсутствующий файл - обычный первый запуск, поврежденный снимок - ошибка конфигурации
+		if err := generator.LoadSnapshot(*restorePath); err == nil {
+			log.Printf("Generator state restored from %s", *restorePath)
+		} else if os.IsNotExist(err) {
+			log.Printf("Generator snapshot %s not found, starting with fresh state", *restorePath)
+		} else {
+			log.Fatalf("Failed to restore generator state: %v", err)
+		}
+	}
+
+	// Инициализация хаба рассылки метрик
+	var hubErr error
+	hub, hubErr = NewHub(HubConfig{
+		SendQueueSize:      getEnvInt("WS_SEND_QUEUE_SIZE", 16),
+		SlowConsumerPolicy: SlowConsumerPolicy(getEnv("WS_SLOW_CONSUMER_POLICY", string(PolicyDropOldest))),
+		SnapshotInterval:   getEnvInt("WS_SNAPSHOT_INTERVAL", 60),
+		ReplayBufferSize:   getEnvInt("WS_REPLAY_BUFFER_SIZE", 300),
+		PingInterval:       getEnvDuration("WS_PING_INTERVAL", 30*time.Second),
+		PongTimeout:        getEnvDuration("WS_PONG_TIMEOUT", 60*time.Second),
+		WriteTimeout:       getEnvDuration("WS_WRITE_TIMEOUT", 10*time.Second),
+		MaxLifetime:        getEnvDuration("WS_MAX_LIFETIME", 0),
+		Intervals:          getEnvDurations("WS_INTERVALS", []time.Duration{time.Second, 5 * time.Second, 15 * time.Second, time.Minute}),
+	})
+	if hubErr != nil {
+		log.Fatalf("Invalid hub configuration: %v", hubErr)
+	}
+
+	// Идентификатор инстанса для распознавания собственных сообщений в Redis
+	instanceID = getEnv("INSTANCE_ID", "")
+	if instanceID == "" {
+		hostname, _ := os.Hostname()
+		instanceID = hostname + "-" + gofakeit.UUID()[:8]
+	}
 
 	// Попытка инициализации Redis для High Availability
 	redisConfig := RedisConfig{
@@ -1210,7 +1492,10 @@ func main() {
 		log.Printf("Warning: Redis initialization failed: %v. Running in standalone mode.", redisErr)
 	} else {
 		log.Println("Redis connected. Running in high availability mode.")
-		// Запускаем подписку на метрики от других инстансов
+		// Публикуем локальные кадры и подписываемся на кадры от других инстансов
+		redisPub = NewRedisPublisher(redisClient, instanceID, getEnvInt("REDIS_PUBLISH_QUEUE_SIZE", 16))
+		hub.AddSink(redisPub)
+		go redisPub.Run(ctx)
 		go subscribeToMetricsFromRedis()
 	}
 
@@ -1240,16 +1525,48 @@ func main() {
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
 		AllowMethods:     []string{"GET", "POST", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Content-Length", "Accept-Encoding", "Authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Content-Length", "Accept-Encoding", "Authorization", "Last-Event-ID", "X-API-Key"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
 	}))
 
 	// Общедоступные маршруты
 	r.GET("/health", func(c *gin.Context) {
+		// Во время остановки балансировщик должен вывести инстанс из ротации
+		if hub.Draining() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
 
+	// Прием метрик от сервисов и Prometheus remote_write по API-ключу, независимо от OIDC
+	ingestKeys := splitList(getEnv("INGEST_API_KEYS", ""))
+	if (ingestor != nil || remoteWriter != nil) && len(ingestKeys) == 0 {
+		log.Println("Warning: METRICS_SOURCE includes ingest or remote_write but INGEST_API_KEYS is empty, all ingest requests will be rejected")
+	}
+	r.POST("/api/ingest", APIKeyMiddleware(ingestKeys), handleIngest(ingestor))
+	r.POST("/api/v1/write", APIKeyMiddleware(ingestKeys), handleRemoteWrite(remoteWriter))
+
+	// Метрики для сбора Prometheus. С PROMETHEUS_API_KEYS сборщик передает ключ как для приема.
+	// При включенном OIDC без ключей не запускаемся, если открытый доступ не разрешен явно
+	metricsAuth, metricsAuthErr := prometheusAuth(
+		splitList(getEnv("PROMETHEUS_API_KEYS", "")),
+		getEnv("ENABLE_OIDC", "") == "true",
+		getEnv("PROMETHEUS_ALLOW_UNAUTHENTICATED", "") == "true",
+	)
+	if metricsAuthErr != nil {
+		log.Fatalf("Refusing to expose /metrics without authentication: %v", metricsAuthErr)
+	}
+	if metricsAuth != nil {
+		r.GET("/metrics", metricsAuth, handlePrometheusMetrics)
+	} else {
+		if getEnv("ENABLE_OIDC", "") == "true" {
+			log.Println("Warning: PROMETHEUS_ALLOW_UNAUTHENTICATED is set, /metrics is public while OIDC is enabled")
+		}
+		r.GET("/metrics", handlePrometheusMetrics)
+	}
+
 	// Маршруты для аутентификации
 	if oidcManager != nil {
 		auth := r.Group("/auth")
@@ -1263,34 +1580,37 @@ func main() {
 		protected := r.Group("/api")
 		protected.Use(oidcManager.AuthMiddleware())
 		{
+			// Поток метрик через Server-Sent Events
+			protected.GET("/sse", handleSSE)
+
 			protected.GET("/metrics/current", func(c *gin.Context) {
-				c.JSON(http.StatusOK, generator.GetCurrentMetrics())
+				c.JSON(http.StatusOK, metricsSource.Current())
 			})
 
-			// Добавляем маршрут для получения исторических данных
-			protected.GET("/metrics/historical/:period/:metric", func(c *gin.Context) {
-				period := c.Param("period") // hourly, daily, weekly
-				metric := c.Param("metric") // activeUsers, sales, conversionRate, responseTime
-
-				if period == "" || metric == "" {
-					c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parameters"})
-					return
-				}
-
-				data := generator.GetHistoricalData(period, metric)
-				c.JSON(http.StatusOK, data)
-			})
+			// Исторические данные: ?from=, ?to=, ?step=, ?limit=, ?fill=
+			protected.GET("/metrics/historical/:period/:metric", handleHistoricalMetrics)
+			protected.GET("/metrics/historical/:period", handleHistoricalSeries)
+			protected.GET("/metrics/compare/:metric", handleCompareMetrics)
+			protected.GET("/metrics/export", handleExportMetrics)
 
 			// Маршрут только для админов
 			admin := protected.Group("/admin")
 			admin.Use(oidcManager.RoleMiddleware("admin"))
 			{
 				admin.GET("/status", func(c *gin.Context) {
-					c.JSON(http.StatusOK, gin.H{
-						"clients": len(clients),
-						"uptime":  time.Since(time.Unix(0, 0)),
-					})
+					status := gin.H{
+						"clients":   hub.Count(),
+						"hub":       hub.Stats(),
+						"broadcast": serverStats.Stats(),
+						"startedAt": processStart.Unix(),
+						"uptime":    time.Since(processStart).Round(time.Second).String(),
+					}
+					if redisPub != nil {
+						status["redis"] = redisPub.Stats()
+					}
+					c.JSON(http.StatusOK, status)
 				})
+				admin.POST("/snapshot", handleSaveSnapshot)
 			}
 		}
 
@@ -1299,23 +1619,16 @@ func main() {
 	} else {
 		// Если OIDC не настроен, все маршруты без аутентификации
 		r.GET("/ws", handleConnections)
+		r.GET("/sse", handleSSE)
 		r.GET("/metrics/current", func(c *gin.Context) {
-			c.JSON(http.StatusOK, generator.GetCurrentMetrics())
+			c.JSON(http.StatusOK, metricsSource.Current())
 		})
 
-		// Добавляем маршрут для получения исторических данных
-		r.GET("/metrics/historical/:period/:metric", func(c *gin.Context) {
-			period := c.Param("period") // hourly, daily, weekly
-			metric := c.Param("metric") // activeUsers, sales, conversionRate, responseTime
-
-			if period == "" || metric == "" {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parameters"})
-				return
-			}
-
-			data := generator.GetHistoricalData(period, metric)
-			c.JSON(http.StatusOK, data)
-		})
+		// Исторические данные: ?from=, ?to=, ?step=, ?limit=, ?fill=
+		r.GET("/metrics/historical/:period/:metric", handleHistoricalMetrics)
+		r.GET("/metrics/historical/:period", handleHistoricalSeries)
+		r.GET("/metrics/compare/:metric", handleCompareMetrics)
+		r.GET("/metrics/export", handleExportMetrics)
 	}
 
 	// Создаем HTTP сервер
@@ -1325,11 +1638,14 @@ func main() {
 	}
 
 	// Настраиваем graceful shutdown
-	setupGracefulShutdown(server)
+	setupGracefulShutdown(server, getEnvDuration("WS_DRAIN_DELAY", 0), getEnvDuration("WS_DRAIN_TIMEOUT", 10*time.Second), *snapshotPath)
 
 	// Запуск широковещательной рассылки метрик
 	go broadcastMetrics()
 
+	// Фоновое прореживание истории по уровням хранения
+	go metricsStore.RunCompactor(ctx, getEnvDuration("METRICS_COMPACTION_INTERVAL", time.Minute))
+
 	// Запуск сервера
 	log.Printf("Server starting on %s...", server.Addr)
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -1349,3 +1665,52 @@ func getEnv(key, defaultValue string) string {
 	}
 	return value
 }
+
+// Хелпер для получения целочисленных переменных окружения
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Warning: invalid value %q for %s, using default %d", value, key, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// Хелпер для получения длительностей из переменных окружения (формат time.ParseDuration)
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Warning: invalid value %q for %s, using default %v", value, key, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// Хелпер для получения списка длительностей через запятую, например 1s,5s,15s
+func getEnvDurations(key string, defaultValue []time.Duration) []time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var parsed []time.Duration
+	for _, item := range strings.Split(value, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(item))
+		if err != nil {
+			log.Printf("Warning: invalid value %q for %s, using default %v", value, key, defaultValue)
+			return defaultValue
+		}
+		parsed = append(parsed, d)
+	}
+	return parsed
+}
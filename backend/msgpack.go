@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Минимальный кодировщик MessagePack. Структуры кодируются как карты
+// по тем же именам полей, что и в JSON (теги json, включая omitempty),
+// поэтому бинарный кадр повторяет структуру JSON-кадра один в один.
+// Ключи карт всегда строки, как и в JSON
+type msgpackWriter struct {
+	buf []byte
+}
+
+func (w *msgpackWriter) Bytes() []byte {
+	return w.buf
+}
+
+func (w *msgpackWriter) WriteNil() {
+	w.buf = append(w.buf, 0xc0)
+}
+
+func (w *msgpackWriter) WriteBool(v bool) {
+	if v {
+		w.buf = append(w.buf, 0xc3)
+	} else {
+		w.buf = append(w.buf, 0xc2)
+	}
+}
+
+func (w *msgpackWriter) WriteInt(v int64) {
+	switch {
+	case v >= 0:
+		w.WriteUint(uint64(v))
+	case v >= -32:
+		w.buf = append(w.buf, byte(v))
+	case v >= math.MinInt8:
+		w.buf = append(w.buf, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		w.buf = append(w.buf, 0xd1)
+		w.buf = appendUint16(w.buf, uint16(v))
+	case v >= math.MinInt32:
+		w.buf = append(w.buf, 0xd2)
+		w.buf = appendUint32(w.buf, uint32(v))
+	default:
+		w.buf = append(w.buf, 0xd3)
+		w.buf = appendUint64(w.buf, uint64(v))
+	}
+}
+
+func (w *msgpackWriter) WriteUint(v uint64) {
+	switch {
+	case v <= 0x7f:
+		w.buf = append(w.buf, byte(v))
+	case v <= math.MaxUint8:
+		w.buf = append(w.buf, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		w.buf = append(w.buf, 0xcd)
+		w.buf = appendUint16(w.buf, uint16(v))
+	case v <= math.MaxUint32:
+		w.buf = append(w.buf, 0xce)
+		w.buf = appendUint32(w.buf, uint32(v))
+	default:
+		w.buf = append(w.buf, 0xcf)
+		w.buf = appendUint64(w.buf, v)
+	}
+}
+
+func (w *msgpackWriter) WriteFloat(v float64) {
+	w.buf = append(w.buf, 0xcb)
+	w.buf = appendUint64(w.buf, math.Float64bits(v))
+}
+
+func (w *msgpackWriter) WriteString(v string) {
+	n := len(v)
+	switch {
+	case n < 32:
+		w.buf = append(w.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		w.buf = append(w.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, 0xda)
+		w.buf = appendUint16(w.buf, uint16(n))
+	default:
+		w.buf = append(w.buf, 0xdb)
+		w.buf = appendUint32(w.buf, uint32(n))
+	}
+	w.buf = append(w.buf, v...)
+}
+
+func (w *msgpackWriter) WriteArrayHeader(n int) {
+	switch {
+	case n < 16:
+		w.buf = append(w.buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, 0xdc)
+		w.buf = appendUint16(w.buf, uint16(n))
+	default:
+		w.buf = append(w.buf, 0xdd)
+		w.buf = appendUint32(w.buf, uint32(n))
+	}
+}
+
+func (w *msgpackWriter) WriteMapHeader(n int) {
+	switch {
+	case n < 16:
+		w.buf = append(w.buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, 0xde)
+		w.buf = appendUint16(w.buf, uint16(n))
+	default:
+		w.buf = append(w.buf, 0xdf)
+		w.buf = appendUint32(w.buf, uint32(n))
+	}
+}
+
+// Кодирование произвольного значения
+func (w *msgpackWriter) Write(v interface{}) error {
+	return w.writeValue(reflect.ValueOf(v))
+}
+
+func (w *msgpackWriter) writeValue(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Invalid:
+		w.WriteNil()
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			w.WriteNil()
+			return nil
+		}
+		return w.writeValue(v.Elem())
+	case reflect.Bool:
+		w.WriteBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.WriteInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		w.WriteUint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		w.WriteFloat(v.Float())
+	case reflect.String:
+		w.WriteString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			w.WriteNil()
+			return nil
+		}
+		return w.writeArray(v)
+	case reflect.Array:
+		return w.writeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			w.WriteNil()
+			return nil
+		}
+		return w.writeMap(v)
+	case reflect.Struct:
+		return w.writeStruct(v)
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func (w *msgpackWriter) writeArray(v reflect.Value) error {
+	w.WriteArrayHeader(v.Len())
+	for i := 0; i < v.Len(); i++ {
+		if err := w.writeValue(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Карты кодируются с отсортированными строковыми ключами, чтобы кадр был детерминированным
+func (w *msgpackWriter) writeMap(v reflect.Value) error {
+	type entry struct {
+		key   string
+		value reflect.Value
+	}
+
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := mapKeyString(iter.Key())
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{key: key, value: iter.Value()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	w.WriteMapHeader(len(entries))
+	for _, e := range entries {
+		w.WriteString(e.key)
+		if err := w.writeValue(e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *msgpackWriter) writeStruct(v reflect.Value) error {
+	fields := cachedStructFields(v.Type())
+
+	present := make([]reflect.Value, len(fields))
+	count := 0
+	for i, f := range fields {
+		fv := v.Field(f.index)
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		present[i] = fv
+		count++
+	}
+
+	w.WriteMapHeader(count)
+	for i, f := range fields {
+		if !present[i].IsValid() {
+			continue
+		}
+		w.WriteString(f.name)
+		if err := w.writeValue(present[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ключ карты в строковом виде по правилам encoding/json
+func mapKeyString(key reflect.Value) (string, error) {
+	switch key.Kind() {
+	case reflect.String:
+		return key.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(key.Uint(), 10), nil
+	default:
+		return "", fmt.Errorf("msgpack: unsupported map key type %s", key.Type())
+	}
+}
+
+// Описание поля структуры по json-тегу
+type structField struct {
+	index     int
+	name      string
+	omitEmpty bool
+}
+
+var structFieldsCache sync.Map // reflect.Type -> []structField
+
+func cachedStructFields(t reflect.Type) []structField {
+	if cached, ok := structFieldsCache.Load(t); ok {
+		return cached.([]structField)
+	}
+
+	fields := make([]structField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue // Неэкспортируемое поле
+		}
+
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts := tag, ""
+		if idx := strings.Index(tag, ","); idx >= 0 {
+			name, opts = tag[:idx], tag[idx+1:]
+		}
+		if name == "" {
+			name = sf.Name
+		}
+
+		fields = append(fields, structField{
+			index:     i,
+			name:      name,
+			omitEmpty: strings.Contains(opts, "omitempty"),
+		})
+	}
+
+	structFieldsCache.Store(t, fields)
+	return fields
+}
+
+// Пустое значение по правилам omitempty из encoding/json
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(v>>32)), uint32(v))
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Декодирование эталонной библиотекой в дерево интерфейсов
+func decodeMsgpackReference(t *testing.T, data []byte) interface{} {
+	t.Helper()
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("reference decoder: %v", err)
+	}
+	if _, err := dec.DecodeInterface(); err == nil {
+		t.Fatal("trailing data after msgpack value")
+	}
+	return normalizeDecoded(v)
+}
+
+func decodeJSONReference(t *testing.T, data []byte) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	return normalizeDecoded(v)
+}
+
+// Числа приводятся к float64, карты - к строковым ключам, чтобы сравнивать
+// результаты декодеров с разными типами целых
+func normalizeDecoded(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			result[key] = normalizeDecoded(value)
+		}
+		return result
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			result[key.(string)] = normalizeDecoded(value)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, value := range v {
+			result[i] = normalizeDecoded(value)
+		}
+		return result
+	}
+
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint())
+	case reflect.Float32:
+		return value.Float()
+	}
+	return v
+}
+
+type msgpackTestInner struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value,omitempty"`
+}
+
+type msgpackTestValue struct {
+	Ints       []int64                     `json:"ints"`
+	Uints      []uint64                    `json:"uints"`
+	Floats     []float64                   `json:"floats"`
+	Strings    []string                    `json:"strings"`
+	Flag       bool                        `json:"flag"`
+	ByTime     map[int64]HistoricalMetrics `json:"byTime"`
+	ByUint     map[uint32]string           `json:"byUint"`
+	Nested     map[string]map[string]int   `json:"nested"`
+	Pointer    *msgpackTestInner           `json:"pointer"`
+	NilPtr     *msgpackTestInner           `json:"nilPtr"`
+	NilMap     map[string]int              `json:"nilMap"`
+	NilSlice   []string                    `json:"nilSlice"`
+	Any        interface{}                 `json:"any"`
+	Omitted    string                      `json:"omitted,omitempty"`
+	OmitPtr    *msgpackTestInner           `json:"omitPtr,omitempty"`
+	OmitMap    map[string]int              `json:"omitMap,omitempty"`
+	OmitZero   int                         `json:"omitZero,omitempty"`
+	Kept       int                         `json:"kept,omitempty"`
+	Skipped    string                      `json:"-"`
+	Untagged   int
+	unexported int
+}
+
+func TestMsgpackMatchesReferenceDecoder(t *testing.T) {
+	bigMap := make(map[string]int)
+	longArray := make([]string, 70000)
+	for i := 0; i < 20; i++ {
+		bigMap[strings.Repeat("k", i+1)] = i
+	}
+
+	value := msgpackTestValue{
+		Ints: []int64{0, 1, 127, 128, 255, 256, 65535, 65536, math.MaxInt32, math.MaxInt32 + 1, math.MaxInt64,
+			-1, -32, -33, -128, -129, -32768, -32769, math.MinInt32, math.MinInt32 - 1, math.MinInt64},
+		Uints:   []uint64{0, 0x7f, 0x80, math.MaxUint8, math.MaxUint16, math.MaxUint32, math.MaxUint32 + 1},
+		Floats:  []float64{0, -0.5, 1e-300, math.MaxFloat64, 3.14},
+		Strings: []string{"", "ascii", "Москва", strings.Repeat("x", 31), strings.Repeat("x", 32), strings.Repeat("y", 256), strings.Repeat("z", 70000)},
+		Flag:    true,
+		ByTime: map[int64]HistoricalMetrics{
+			1700000000: {ActiveUsers: 10, Sales: 3},
+			-3600:      {ActiveUsers: 1},
+			0:          {},
+		},
+		ByUint:  map[uint32]string{7: "seven", math.MaxUint32: "max"},
+		Nested:  map[string]map[string]int{"a": {"b": 1}, "empty": {}, "nil": nil},
+		Pointer: &msgpackTestInner{Name: "inner", Value: 2.5},
+		Any:     []interface{}{1, "two", nil, map[string]interface{}{"three": 3.0}, bigMap},
+		Kept:    -7,
+		Skipped: "not encoded",
+	}
+
+	w := &msgpackWriter{}
+	if err := w.Write(value); err != nil {
+		t.Fatal(err)
+	}
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := decodeMsgpackReference(t, w.Bytes())
+	want := decodeJSONReference(t, jsonData)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("msgpack and JSON encodings differ:\nmsgpack: %v\njson:    %v", got, want)
+	}
+
+	fields := got.(map[string]interface{})
+	for _, name := range []string{"omitted", "omitPtr", "omitMap", "omitZero", "Skipped", "unexported"} {
+		if _, ok := fields[name]; ok {
+			t.Errorf("field %s must be omitted", name)
+		}
+	}
+	for _, name := range []string{"nilPtr", "nilMap", "nilSlice", "any"} {
+		if v, ok := fields[name]; !ok || (name != "any" && v != nil) {
+			t.Errorf("field %s must be encoded as nil, got %v", name, v)
+		}
+	}
+	if _, ok := fields["byTime"].(map[string]interface{})["1700000000"]; !ok {
+		t.Error("int64 map keys must be encoded as decimal strings")
+	}
+
+	// Массивы и карты длиннее 16 и 65535 элементов
+	w = &msgpackWriter{}
+	if err := w.Write(map[string]interface{}{"array": longArray, "map": bigMap}); err != nil {
+		t.Fatal(err)
+	}
+	decoded := decodeMsgpackReference(t, w.Bytes()).(map[string]interface{})
+	if len(decoded["array"].([]interface{})) != len(longArray) || len(decoded["map"].(map[string]interface{})) != len(bigMap) {
+		t.Fatal("long array or map lost elements")
+	}
+}
+
+// Кадры MessagePack собираются из фрагментов отдельно от JSON и должны совпадать
+// с JSON-кадрами для любых подписок, снимков и дельт
+func TestFrameMsgpackMatchesJSON(t *testing.T) {
+	ticks := benchmarkTicks(3)
+	// Удаленный ключ передается в дельте как null
+	delete(ticks[2].ErrorsByType, "Server Error")
+	ticks[1].ErrorsByType["Server Error"] = 1
+	ticks[2].LatencySketch = nil
+
+	var prev *Frame
+	for i, tick := range ticks {
+		frame, err := NewFrame(uint64(i+1), tick, prev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame.Interval = tickInterval
+		for _, topics := range append(benchmarkSubscriptions, 0, TopicKPI) {
+			for _, delta := range []bool{false, true} {
+				data, err := frame.Encode(FormatMsgpack, topics, delta)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := decodeMsgpackReference(t, data)
+				want := decodeJSONReference(t, frame.JSON(topics, delta))
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("frame %d topics %v delta %v:\nmsgpack: %v\njson:    %v", i+1, topics.Names(), delta, got, want)
+				}
+			}
+		}
+		prev = frame
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Минимальный писатель Parquet: плоская схема, кодирование PLAIN, без сжатия, одна страница
+// данных на колонку в группе строк. Группы строк пишутся в поток по мере заполнения,
+// в памяти остаются только строки текущей группы и смещения колонок для футера
+
+const parquetMagic = "PAR1"
+
+// Физические типы Parquet
+const (
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+)
+
+// Логические типы (ConvertedType)
+const (
+	parquetNoConversion    = -1
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+)
+
+// Кодирования
+const (
+	parquetPlain = 0
+	parquetRLE   = 3
+)
+
+// Колонка файла и ее значения в текущей группе строк
+type parquetColumn struct {
+	name      string
+	kind      int32
+	optional  bool
+	converted int32
+
+	count  int64  // Значений в группе, включая null
+	levels []bool // Уровни определения для необязательной колонки: false - null
+	values []byte // Значения без null в кодировании PLAIN
+}
+
+func newParquetColumn(name string, kind int32, optional bool, converted int32) *parquetColumn {
+	return &parquetColumn{name: name, kind: kind, optional: optional, converted: converted}
+}
+
+func (c *parquetColumn) define() {
+	c.count++
+	if c.optional {
+		c.levels = append(c.levels, true)
+	}
+}
+
+func (c *parquetColumn) AppendNull() {
+	c.count++
+	c.levels = append(c.levels, false)
+}
+
+func (c *parquetColumn) AppendInt64(v int64) {
+	c.define()
+	c.values = appendLittleEndian64(c.values, uint64(v))
+}
+
+func (c *parquetColumn) AppendDouble(v float64) {
+	c.define()
+	c.values = appendLittleEndian64(c.values, math.Float64bits(v))
+}
+
+func (c *parquetColumn) AppendString(v string) {
+	c.define()
+	c.values = appendLittleEndian32(c.values, uint32(len(v)))
+	c.values = append(c.values, v...)
+}
+
+// Тело страницы данных: уровни определения (RLE с префиксом длины) и значения.
+// Уровни повторения отсутствуют - схема плоская
+func (c *parquetColumn) page() []byte {
+	if !c.optional {
+		return c.values
+	}
+	levels := appendLevels(nil, c.levels)
+	page := make([]byte, 0, 4+len(levels)+len(c.values))
+	page = appendLittleEndian32(page, uint32(len(levels)))
+	page = append(page, levels...)
+	return append(page, c.values...)
+}
+
+func (c *parquetColumn) reset() {
+	c.count = 0
+	c.levels = c.levels[:0]
+	c.values = c.values[:0]
+}
+
+// Уровни определения битовой ширины 1 в гибридном кодировании RLE: серии одинаковых значений
+func appendLevels(buf []byte, levels []bool) []byte {
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		buf = appendUvarint(buf, uint64(j-i)<<1)
+		if levels[i] {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		i = j
+	}
+	return buf
+}
+
+// Записанный фрагмент колонки: смещение страницы, размер и число значений
+type parquetChunk struct {
+	offset int64
+	size   int64
+	values int64
+}
+
+type parquetRowGroup struct {
+	chunks []parquetChunk
+	rows   int64
+	size   int64
+}
+
+type parquetWriter struct {
+	w       io.Writer
+	columns []*parquetColumn
+	offset  int64
+	rows    int64 // Строк в текущей группе
+	groups  []parquetRowGroup
+}
+
+func newParquetWriter(w io.Writer, columns ...*parquetColumn) *parquetWriter {
+	return &parquetWriter{w: w, columns: columns}
+}
+
+// Завершение строки: значения всех колонок добавлены
+func (p *parquetWriter) EndRow() {
+	p.rows++
+}
+
+func (p *parquetWriter) Rows() int64 {
+	return p.rows
+}
+
+func (p *parquetWriter) write(data []byte) error {
+	n, err := p.w.Write(data)
+	p.offset += int64(n)
+	return err
+}
+
+func (p *parquetWriter) writeMagic() error {
+	if p.offset > 0 {
+		return nil
+	}
+	return p.write([]byte(parquetMagic))
+}
+
+// Запись накопленных строк группой строк
+func (p *parquetWriter) Flush() error {
+	if p.rows == 0 {
+		return nil
+	}
+	if err := p.writeMagic(); err != nil {
+		return err
+	}
+
+	group := parquetRowGroup{rows: p.rows}
+	for _, column := range p.columns {
+		page := column.page()
+
+		header := newThriftWriter()
+		header.I32(1, 0) // DATA_PAGE
+		header.I32(2, int32(len(page)))
+		header.I32(3, int32(len(page)))
+		header.BeginStruct(5)
+		header.I32(1, int32(column.count))
+		header.I32(2, parquetPlain)
+		header.I32(3, parquetRLE)
+		header.I32(4, parquetRLE)
+		header.EndStruct()
+		header.EndStruct()
+
+		chunk := parquetChunk{offset: p.offset, size: int64(len(header.buf) + len(page)), values: column.count}
+		if err := p.write(header.buf); err != nil {
+			return err
+		}
+		if err := p.write(page); err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, chunk)
+		group.size += chunk.size
+		column.reset()
+	}
+	p.groups = append(p.groups, group)
+	p.rows = 0
+	return nil
+}
+
+// Запись оставшихся строк и футера с метаданными файла
+func (p *parquetWriter) Close() error {
+	if err := p.Flush(); err != nil {
+		return err
+	}
+	if err := p.writeMagic(); err != nil {
+		return err
+	}
+
+	var total int64
+	for _, group := range p.groups {
+		total += group.rows
+	}
+
+	meta := newThriftWriter()
+	meta.I32(1, 1) // Версия формата
+	meta.BeginList(2, thriftStruct, len(p.columns)+1)
+	meta.BeginElement()
+	meta.Binary(4, "schema")
+	meta.I32(5, int32(len(p.columns)))
+	meta.EndStruct()
+	for _, column := range p.columns {
+		meta.BeginElement()
+		meta.I32(1, column.kind)
+		if column.optional {
+			meta.I32(3, 1) // OPTIONAL
+		} else {
+			meta.I32(3, 0) // REQUIRED
+		}
+		meta.Binary(4, column.name)
+		if column.converted != parquetNoConversion {
+			meta.I32(6, column.converted)
+		}
+		meta.EndStruct()
+	}
+	meta.I64(3, total)
+	meta.BeginList(4, thriftStruct, len(p.groups))
+	for _, group := range p.groups {
+		meta.BeginElement()
+		meta.BeginList(1, thriftStruct, len(group.chunks))
+		for i, chunk := range group.chunks {
+			column := p.columns[i]
+			meta.BeginElement()
+			meta.I64(2, chunk.offset)
+			meta.BeginStruct(3)
+			meta.I32(1, column.kind)
+			meta.BeginList(2, thriftI32, 2)
+			meta.ListI32(parquetPlain)
+			meta.ListI32(parquetRLE)
+			meta.BeginList(3, thriftBinary, 1)
+			meta.ListBinary(column.name)
+			meta.I32(4, 0) // UNCOMPRESSED
+			meta.I64(5, chunk.values)
+			meta.I64(6, chunk.size)
+			meta.I64(7, chunk.size)
+			meta.I64(9, chunk.offset)
+			meta.EndStruct()
+			meta.EndStruct()
+		}
+		meta.I64(2, group.size)
+		meta.I64(3, group.rows)
+		meta.EndStruct()
+	}
+	meta.Binary(6, "dashboard metrics export")
+	meta.EndStruct()
+
+	footer := appendLittleEndian32(meta.buf, uint32(len(meta.buf)))
+	footer = append(footer, parquetMagic...)
+	return p.write(footer)
+}
+
+func appendLittleEndian32(buf []byte, v uint32) []byte {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+func appendLittleEndian64(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+// Типы полей компактного протокола Thrift, которым описаны метаданные Parquet
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// Кодировщик компактного протокола Thrift. Номера полей кодируются разницей
+// с предыдущим полем той же структуры, поэтому храним стек последних номеров
+type thriftWriter struct {
+	buf  []byte
+	last []int16
+}
+
+func newThriftWriter() *thriftWriter {
+	return &thriftWriter{last: []int16{0}}
+}
+
+func (t *thriftWriter) field(id int16, kind byte) {
+	top := len(t.last) - 1
+	if delta := id - t.last[top]; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|kind)
+	} else {
+		t.buf = append(t.buf, kind)
+		t.buf = appendVarint(t.buf, int64(id))
+	}
+	t.last[top] = id
+}
+
+func (t *thriftWriter) I32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.buf = appendVarint(t.buf, int64(v))
+}
+
+func (t *thriftWriter) I64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.buf = appendVarint(t.buf, v)
+}
+
+func (t *thriftWriter) Binary(id int16, v string) {
+	t.field(id, thriftBinary)
+	t.ListBinary(v)
+}
+
+func (t *thriftWriter) BeginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.last = append(t.last, 0)
+}
+
+// Структура - элемент списка: без заголовка поля
+func (t *thriftWriter) BeginElement() {
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) EndStruct() {
+	t.buf = append(t.buf, 0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) BeginList(id int16, elem byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf = append(t.buf, byte(size)<<4|elem)
+		return
+	}
+	t.buf = append(t.buf, 0xf0|elem)
+	t.buf = appendUvarint(t.buf, uint64(size))
+}
+
+func (t *thriftWriter) ListI32(v int32) {
+	t.buf = appendVarint(t.buf, int64(v))
+}
+
+func (t *thriftWriter) ListBinary(v string) {
+	t.buf = appendUvarint(t.buf, uint64(len(v)))
+	t.buf = append(t.buf, v...)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+// Файл Parquet в памяти для стороннего читателя. Читатель открывает файл заново для каждой колонки
+type parquetTestFile struct {
+	*bytes.Reader
+	data []byte
+}
+
+func newParquetTestFile(data []byte) *parquetTestFile {
+	return &parquetTestFile{Reader: bytes.NewReader(data), data: data}
+}
+
+func (f *parquetTestFile) Open(string) (source.ParquetFile, error) {
+	return newParquetTestFile(f.data), nil
+}
+
+func (f *parquetTestFile) Create(string) (source.ParquetFile, error) {
+	return nil, errors.New("read-only file")
+}
+
+func (f *parquetTestFile) Write([]byte) (int, error) {
+	return 0, errors.New("read-only file")
+}
+
+func (f *parquetTestFile) Close() error {
+	return nil
+}
+
+// Строка выгрузки в схеме читателя
+type parquetExportRecord struct {
+	Timestamp int64    `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Metric    string   `parquet:"name=metric, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Dimension *string  `parquet:"name=dimension, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Key       *string  `parquet:"name=key, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Value     *float64 `parquet:"name=value, type=DOUBLE, repetitiontype=OPTIONAL"`
+}
+
+// Выгрузка в Parquet, прочитанная независимым читателем, совпадает с выгрузкой того же
+// запроса в NDJSON: те же строки, null в пропусках и пустых измерениях, несколько групп строк
+func TestParquetExportReadBack(t *testing.T) {
+	store := newTestTieredStore(t)
+	end := bucketStart(time.Now().Unix(), time.Hour)
+	from := end - 700*3600
+	gap := end - 100*3600
+
+	// Часы с данными и разрыв в 50 часов без них
+	record := func(start int64, seconds float64) MetricsData {
+		tick := testTick(start)
+		if start%7 == 0 {
+			tick.ErrorsByType["Timeout"] = 2 // Ключ встречается не в каждом интервале
+		}
+		return scaleCounters(tick, seconds)
+	}
+	if err := store.Backfill(time.Hour, from, gap-50*3600, record); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Backfill(time.Hour, gap, end, record); err != nil {
+		t.Fatal(err)
+	}
+
+	query := HistoryQuery{
+		Metrics:    historyMetrics,
+		Dimensions: []string{DimensionRegion, DimensionErrorType},
+		From:       from,
+		To:         end,
+		Step:       time.Hour,
+		Fill:       FillNull,
+	}
+
+	var ndjson, parquetData bytes.Buffer
+	for _, export := range []struct {
+		format string
+		w      *bytes.Buffer
+	}{{"ndjson", &ndjson}, {"parquet", &parquetData}} {
+		format, _ := findExportFormat(export.format)
+		writer := format.newWriter(export.w)
+		if err := exportHistory(store, query, writer); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var want []ExportRow
+	scanner := bufio.NewScanner(&ndjson)
+	for scanner.Scan() {
+		var row ExportRow
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, row)
+	}
+
+	pr, err := reader.NewParquetReader(newParquetTestFile(parquetData.Bytes()), new(parquetExportRecord), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+
+	footer := pr.Footer
+	if len(footer.RowGroups) < 2 {
+		t.Fatalf("expected several row groups, got %d", len(footer.RowGroups))
+	}
+	if footer.Schema[1].GetConvertedType() != parquet.ConvertedType_TIMESTAMP_MILLIS ||
+		footer.Schema[5].GetRepetitionType() != parquet.FieldRepetitionType_OPTIONAL {
+		t.Fatalf("unexpected schema: %v", footer.Schema)
+	}
+	if int(pr.GetNumRows()) != len(want) {
+		t.Fatalf("parquet has %d rows, ndjson %d", pr.GetNumRows(), len(want))
+	}
+
+	records := make([]parquetExportRecord, len(want))
+	if err := pr.Read(&records); err != nil {
+		t.Fatal(err)
+	}
+
+	nulls := 0
+	for i, record := range records {
+		got := ExportRow{Timestamp: record.Timestamp / 1000, Metric: record.Metric, Value: record.Value}
+		if record.Dimension != nil {
+			got.Dimension = *record.Dimension
+		}
+		if record.Key != nil {
+			got.Key = *record.Key
+		}
+		if record.Timestamp%1000 != 0 || (record.Dimension == nil) != (record.Key == nil) {
+			t.Fatalf("row %d: %+v", i, record)
+		}
+		if record.Value == nil {
+			nulls++
+		}
+
+		expected := want[i]
+		expected.Time = ""
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("row %d: parquet %+v, ndjson %+v", i, got, expected)
+		}
+	}
+	if nulls == 0 {
+		t.Fatal("gap hours must be exported as null values")
+	}
+}
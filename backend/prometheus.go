@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Время запуска процесса для uptime и process_start_time_seconds
+var processStart = time.Now()
+
+// Границы гистограммы длительности тика рассылки, секунды
+var broadcastDurationBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Статистика тиков рассылки
+type BroadcastStats struct {
+	Ticks          uint64  `json:"ticks"`
+	TickLagMs      float64 `json:"tickLagMs"`      // Задержка начала последнего тика относительно расписания
+	LastDurationMs float64 `json:"lastDurationMs"` // Длительность последнего тика: генерация, запись в историю, рассылка
+}
+
+// Внутренние метрики сервера и накопленные с запуска счетчики по тикам источника
+type serverMetrics struct {
+	mu           sync.Mutex
+	ticks        uint64
+	tickLag      time.Duration
+	lastDuration time.Duration
+	durations    promHistogram
+
+	requests    float64
+	sales       float64
+	errors      map[string]float64
+	regionSales map[string]float64
+}
+
+var serverStats = &serverMetrics{
+	durations:   promHistogram{buckets: broadcastDurationBuckets, counts: make([]uint64, len(broadcastDurationBuckets))},
+	errors:      make(map[string]float64),
+	regionSales: make(map[string]float64),
+}
+
+// Учет тика рассылки: lag - задержка начала тика, duration - время его обработки
+func (s *serverMetrics) ObserveTick(metrics MetricsData, lag, duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ticks++
+	s.tickLag = lag
+	s.lastDuration = duration
+	s.durations.Observe(duration.Seconds())
+
+	s.requests += metrics.RequestsPerSecond * tickInterval.Seconds()
+	s.sales += float64(metrics.Sales)
+	for errorType, count := range metrics.ErrorsByType {
+		s.errors[errorType] += float64(count)
+	}
+	for region, data := range metrics.RegionalData {
+		s.regionSales[region] += float64(data.Sales)
+	}
+}
+
+func (s *serverMetrics) Stats() BroadcastStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return BroadcastStats{
+		Ticks:          s.ticks,
+		TickLagMs:      float64(s.tickLag) / float64(time.Millisecond),
+		LastDurationMs: float64(s.lastDuration) / float64(time.Millisecond),
+	}
+}
+
+// Гистограмма в формате Prometheus: счетчики по верхним границам, сумма и число наблюдений
+type promHistogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *promHistogram) Observe(value float64) {
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Построитель текстового формата экспозиции Prometheus 0.0.4
+type promWriter struct {
+	buf strings.Builder
+}
+
+var promHelpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// Заголовок семейства метрик
+func (p *promWriter) Family(name, kind, help string) {
+	p.buf.WriteString("# HELP " + name + " " + promHelpEscaper.Replace(help) + "\n")
+	p.buf.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// Значение с метками, labels - пары имя, значение
+func (p *promWriter) Sample(name string, value float64, labels ...string) {
+	p.buf.WriteString(name)
+	if len(labels) > 0 {
+		p.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.buf.WriteByte(',')
+			}
+			p.buf.WriteString(labels[i] + `="` + promLabelEscaper.Replace(labels[i+1]) + `"`)
+		}
+		p.buf.WriteByte('}')
+	}
+	p.buf.WriteByte(' ')
+	p.buf.WriteString(formatPromValue(value))
+	p.buf.WriteByte('\n')
+}
+
+// Семейство из одного значения без меток
+func (p *promWriter) Single(name, kind, help string, value float64) {
+	p.Family(name, kind, help)
+	p.Sample(name, value)
+}
+
+// Семейство со значением на каждый ключ карты, ключ становится меткой label
+func (p *promWriter) ByLabel(name, kind, help, label string, values map[string]float64) {
+	p.Family(name, kind, help)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		p.Sample(name, values[key], label, key)
+	}
+}
+
+func (p *promWriter) Histogram(name, help string, h *promHistogram) {
+	p.Family(name, "histogram", help)
+	for i, bound := range h.buckets {
+		p.Sample(name+"_bucket", float64(h.counts[i]), "le", formatPromValue(bound))
+	}
+	p.Sample(name+"_bucket", float64(h.count), "le", "+Inf")
+	p.Sample(name+"_sum", h.sum)
+	p.Sample(name+"_count", float64(h.count))
+}
+
+func formatPromValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Текущие метрики источника: значения последнего тика - gauge, суммы по тикам с запуска - counter.
+// Проценты переводятся в доли, миллисекунды - в секунды, как принято в Prometheus
+func writeDashboardMetrics(p *promWriter, metrics MetricsData) {
+	p.Single("dashboard_active_users", "gauge", "Active users.", float64(metrics.ActiveUsers))
+	p.Single("dashboard_requests_per_second", "gauge", "Requests per second in the last tick.", metrics.RequestsPerSecond)
+	p.Single("dashboard_response_time_seconds", "gauge", "Mean response time in the last tick.", metrics.ResponseTimeMs/1000)
+
+	p.Family("dashboard_response_time_quantile_seconds", "gauge", "Response time percentiles in the last tick.")
+	for _, q := range []struct {
+		quantile string
+		ms       float64
+	}{
+		{"0.5", metrics.Latency.P50},
+		{"0.9", metrics.Latency.P90},
+		{"0.95", metrics.Latency.P95},
+		{"0.99", metrics.Latency.P99},
+	} {
+		p.Sample("dashboard_response_time_quantile_seconds", q.ms/1000, "quantile", q.quantile)
+	}
+
+	p.Single("dashboard_conversion_ratio", "gauge", "Conversion rate.", metrics.ConversionRate/100)
+	p.Single("dashboard_error_ratio", "gauge", "Share of failed requests in the last tick.", metrics.ErrorRate/100)
+	p.Single("dashboard_server_load_ratio", "gauge", "Server load.", metrics.ServerLoad/100)
+	p.Single("dashboard_database_connections", "gauge", "Open database connections.", float64(metrics.DatabaseConnections))
+
+	regionUsers := make(map[string]float64, len(metrics.RegionalData))
+	regionConversion := make(map[string]float64, len(metrics.RegionalData))
+	for region, data := range metrics.RegionalData {
+		regionUsers[region] = float64(data.ActiveUsers)
+		regionConversion[region] = data.ConversionRate / 100
+	}
+	p.ByLabel("dashboard_region_active_users", "gauge", "Active users by region.", "region", regionUsers)
+	p.ByLabel("dashboard_region_conversion_ratio", "gauge", "Conversion rate by region.", "region", regionConversion)
+
+	sources := make(map[string]float64, len(metrics.SourcesData))
+	for source, users := range metrics.SourcesData {
+		sources[source] = float64(users)
+	}
+	p.ByLabel("dashboard_source_active_users", "gauge", "Active users by traffic source.", "source", sources)
+
+	funnel := metrics.ConversionFunnel
+	p.ByLabel("dashboard_funnel_users", "gauge", "Users at each conversion funnel stage.", "stage", map[string]float64{
+		"visitors":       float64(funnel.Visitors),
+		"productViews":   float64(funnel.ProductViews),
+		"addedToCart":    float64(funnel.AddedToCart),
+		"beganCheckout":  float64(funnel.BeganCheckout),
+		"purchasedItems": float64(funnel.PurchasedItems),
+	})
+}
+
+func (s *serverMetrics) write(p *promWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p.Single("dashboard_requests_total", "counter", "Requests served since process start.", s.requests)
+	p.Single("dashboard_sales_total", "counter", "Sales since process start.", s.sales)
+	p.ByLabel("dashboard_errors_total", "counter", "Errors by type since process start.", "type", s.errors)
+	p.ByLabel("dashboard_region_sales_total", "counter", "Sales by region since process start.", "region", s.regionSales)
+
+	p.Single("dashboard_ticks_total", "counter", "Broadcast ticks since process start.", float64(s.ticks))
+	p.Single("dashboard_tick_lag_seconds", "gauge", "Delay of the last generator tick behind its schedule.", s.tickLag.Seconds())
+	p.Histogram("dashboard_broadcast_duration_seconds", "Time to generate, store and publish one tick.", &s.durations)
+}
+
+func writeServerMetrics(p *promWriter) {
+	p.Single("process_start_time_seconds", "gauge", "Start time of the process since unix epoch in seconds.", float64(processStart.UnixNano())/1e9)
+
+	stats := hub.Stats()
+	p.Single("dashboard_connected_clients", "gauge", "Connected WebSocket and SSE clients.", float64(stats.Clients))
+	p.Single("dashboard_frames_sent_total", "counter", "Frames written to WebSocket and SSE clients.", float64(stats.FramesSent))
+	p.Single("dashboard_frames_dropped_total", "counter", "Frames dropped for slow clients.", float64(stats.FramesDropped))
+	p.Single("dashboard_slow_client_disconnects_total", "counter", "Clients disconnected for a full send queue.", float64(stats.SlowDisconnects))
+	p.ByLabel("dashboard_reaped_connections_total", "counter", "Connections closed by the server.", "reason", map[string]float64{
+		"idle":     float64(stats.ReapedIdle),
+		"lifetime": float64(stats.ReapedLifetime),
+	})
+
+	var redisStats RedisPublisherStats
+	if redisPub != nil {
+		redisStats = redisPub.Stats()
+	}
+	p.Single("dashboard_redis_publish_errors_total", "counter", "Failed publishes of frames to Redis.", float64(redisStats.PublishErrors))
+	p.Single("dashboard_redis_publish_dropped_total", "counter", "Frames dropped for a full Redis publish queue.", float64(redisStats.Dropped))
+
+	serverStats.write(p)
+}
+
+// Защита /metrics. С ключами сборщик передает ключ; без ключей эндпоинт открыт, только если
+// авторизация дашборда выключена или открытый доступ разрешен явно. nil - эндпоинт открыт
+func prometheusAuth(keys []string, oidcEnabled, allowUnauthenticated bool) (gin.HandlerFunc, error) {
+	if len(keys) > 0 {
+		return APIKeyMiddleware(keys), nil
+	}
+	if oidcEnabled && !allowUnauthenticated {
+		return nil, errors.New("OIDC is enabled but PROMETHEUS_API_KEYS is empty, set scrape keys or PROMETHEUS_ALLOW_UNAUTHENTICATED=true")
+	}
+	return nil, nil
+}
+
+// Обработчик /metrics для сбора Prometheus
+func handlePrometheusMetrics(c *gin.Context) {
+	p := &promWriter{}
+	writeDashboardMetrics(p, metricsSource.Current())
+	writeServerMetrics(p)
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(p.buf.String()))
+}
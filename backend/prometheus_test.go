@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPrometheusAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cases := []struct {
+		name                   string
+		keys                   []string
+		oidc, allow            bool
+		refused                bool
+		statusNoKey, statusKey int
+	}{
+		{name: "open without OIDC", statusNoKey: http.StatusOK, statusKey: http.StatusOK},
+		{name: "keys without OIDC", keys: []string{"scrape"}, statusNoKey: http.StatusUnauthorized, statusKey: http.StatusOK},
+		{name: "keys with OIDC", keys: []string{"scrape"}, oidc: true, statusNoKey: http.StatusUnauthorized, statusKey: http.StatusOK},
+		{name: "OIDC without keys", oidc: true, refused: true},
+		{name: "OIDC with explicit opt-out", oidc: true, allow: true, statusNoKey: http.StatusOK, statusKey: http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			auth, err := prometheusAuth(c.keys, c.oidc, c.allow)
+			if c.refused {
+				if err == nil {
+					t.Fatal("unauthenticated /metrics must be refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := gin.New()
+			handlers := []gin.HandlerFunc{func(c *gin.Context) { c.String(http.StatusOK, "ok") }}
+			if auth != nil {
+				handlers = append([]gin.HandlerFunc{auth}, handlers...)
+			}
+			r.GET("/metrics", handlers...)
+
+			for _, key := range []string{"", "scrape"} {
+				req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+				want := c.statusNoKey
+				if key != "" {
+					req.Header.Set("Authorization", "Bearer "+key)
+					want = c.statusKey
+				}
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				if w.Code != want {
+					t.Fatalf("key %q: status %d, want %d", key, w.Code, want)
+				}
+			}
+		})
+	}
+}
+
+// Формат экспозиции: HELP и TYPE перед значениями, экранирование меток и справки,
+// накопительные границы гистограммы с +Inf
+func TestPromWriterExposition(t *testing.T) {
+	p := &promWriter{}
+	p.Single("test_ticks_total", "counter", "Ticks.", 3)
+	p.ByLabel("test_errors_total", "counter", "Errors by type,\nwith \\ in help.", "type", map[string]float64{
+		`quote "q"`:    1,
+		`back\slash`:   2,
+		"new\nline":    0.5,
+		"Server Error": math.Inf(1),
+	})
+	h := promHistogram{buckets: []float64{0.1, 1}, counts: make([]uint64, 2)}
+	for _, value := range []float64{0.05, 0.5, 0.5, 5} {
+		h.Observe(value)
+	}
+	p.Histogram("test_duration_seconds", "Durations.", &h)
+
+	expected := `# HELP test_ticks_total Ticks.
+# TYPE test_ticks_total counter
+test_ticks_total 3
+# HELP test_errors_total Errors by type,\nwith \\ in help.
+# TYPE test_errors_total counter
+test_errors_total{type="Server Error"} +Inf
+test_errors_total{type="back\\slash"} 2
+test_errors_total{type="new\nline"} 0.5
+test_errors_total{type="quote \"q\""} 1
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 3
+test_duration_seconds_bucket{le="+Inf"} 4
+test_duration_seconds_sum 6.05
+test_duration_seconds_count 4
+`
+	if got := p.buf.String(); got != expected {
+		t.Fatalf("exposition:\n%s\nwant:\n%s", got, expected)
+	}
+}
+
+// Разбор строки значения: имя, метки и значение. Экранированные символы в метках раскрываются
+func parsePromSample(line string) (string, map[string]string, error) {
+	name := line
+	labels := make(map[string]string)
+	if i := strings.IndexAny(line, "{ "); i >= 0 {
+		name = line[:i]
+		line = line[i:]
+	}
+	if strings.HasPrefix(line, "{") {
+		line = line[1:]
+		for !strings.HasPrefix(line, "}") {
+			eq := strings.Index(line, `="`)
+			if eq <= 0 {
+				return "", nil, fmt.Errorf("malformed label in %q", line)
+			}
+			label := line[:eq]
+			line = line[eq+2:]
+			var value strings.Builder
+			for {
+				if line == "" {
+					return "", nil, fmt.Errorf("unterminated label %s", label)
+				}
+				c := line[0]
+				line = line[1:]
+				if c == '"' {
+					break
+				}
+				if c == '\\' {
+					if line == "" {
+						return "", nil, fmt.Errorf("dangling escape in label %s", label)
+					}
+					switch line[0] {
+					case 'n':
+						value.WriteByte('\n')
+					case '\\', '"':
+						value.WriteByte(line[0])
+					default:
+						return "", nil, fmt.Errorf("invalid escape \\%c in label %s", line[0], label)
+					}
+					line = line[1:]
+					continue
+				}
+				value.WriteByte(c)
+			}
+			labels[label] = value.String()
+			line = strings.TrimPrefix(line, ",")
+		}
+		line = line[1:]
+	}
+	if !strings.HasPrefix(line, " ") {
+		return "", nil, fmt.Errorf("no value after %s", name)
+	}
+	if _, err := strconv.ParseFloat(strings.TrimPrefix(line[1:], "+"), 64); err != nil {
+		return "", nil, fmt.Errorf("invalid value %q of %s", line[1:], name)
+	}
+	return name, labels, nil
+}
+
+// Полный вывод /metrics разбирается как текстовый формат: у каждого значения есть TYPE его семейства,
+// семейства не повторяются, у гистограммы есть бакет +Inf, метки с кавычками и переводами строк экранированы
+func TestPrometheusExpositionFormat(t *testing.T) {
+	metrics := testTick(time.Now().Unix())
+	metrics.RegionalData[`Регион "Север"`] = Region{ActiveUsers: 1, Sales: 1}
+	metrics.ErrorsByType["line\nbreak"] = 1
+	stats := &serverMetrics{
+		durations:   promHistogram{buckets: broadcastDurationBuckets, counts: make([]uint64, len(broadcastDurationBuckets))},
+		errors:      make(map[string]float64),
+		regionSales: make(map[string]float64),
+	}
+	stats.ObserveTick(metrics, time.Millisecond, 3*time.Millisecond)
+
+	p := &promWriter{}
+	writeDashboardMetrics(p, metrics)
+	stats.write(p)
+
+	types := make(map[string]string)
+	family := ""
+	regions := make(map[string]bool)
+	errorTypes := make(map[string]bool)
+	var bounds []string
+	for _, line := range strings.Split(strings.TrimSuffix(p.buf.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			if len(fields) != 4 {
+				t.Fatalf("malformed TYPE line %q", line)
+			}
+			if _, ok := types[fields[2]]; ok {
+				t.Fatalf("family %s is declared twice", fields[2])
+			}
+			family = fields[2]
+			types[family] = fields[3]
+			continue
+		}
+
+		name, labels, err := parsePromSample(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		base := name
+		if types[family] == "histogram" {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				base = strings.TrimSuffix(base, suffix)
+			}
+		}
+		if base != family {
+			t.Fatalf("sample %s outside its family, last TYPE is %s", name, family)
+		}
+		switch name {
+		case "dashboard_region_sales_total":
+			regions[labels["region"]] = true
+		case "dashboard_errors_total":
+			errorTypes[labels["type"]] = true
+		case "dashboard_broadcast_duration_seconds_bucket":
+			bounds = append(bounds, labels["le"])
+		}
+	}
+
+	if types["dashboard_broadcast_duration_seconds"] != "histogram" || types["dashboard_sales_total"] != "counter" || types["dashboard_active_users"] != "gauge" {
+		t.Fatalf("unexpected family types %v", types)
+	}
+	if len(bounds) != len(broadcastDurationBuckets)+1 || bounds[len(bounds)-1] != "+Inf" {
+		t.Fatalf("histogram buckets %v", bounds)
+	}
+	if !regions[`Регион "Север"`] || !errorTypes["line\nbreak"] {
+		t.Fatalf("escaped labels are not preserved: regions %v, errors %v", regions, errorTypes)
+	}
+}
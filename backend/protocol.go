@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Подпротоколы WebSocket, определяющие формат кадров
+const (
+	SubprotocolJSON    = "dashboard.json.v1"
+	SubprotocolMsgpack = "dashboard.msgpack.v1"
+
+	// Префикс элемента Sec-WebSocket-Protocol, в котором браузерный клиент передает JWT
+	bearerSubprotocolPrefix = "bearer."
+)
+
+// Результат согласования подпротокола
+type NegotiatedProtocol struct {
+	Subprotocol string // Выбранный подпротокол для ответа сервера, пустой - без подпротокола
+	Format      WireFormat
+	Token       string
+}
+
+// Согласование подпротокола. Клиент перечисляет форматы в порядке предпочтения
+// и может добавить элемент bearer.<jwt>, например:
+//
+//	Sec-WebSocket-Protocol: dashboard.msgpack.v1, dashboard.json.v1, bearer.eyJhbGciOi...
+//
+// Токен никогда не возвращается клиенту в ответе. Для совместимости со старыми клиентами
+// заголовок без известных элементов целиком считается токеном
+func negotiateSubprotocol(r *http.Request) NegotiatedProtocol {
+	result := NegotiatedProtocol{Format: FormatJSON}
+
+	offered := websocket.Subprotocols(r)
+	recognized := false
+	for _, protocol := range offered {
+		switch {
+		case strings.HasPrefix(protocol, bearerSubprotocolPrefix):
+			result.Token = strings.TrimPrefix(protocol, bearerSubprotocolPrefix)
+			recognized = true
+		case protocol == SubprotocolJSON && result.Subprotocol == "":
+			result.Subprotocol = protocol
+			recognized = true
+		case protocol == SubprotocolMsgpack && result.Subprotocol == "":
+			result.Subprotocol = protocol
+			result.Format = FormatMsgpack
+			recognized = true
+		}
+	}
+
+	if !recognized {
+		result.Token = r.Header.Get("Sec-WebSocket-Protocol")
+	}
+
+	return result
+}
+
+// Управляющее сообщение от клиента по /ws:
+//
+//	{"action": "subscribe", "topics": ["kpi", "regional", "historical:hourly"]}
+//	{"action": "unsubscribe", "topics": ["historical"]}
+//	{"action": "snapshot"}
+//	{"action": "interval", "interval": 15}
+type ControlMessage struct {
+	Action   string   `json:"action"`
+	Topics   []string `json:"topics"`
+	Interval int64    `json:"interval,omitempty"` // Интервал тиков в секундах
+}
+
+// Ответ сервера на управляющее сообщение
+type ControlReply struct {
+	Type     string   `json:"type"` // subscribed или error
+	Topics   []string `json:"topics,omitempty"`
+	Interval int64    `json:"interval,omitempty"` // Текущий интервал тиков в секундах
+	Error    string   `json:"error,omitempty"`
+}
+
+// Начальная подписка клиента из параметра ?topics=kpi,regional.
+// Без параметра клиент получает все секции, как и раньше
+func initialTopics(query string) (Topic, error) {
+	if query == "" {
+		return AllTopics, nil
+	}
+	return ParseTopics(strings.Split(query, ","))
+}
+
+// Режим кадров из параметра ?mode=full|delta
+func parseFrameMode(query string) (bool, error) {
+	switch query {
+	case "", "full":
+		return false, nil
+	case "delta":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown mode: %q, valid modes: full, delta", query)
+	}
+}
+
+// Интервал тиков из параметра ?interval=5s (или ?interval=5 в секундах).
+// Без параметра клиент получает каждый тик
+func parseInterval(query string) (time.Duration, error) {
+	if query == "" {
+		return tickInterval, nil
+	}
+
+	interval, err := time.ParseDuration(query)
+	if err != nil {
+		seconds, convErr := strconv.ParseInt(query, 10, 64)
+		if convErr != nil {
+			return 0, fmt.Errorf("invalid interval: %q", query)
+		}
+		interval = time.Duration(seconds) * time.Second
+	}
+
+	if hub.streamFor(interval) == nil {
+		return 0, fmt.Errorf("unsupported interval: %q, valid intervals: %s", query, strings.Join(validIntervalNames(), ", "))
+	}
+	return interval, nil
+}
+
+// Список поддерживаемых интервалов для сообщений об ошибках
+func validIntervalNames() []string {
+	intervals := hub.Intervals()
+	names := make([]string, len(intervals))
+	for i, interval := range intervals {
+		names[i] = fmt.Sprintf("%ds", interval/time.Second)
+	}
+	return names
+}
+
+// Позиция клиента в потоке: эпоха нумерации, интервал потока и номер последнего полученного кадра.
+// У каждого интервала своя нумерация кадров, а после перезапуска сервера нумерация начинается
+// заново, поэтому номер без интервала и эпохи не указывает на кадр
+type StreamPosition struct {
+	Epoch    string
+	Interval time.Duration
+	Seq      uint64
+}
+
+// Идентификатор вида <эпоха>:<интервал в секундах>:<seq>, например 3f9a1c2e:5:42.
+// Используется как id события SSE и значение ?since=
+func (p StreamPosition) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.Epoch, p.Interval/time.Second, p.Seq)
+}
+
+// Разбор ?since= и Last-Event-ID. Позиции старых клиентов без эпохи (<интервал>:<seq>)
+// или без интервала принимаются, но не относятся ни к одному потоку, и такой клиент
+// получает полный снимок
+func parseStreamPosition(value string) (StreamPosition, error) {
+	var position StreamPosition
+	invalid := fmt.Errorf("invalid stream position: %q", value)
+
+	parts := strings.Split(value, ":")
+	if len(parts) > 3 || (len(parts) == 3 && parts[0] == "") {
+		return position, invalid
+	}
+	if len(parts) == 3 {
+		position.Epoch = parts[0]
+	}
+	if len(parts) >= 2 {
+		seconds, err := strconv.ParseInt(parts[len(parts)-2], 10, 64)
+		if err != nil || seconds <= 0 {
+			return position, invalid
+		}
+		position.Interval = time.Duration(seconds) * time.Second
+	}
+
+	n, err := strconv.ParseUint(parts[len(parts)-1], 10, 64)
+	if err != nil {
+		return position, invalid
+	}
+	position.Seq = n
+	return position, nil
+}
+
+// Обработка управляющего сообщения клиента
+func handleControlMessage(client *Client, data []byte) {
+	var msg ControlMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		client.Reply(ControlReply{Type: "error", Error: "invalid message: " + err.Error()})
+		return
+	}
+
+	topics, err := ParseTopics(msg.Topics)
+	if err != nil {
+		client.Reply(ControlReply{
+			Type:  "error",
+			Error: fmt.Sprintf("%v, valid topics: %s", err, strings.Join(validTopicNames(), ", ")),
+		})
+		return
+	}
+
+	switch msg.Action {
+	case "subscribe":
+		client.SetTopics(client.Topics() | topics)
+	case "unsubscribe":
+		client.SetTopics(client.Topics() &^ topics)
+	case "snapshot":
+		// В полном режиме каждый кадр и так снимок, запрос без ответа выглядел бы потерянным
+		if !client.delta {
+			client.Reply(ControlReply{Type: "error", Error: "snapshot action requires ?mode=delta"})
+			return
+		}
+		// Снимок сам служит ответом
+		client.RequestSnapshot()
+		return
+	case "interval":
+		if err := client.SetInterval(time.Duration(msg.Interval) * time.Second); err != nil {
+			client.Reply(ControlReply{
+				Type:  "error",
+				Error: fmt.Sprintf("%v, valid intervals: %s", err, strings.Join(validIntervalNames(), ", ")),
+			})
+			return
+		}
+	default:
+		client.Reply(ControlReply{Type: "error", Error: fmt.Sprintf("unknown action: %q", msg.Action)})
+		return
+	}
+
+	client.Reply(ControlReply{
+		Type:     "subscribed",
+		Topics:   client.Topics().Names(),
+		Interval: int64(client.Interval() / time.Second),
+	})
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Соответствие серий Prometheus метрикам приема по умолчанию. Гистограммы времени ответа
+// в Prometheus в секундах, поэтому значения умножаются на 1000
+const defaultRemoteWriteMapping = "orders_total=sales,http_request_duration_seconds=responseTime*1000,errors_total=errors,active_users=activeUsers"
+
+// Соответствие меток Prometheus полям выборки по умолчанию. instance отличает последние значения разных целей сбора
+const defaultRemoteWriteLabels = "region=region,source=source,type=errorType,instance=service"
+
+// Максимальный размер тела после распаковки snappy
+const remoteWriteMaxDecodedBytes = 32 << 20
+
+// Сколько хранится последнее значение серии-счетчика, которая перестала приходить
+const remoteWriteSeriesTTL = 10 * time.Minute
+
+// Метка серии Prometheus
+type promLabel struct {
+	name, value string
+}
+
+type promSample struct {
+	value     float64
+	timestamp int64 // мс
+}
+
+// Серия из WriteRequest протокола remote_write 1.0
+type promSeries struct {
+	labels  []promLabel
+	samples []promSample
+}
+
+func (s promSeries) label(name string) string {
+	for _, label := range s.labels {
+		if label.name == name {
+			return label.value
+		}
+	}
+	return ""
+}
+
+// Обход полей сообщения protobuf. Для полей bytes передается содержимое, для varint и fixed64 - значение
+func protoFields(data []byte, visit func(num protowire.Number, typ protowire.Type, b []byte, v uint64) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		var b []byte
+		var v uint64
+		switch typ {
+		case protowire.BytesType:
+			b, n = protowire.ConsumeBytes(data)
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if err := visit(num, typ, b, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Разбор WriteRequest: timeseries = 1. Метаданные, экземпляры и нативные гистограммы пропускаются
+func decodeWriteRequest(data []byte) ([]promSeries, error) {
+	var series []promSeries
+	err := protoFields(data, func(num protowire.Number, typ protowire.Type, b []byte, _ uint64) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		s, err := decodeTimeSeries(b)
+		if err != nil {
+			return err
+		}
+		series = append(series, s)
+		return nil
+	})
+	return series, err
+}
+
+// TimeSeries: labels = 1, samples = 2
+func decodeTimeSeries(data []byte) (promSeries, error) {
+	var series promSeries
+	err := protoFields(data, func(num protowire.Number, typ protowire.Type, b []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			var label promLabel
+			err := protoFields(b, func(num protowire.Number, typ protowire.Type, b []byte, _ uint64) error {
+				if typ == protowire.BytesType && num == 1 {
+					label.name = string(b)
+				} else if typ == protowire.BytesType && num == 2 {
+					label.value = string(b)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			series.labels = append(series.labels, label)
+		case 2:
+			var sample promSample
+			err := protoFields(b, func(num protowire.Number, typ protowire.Type, _ []byte, v uint64) error {
+				if typ == protowire.Fixed64Type && num == 1 {
+					sample.value = math.Float64frombits(v)
+				} else if typ == protowire.VarintType && num == 2 {
+					sample.timestamp = int64(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			series.samples = append(series.samples, sample)
+		}
+		return nil
+	})
+	return series, err
+}
+
+// Цель соответствия серии: метрика приема и множитель значений
+type remoteWriteTarget struct {
+	metric string
+	scale  float64
+}
+
+// Разбор соответствия вида series=metric[*scale],...
+func parseRemoteWriteMapping(spec string) (map[string]remoteWriteTarget, error) {
+	targets := make(map[string]remoteWriteTarget)
+	for _, item := range splitList(spec) {
+		target := remoteWriteTarget{scale: 1}
+		if i := strings.IndexByte(item, '*'); i >= 0 {
+			scale, err := strconv.ParseFloat(item[i+1:], 64)
+			if err != nil || scale <= 0 {
+				return nil, fmt.Errorf("invalid scale in mapping %q", item)
+			}
+			target.scale = scale
+			item = item[:i]
+		}
+		mapping, err := parseNameMapping(item, ingestMetricNames())
+		if err != nil {
+			return nil, err
+		}
+		for name, metric := range mapping {
+			target.metric = metric
+			targets[name] = target
+		}
+	}
+	return targets, nil
+}
+
+// Последнее значение серии-счетчика для вычисления прироста
+type remoteWriteCounter struct {
+	value float64
+	seen  time.Time
+}
+
+// Приросты гистограммы или summary времени ответа, накопленные до ближайшего тика. Серии одной
+// гистограммы Prometheus может прислать в разных запросах, поэтому корзины сводятся только на тике
+type remoteWriteLatency struct {
+	service    string
+	scale      float64
+	buckets    map[float64]float64 // Прирост накопительных корзин по верхней границе le
+	sum, count float64
+}
+
+// Источник метрик из Prometheus remote_write. Счетчики переводятся в приросты между отправками,
+// последние значения gauge учитываются как есть, гистограммы времени ответа дают RPS, среднее и перцентили.
+// Выборки сворачиваются в тики тем же агрегатором, что и POST /api/ingest
+type RemoteWriteSource struct {
+	*IngestAggregator
+	metrics map[string]remoteWriteTarget // Имя серии -> метрика приема
+	labels  map[string]string            // Метка Prometheus -> поле выборки
+
+	mu        sync.Mutex
+	counters  map[string]*remoteWriteCounter
+	latency   map[string]*remoteWriteLatency
+	lastPrune time.Time
+}
+
+func NewRemoteWriteSource(store *TieredStore, metricMapping, labelMapping string, config IngestConfig) (*RemoteWriteSource, error) {
+	metrics, err := parseRemoteWriteMapping(metricMapping)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := parseNameMapping(labelMapping, ingestLabelFields)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteWriteSource{
+		IngestAggregator: NewIngestAggregator(store, config),
+		metrics:          metrics,
+		labels:           labels,
+		counters:         make(map[string]*remoteWriteCounter),
+		latency:          make(map[string]*remoteWriteLatency),
+	}, nil
+}
+
+func (s *RemoteWriteSource) Name() string {
+	return "remote_write"
+}
+
+// Итог приема запроса
+type RemoteWriteResult struct {
+	Accepted int    `json:"accepted"`
+	Rejected int    `json:"rejected"`
+	Unmapped int    `json:"unmapped"` // Серии без соответствия
+	Error    string `json:"error,omitempty"`
+}
+
+// Прием серий запроса. Выборки проверяются по одной: отклоненная выборка не мешает остальным
+func (s *RemoteWriteSource) Receive(series []promSeries, now time.Time) RemoteWriteResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result RemoteWriteResult
+	for _, ts := range series {
+		name := ts.label("__name__")
+		target, part, ok := s.resolve(name)
+		if !ok {
+			result.Unmapped++
+			continue
+		}
+
+		labels := make(map[string]string)
+		for _, label := range ts.labels {
+			if field, ok := s.labels[label.name]; ok {
+				labels[field] = label.value
+			}
+		}
+
+		// Пропуски выборок (NaN, в том числе метки устаревания) не учитываются
+		samples := make([]promSample, 0, len(ts.samples))
+		for _, sample := range ts.samples {
+			if !math.IsNaN(sample.value) {
+				samples = append(samples, sample)
+			}
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i].timestamp < samples[j].timestamp })
+
+		switch target.metric {
+		case IngestActiveUsers, IngestServerLoad, IngestDatabaseConnections:
+			sample := ingestSampleTemplate(target.metric, labels)
+			sample.Value = samples[len(samples)-1].value * target.scale
+			s.ingest(&result, labels["service"], sample, now)
+		case IngestSales, IngestErrors:
+			delta, ok := s.counterDelta(seriesKey(ts.labels), samples, now)
+			if !ok || delta == 0 {
+				continue
+			}
+			sample := ingestSampleTemplate(target.metric, labels)
+			sample.Value = delta * target.scale
+			s.ingest(&result, labels["service"], sample, now)
+		case IngestResponseTime:
+			delta, ok := s.counterDelta(seriesKey(ts.labels), samples, now)
+			if !ok {
+				continue
+			}
+			s.addLatency(name[:len(name)-len(part)], ts, labels["service"], target.scale, part, delta)
+		}
+	}
+
+	if now.Sub(s.lastPrune) > time.Minute {
+		s.lastPrune = now
+		for key, counter := range s.counters {
+			if now.Sub(counter.seen) > remoteWriteSeriesTTL {
+				delete(s.counters, key)
+			}
+		}
+	}
+	return result
+}
+
+// Цель серии. Для времени ответа в соответствии задается базовое имя гистограммы или summary,
+// а приходят серии _bucket, _sum и _count; part - суффикс серии
+func (s *RemoteWriteSource) resolve(name string) (remoteWriteTarget, string, bool) {
+	if target, ok := s.metrics[name]; ok && target.metric != IngestResponseTime {
+		return target, "", true
+	}
+	for _, part := range []string{"_bucket", "_sum", "_count"} {
+		if !strings.HasSuffix(name, part) {
+			continue
+		}
+		if target, ok := s.metrics[strings.TrimSuffix(name, part)]; ok && target.metric == IngestResponseTime {
+			return target, part, true
+		}
+	}
+	return remoteWriteTarget{}, "", false
+}
+
+func (s *RemoteWriteSource) ingest(result *RemoteWriteResult, service string, sample IngestSample, now time.Time) {
+	if problems := s.Ingest(IngestBatch{Service: service, Samples: []IngestSample{sample}}, now); problems != nil {
+		result.Rejected++
+		if result.Error == "" {
+			result.Error = problems[0].Error
+		}
+		return
+	}
+	result.Accepted++
+}
+
+// Прирост счетчика с прошлой отправки. Первая выборка серии только запоминается, иначе
+// после перезапуска весь накопленный счетчик попал бы в один тик. Уменьшение значения - сброс счетчика
+func (s *RemoteWriteSource) counterDelta(key string, samples []promSample, now time.Time) (float64, bool) {
+	counter, known := s.counters[key]
+	if !known {
+		counter = &remoteWriteCounter{value: samples[0].value}
+		s.counters[key] = counter
+	}
+	delta := 0.0
+	for _, sample := range samples {
+		if sample.value >= counter.value {
+			delta += sample.value - counter.value
+		} else {
+			delta += sample.value
+		}
+		counter.value = sample.value
+	}
+	counter.seen = now
+	return delta, known || len(samples) > 1
+}
+
+// Накопление прироста серии гистограммы. Серии одной гистограммы отличаются только le
+func (s *RemoteWriteSource) addLatency(base string, ts promSeries, service string, scale float64, part string, delta float64) {
+	var key strings.Builder
+	key.WriteString(base)
+	for _, label := range ts.labels {
+		if label.name != "__name__" && label.name != "le" {
+			key.WriteString("\xff" + label.name + "\xff" + label.value)
+		}
+	}
+	latency := s.latency[key.String()]
+	if latency == nil {
+		latency = &remoteWriteLatency{service: service, scale: scale, buckets: make(map[float64]float64)}
+		s.latency[key.String()] = latency
+	}
+
+	switch part {
+	case "_bucket":
+		le, err := strconv.ParseFloat(ts.label("le"), 64)
+		if err == nil {
+			latency.buckets[le] += delta
+		}
+	case "_sum":
+		latency.sum += delta
+	case "_count":
+		latency.count += delta
+	}
+}
+
+// Выборки времени ответа из накопленных приростов. По корзинам запрос учитывается серединой
+// своей корзины, как при оценке histogram_quantile; без корзин (summary) - средним значением
+func (l *remoteWriteLatency) samples() []IngestSample {
+	var samples []IngestSample
+	if len(l.buckets) == 0 {
+		if l.count > 0 {
+			samples = append(samples, IngestSample{Metric: IngestResponseTime, Value: l.sum / l.count * l.scale, Count: l.count})
+		}
+		return samples
+	}
+
+	bounds := make([]float64, 0, len(l.buckets))
+	for le := range l.buckets {
+		bounds = append(bounds, le)
+	}
+	sort.Float64s(bounds)
+
+	lower, cumulative := 0.0, 0.0
+	for _, le := range bounds {
+		count := l.buckets[le] - cumulative
+		if count > 0 {
+			// Для корзины +Inf известна только нижняя граница
+			value := lower
+			if !math.IsInf(le, 1) {
+				value = (lower + le) / 2
+			}
+			samples = append(samples, IngestSample{Metric: IngestResponseTime, Value: value * l.scale, Count: count})
+			cumulative = l.buckets[le]
+		}
+		if !math.IsInf(le, 1) {
+			lower = le
+		}
+	}
+	return samples
+}
+
+// Тик: накопленные гистограммы сводятся в выборки, затем агрегатор собирает метрики тика
+func (s *RemoteWriteSource) Next(now time.Time) MetricsData {
+	s.mu.Lock()
+	for _, latency := range s.latency {
+		for _, sample := range latency.samples() {
+			if problems := s.Ingest(IngestBatch{Service: latency.service, Samples: []IngestSample{sample}}, now); problems != nil {
+				log.Printf("Rejected remote_write latency sample: %s", problems[0].Error)
+			}
+		}
+	}
+	s.latency = make(map[string]*remoteWriteLatency)
+	s.mu.Unlock()
+
+	return s.IngestAggregator.Next(now)
+}
+
+// Ключ серии по всем меткам
+func seriesKey(labels []promLabel) string {
+	sorted := append([]promLabel(nil), labels...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	var key strings.Builder
+	for _, label := range sorted {
+		key.WriteString(label.name + "\xff" + label.value + "\xff")
+	}
+	return key.String()
+}
+
+// Обработчик POST /api/v1/write: WriteRequest протокола remote_write 1.0 в protobuf, сжатый snappy.
+// Успешный прием - 204; 400 Prometheus не повторяет, поэтому на него отвечаем только для
+// неразбираемых запросов и выборок, которые не пройдут проверку и при повторе
+func handleRemoteWrite(source *RemoteWriteSource) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if source == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Remote write is not enabled, set METRICS_SOURCE=remote_write"})
+			return
+		}
+		if encoding := c.GetHeader("Content-Encoding"); encoding != "" && encoding != "snappy" {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": fmt.Sprintf("unsupported content encoding: %q, expected snappy", encoding)})
+			return
+		}
+		if contentType := c.GetHeader("Content-Type"); strings.Contains(contentType, "proto=") &&
+			!strings.Contains(contentType, "proto=prometheus.WriteRequest") {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": fmt.Sprintf("unsupported remote write message: %q, expected prometheus.WriteRequest", contentType)})
+			return
+		}
+
+		maxBytes := source.config.MaxBodyBytes
+		compressed, err := io.ReadAll(io.LimitReader(c.Request.Body, maxBytes+1))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			return
+		}
+		if int64(len(compressed)) > maxBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("request body exceeds %d bytes", maxBytes)})
+			return
+		}
+
+		size, err := snappy.DecodedLen(compressed)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid snappy body: %v", err)})
+			return
+		}
+		if size > remoteWriteMaxDecodedBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("decoded body exceeds %d bytes", remoteWriteMaxDecodedBytes)})
+			return
+		}
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid snappy body: %v", err)})
+			return
+		}
+
+		series, err := decodeWriteRequest(data)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid write request: %v", err)})
+			return
+		}
+
+		result := source.Receive(series, time.Now())
+		if result.Rejected > 0 {
+			c.JSON(http.StatusBadRequest, result)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// Записанные запросы remote_write: WriteRequest в protobuf, сжатый snappy, как их хранит
+// cmd/remote-write-harness. scenario - три отправки с заданными значениями (см. TestRemoteWriteScenario),
+// generated - вывод стенда с -generate -count 3
+func readRemoteWriteRequests(t *testing.T, dir string) [][]promSeries {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join("testdata", "remote-write", dir, "*.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("no recorded requests in %s", dir)
+	}
+	sort.Strings(files)
+
+	requests := make([][]promSeries, len(files))
+	for i, path := range files {
+		compressed, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if requests[i], err = decodeWriteRequest(data); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	return requests
+}
+
+func newTestRemoteWriteSource(t *testing.T) *RemoteWriteSource {
+	t.Helper()
+	source, err := NewRemoteWriteSource(newTestTieredStore(t), defaultRemoteWriteMapping, defaultRemoteWriteLabels, IngestConfig{
+		MaxLabelValues: 10,
+		GaugeTTL:       time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := source.IngestAggregator.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func withinAccuracy(got, want float64) bool {
+	return math.Abs(got-want) <= want*latencySketchAccuracy
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	requests := readRemoteWriteRequests(t, "scenario")
+	if len(requests) != 3 || len(requests[0]) != 11 || len(requests[1]) != 10 || len(requests[2]) != 10 {
+		t.Fatalf("unexpected series counts in recorded requests")
+	}
+
+	want := promSeries{
+		labels:  []promLabel{{"__name__", "orders_total"}, {"instance", "shop:9100"}, {"region", "Казань"}},
+		samples: []promSample{{53, 1700000000000}, {50, 1699999985000}},
+	}
+	if got := requests[0][1]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("series %+v, want %+v", got, want)
+	}
+	if got := requests[2][3].samples[0].value; !math.IsNaN(got) {
+		t.Fatalf("stale marker decoded as %v", got)
+	}
+
+	if _, err := decodeWriteRequest([]byte{0x0a, 0x05, 0x0a}); err == nil {
+		t.Fatal("truncated request decoded")
+	}
+}
+
+// Три отправки одной цели:
+//  1. первые значения счетчиков и гистограммы; у orders_total{region="Казань"} две выборки 50 и 53
+//  2. приросты: orders +30 и +7, errors +2, гистограмма +41 запрос: 10 до 50 мс, 20 до 100 мс,
+//     10 до 250 мс и 1 дольше
+//  3. перезапуск цели: orders{Москва} 130 -> 12, errors 7 -> 1, гистограмма с нуля 5 запросов до 50 мс;
+//     active_users с меткой устаревания (NaN)
+func TestRemoteWriteScenario(t *testing.T) {
+	source := newTestRemoteWriteSource(t)
+	requests := readRemoteWriteRequests(t, "scenario")
+	start := time.Unix(1700000000, 0)
+
+	ticks := make([]MetricsData, len(requests))
+	for i, series := range requests {
+		now := start.Add(time.Duration(i) * 15 * time.Second)
+		result := source.Receive(series, now)
+		if result.Rejected != 0 {
+			t.Fatalf("request %d: %+v", i+1, result)
+		}
+		if i == 0 && result.Unmapped != 1 {
+			t.Fatalf("go_goroutines must be unmapped: %+v", result)
+		}
+		ticks[i] = source.Next(now)
+	}
+
+	// Первая выборка серии только запоминается: иначе накопленные с запуска цели
+	// 100 заказов, 5 ошибок и 410 запросов попали бы в первый тик
+	first := ticks[0]
+	if first.Sales != 3 || len(first.ErrorsByType) != 0 || first.RequestsPerSecond != 0 {
+		t.Fatalf("tick 1: sales %d, errors %v, rps %v", first.Sales, first.ErrorsByType, first.RequestsPerSecond)
+	}
+	if first.ActiveUsers != 900 {
+		t.Fatalf("tick 1: active users %d", first.ActiveUsers)
+	}
+
+	// Корзины гистограммы дают запросы в серединах корзин, для +Inf - на нижней границе
+	second := ticks[1]
+	if second.Sales != 37 || second.RegionalData["Москва"].Sales != 30 || second.ErrorsByType["Timeout"] != 2 {
+		t.Fatalf("tick 2: sales %d, regions %v, errors %v", second.Sales, second.RegionalData, second.ErrorsByType)
+	}
+	if second.RequestsPerSecond != 41 || second.ActiveUsers != 950 {
+		t.Fatalf("tick 2: rps %v, active users %d", second.RequestsPerSecond, second.ActiveUsers)
+	}
+	if !withinAccuracy(second.ResponseTimeMs, (25*10+75*20+175*10+250)/41.0) {
+		t.Fatalf("tick 2: response time %v", second.ResponseTimeMs)
+	}
+	if p := second.Latency; !withinAccuracy(p.P50, 75) || !withinAccuracy(p.P90, 175) || !withinAccuracy(p.P99, 250) {
+		t.Fatalf("tick 2: percentiles %+v", p)
+	}
+
+	// Уменьшение счетчика - сброс: новое значение и есть прирост
+	third := ticks[2]
+	if third.Sales != 17 || third.RegionalData["Москва"].Sales != 12 || third.ErrorsByType["Timeout"] != 1 {
+		t.Fatalf("tick 3: sales %d, regions %v, errors %v", third.Sales, third.RegionalData, third.ErrorsByType)
+	}
+	if third.RequestsPerSecond != 5 || !withinAccuracy(third.Latency.P99, 25) {
+		t.Fatalf("tick 3: rps %v, p99 %v", third.RequestsPerSecond, third.Latency.P99)
+	}
+	// Метка устаревания не сбрасывает последнее значение
+	if third.ActiveUsers != 950 {
+		t.Fatalf("tick 3: active users %d", third.ActiveUsers)
+	}
+}
+
+// Запросы стенда: продажи и запросы за тики совпадают с приростами счетчиков в самих запросах
+func TestRemoteWriteGeneratedRequests(t *testing.T) {
+	source := newTestRemoteWriteSource(t)
+	requests := readRemoteWriteRequests(t, "generated")
+
+	previous := make(map[string]float64)
+	for i, series := range requests {
+		wantSales, wantRequests := 0.0, 0.0
+		for _, ts := range series {
+			key := seriesKey(ts.labels)
+			value := ts.samples[len(ts.samples)-1].value
+			if last, ok := previous[key]; ok {
+				switch ts.label("__name__") {
+				case "orders_total":
+					wantSales += value - last
+				case "http_request_duration_seconds_count":
+					wantRequests += value - last
+				}
+			}
+			previous[key] = value
+		}
+
+		now := time.Unix(1700000000+int64(i), 0)
+		if result := source.Receive(series, now); result.Rejected != 0 || result.Unmapped != 0 {
+			t.Fatalf("request %d: %+v", i+1, result)
+		}
+		metrics := source.Next(now)
+		if float64(metrics.Sales) != wantSales || metrics.RequestsPerSecond != wantRequests {
+			t.Fatalf("request %d: sales %d, rps %v, want %v and %v", i+1, metrics.Sales, metrics.RequestsPerSecond, wantSales, wantRequests)
+		}
+		if i > 0 && (metrics.RequestsPerSecond == 0 || metrics.Latency.P50 == 0) {
+			t.Fatalf("request %d: no latency from the histogram", i+1)
+		}
+	}
+}
+
+func TestRemoteWriteCounterDelta(t *testing.T) {
+	samples := func(values ...float64) []promSample {
+		result := make([]promSample, len(values))
+		for i, value := range values {
+			result[i] = promSample{value: value, timestamp: int64(i)}
+		}
+		return result
+	}
+	cases := []struct {
+		name   string
+		known  []float64 // Выборки предыдущей отправки, nil - серия новая
+		values []float64
+		delta  float64
+		ok     bool
+	}{
+		{"first sample", nil, []float64{100}, 0, false},
+		{"first request with several samples", nil, []float64{100, 104, 110}, 10, true},
+		{"increase", []float64{100}, []float64{130}, 30, true},
+		{"unchanged", []float64{100}, []float64{100}, 0, true},
+		{"reset", []float64{100}, []float64{12}, 12, true},
+		{"reset to zero", []float64{100}, []float64{0}, 0, true},
+		{"reset inside a request", []float64{100}, []float64{120, 3, 8}, 20 + 3 + 5, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			source := newTestRemoteWriteSource(t)
+			now := time.Unix(1700000000, 0)
+			if c.known != nil {
+				source.counterDelta("series", samples(c.known...), now)
+			}
+			delta, ok := source.counterDelta("series", samples(c.values...), now)
+			if delta != c.delta || ok != c.ok {
+				t.Fatalf("delta %v, %v, want %v, %v", delta, ok, c.delta, c.ok)
+			}
+		})
+	}
+}
+
+func TestRemoteWriteLatencySamples(t *testing.T) {
+	cases := []struct {
+		name    string
+		latency remoteWriteLatency
+		want    []IngestSample
+	}{
+		{
+			name:    "buckets in seconds",
+			latency: remoteWriteLatency{scale: 1000, buckets: map[float64]float64{0.1: 4, 0.5: 10, math.Inf(1): 12}},
+			want: []IngestSample{
+				{Metric: IngestResponseTime, Value: 50, Count: 4},
+				{Metric: IngestResponseTime, Value: 300, Count: 6},
+				{Metric: IngestResponseTime, Value: 500, Count: 2},
+			},
+		},
+		{
+			name:    "empty buckets skipped",
+			latency: remoteWriteLatency{scale: 1, buckets: map[float64]float64{10: 0, 20: 0, 40: 3, math.Inf(1): 3}},
+			want:    []IngestSample{{Metric: IngestResponseTime, Value: 30, Count: 3}},
+		},
+		{
+			name:    "summary without buckets",
+			latency: remoteWriteLatency{scale: 1000, sum: 1.5, count: 10},
+			want:    []IngestSample{{Metric: IngestResponseTime, Value: 150, Count: 10}},
+		},
+		{
+			name:    "no requests",
+			latency: remoteWriteLatency{scale: 1000},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.latency.samples(); !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("samples %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
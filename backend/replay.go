@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Максимальная длина строки файла записи: кадр с историей занимает десятки килобайт
+const maxReplayLineBytes = 16 << 20
+
+// Воспроизведение записанных метрик: файл NDJSON, по объекту MetricsData на строку
+// (например, ответы /metrics/current). Каждый тик отдается следующая запись с текущей
+// меткой времени; история строится заново по воспроизведенным тикам. Файл читается
+// построчно, в конце начинается сначала или, без повтора, остается последняя запись
+type ReplaySource struct {
+	mu      sync.Mutex
+	path    string
+	loop    bool
+	store   *TieredStore
+	file    *os.File
+	reader  *bufio.Reader
+	line    int
+	history *historyTracker // nil - история ведется объединяющим источником
+	last    MetricsData
+}
+
+func NewReplaySource(store *TieredStore, path string, loop bool) *ReplaySource {
+	return &ReplaySource{
+		path:    path,
+		loop:    loop,
+		store:   store,
+		history: &historyTracker{rollups: newHistoryRollups()},
+	}
+}
+
+func (r *ReplaySource) Name() string {
+	return "replay"
+}
+
+func (r *ReplaySource) Start(ctx context.Context) error {
+	file, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	var history *historyTracker
+	if r.history != nil {
+		history = loadHistoryTracker(r.store, time.Now())
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.file = file
+	r.reader = bufio.NewReaderSize(file, 64<<10)
+	r.history = history
+	return nil
+}
+
+func (r *ReplaySource) disableHistory() {
+	r.history = nil
+}
+
+func (r *ReplaySource) Stop() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// Запись относится к прошлому, но ее время - время воспроизведения, поэтому заранее
+// в хранилище ничего не пишем
+func (r *ReplaySource) Backfill(now time.Time) error {
+	return nil
+}
+
+func (r *ReplaySource) Next(now time.Time) MetricsData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	metrics, err := r.read()
+	if err != nil {
+		log.Printf("Error replaying %s: %v", r.path, err)
+	}
+	if err != nil || metrics == nil {
+		// Без новой записи повторяем последнюю
+		previous := r.last
+		metrics = &previous
+	}
+
+	metrics.Timestamp = now.Unix()
+	r.history.add(metrics)
+	r.last = *metrics
+	return r.last
+}
+
+// Следующая запись файла; nil, если записи закончились и повтор выключен
+func (r *ReplaySource) read() (*MetricsData, error) {
+	if r.reader == nil {
+		return nil, nil
+	}
+
+	rewound := false
+	for {
+		line, err := r.readLine()
+		if err == io.EOF {
+			// Пустой файл перематываем не больше одного раза, чтобы не зациклиться
+			if !r.loop || rewound {
+				return nil, nil
+			}
+			if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			r.reader.Reset(r.file)
+			r.line = 0
+			rewound = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+
+		var metrics MetricsData
+		if err := json.Unmarshal(line, &metrics); err != nil {
+			return nil, fmt.Errorf("line %d: %w", r.line, err)
+		}
+		return &metrics, nil
+	}
+}
+
+// Строка файла. Слишком длинная строка пропускается целиком, чтобы следующее чтение
+// началось с новой записи
+func (r *ReplaySource) readLine() ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, isPrefix, err := r.reader.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+			tooLong = len(line) > maxReplayLineBytes
+		}
+		if isPrefix {
+			continue
+		}
+		r.line++
+		if tooLong {
+			return nil, fmt.Errorf("line %d exceeds %d bytes", r.line, maxReplayLineBytes)
+		}
+		return line, nil
+	}
+}
+
+func (r *ReplaySource) Current() MetricsData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
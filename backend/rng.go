@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math/bits"
+	"math/rand"
+)
+
+// Источник случайных чисел генератора метрик (xoshiro256**). В отличие от источника
+// math/rand его состояние - четыре слова, которые можно сохранить в снимок и восстановить,
+// после чего генератор продолжит ту же последовательность
+type generatorSource struct {
+	state [4]uint64
+}
+
+func newGeneratorSource(seed int64) *generatorSource {
+	source := &generatorSource{}
+	source.Seed(seed)
+	return source
+}
+
+// Инициализация состояния через splitmix64, чтобы близкие seed давали несвязанные последовательности
+func (s *generatorSource) Seed(seed int64) {
+	x := uint64(seed)
+	for i := range s.state {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		s.state[i] = z ^ (z >> 31)
+	}
+}
+
+func (s *generatorSource) Uint64() uint64 {
+	result := bits.RotateLeft64(s.state[1]*5, 7) * 9
+	t := s.state[1] << 17
+
+	s.state[2] ^= s.state[0]
+	s.state[3] ^= s.state[1]
+	s.state[1] ^= s.state[2]
+	s.state[0] ^= s.state[3]
+	s.state[2] ^= t
+	s.state[3] = bits.RotateLeft64(s.state[3], 45)
+	return result
+}
+
+func (s *generatorSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// Состояние источника для снимка
+func (s *generatorSource) State() [4]uint64 {
+	return s.state
+}
+
+// Восстановление состояния из снимка. Нулевое состояние xoshiro вырождено и не принимается
+func (s *generatorSource) SetState(state [4]uint64) bool {
+	if state == [4]uint64{} {
+		return false
+	}
+	s.state = state
+	return true
+}
+
+var _ rand.Source64 = (*generatorSource)(nil)
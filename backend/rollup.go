@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+)
+
+// Сводка метрик за период, которую можно дополнять записями и объединять с другими сводками
+// без потери точности. Каждая запись входит с весом - числом секунд, которые она представляет:
+// тик - секунду, запись уровня хранения - свое разрешение. Мгновенные значения (пользователи,
+// нагрузка, RPS, источники, воронка) усредняются по времени, счетчики событий (продажи, ошибки)
+// суммируются. Время отклика и доля ошибок взвешиваются по числу запросов, конверсия - по числу
+// пользователей. Перцентили времени ответа считаются по объединенному скетчу распределения
+type Rollup struct {
+	Start           int64   // Начало периода
+	Duration        float64 // Суммарный вес записей, секунды
+	Records         int     // Число записей в сводке
+	PeakActiveUsers int     // Максимум пользователей среди записей
+
+	// Суммы значений, умноженных на вес
+	users, rps, load, dbConnections     float64
+	responseTime, weightedResponseTime  float64
+	errorRate, weightedErrorRate        float64
+	conversion, weightedConversion      float64
+	visitors, productViews, addedToCart float64
+	beganCheckout, purchased            float64
+	sources                             map[string]float64
+	regions                             map[string]*regionRollup
+
+	// Счетчики
+	sales   int
+	errors  map[string]int
+	latency LatencySketch // Объединенное распределение времени ответа
+}
+
+type regionRollup struct {
+	users, conversion, weightedConversion float64
+	sales                                 int
+}
+
+func newRollup(start int64) *Rollup {
+	return &Rollup{
+		Start:   start,
+		sources: make(map[string]float64),
+		regions: make(map[string]*regionRollup),
+		errors:  make(map[string]int),
+	}
+}
+
+// Добавление записи с весом weight секунд
+func (r *Rollup) Add(m MetricsData, weight float64) {
+	r.Duration += weight
+	r.Records++
+	if m.ActiveUsers > r.PeakActiveUsers {
+		r.PeakActiveUsers = m.ActiveUsers
+	}
+	if m.PeakActiveUsers > r.PeakActiveUsers {
+		r.PeakActiveUsers = m.PeakActiveUsers
+	}
+
+	r.users += float64(m.ActiveUsers) * weight
+	r.rps += m.RequestsPerSecond * weight
+	r.load += m.ServerLoad * weight
+	r.dbConnections += float64(m.DatabaseConnections) * weight
+
+	r.responseTime += m.ResponseTimeMs * weight
+	r.weightedResponseTime += m.ResponseTimeMs * m.RequestsPerSecond * weight
+	r.errorRate += m.ErrorRate * weight
+	r.weightedErrorRate += m.ErrorRate * m.RequestsPerSecond * weight
+	r.conversion += m.ConversionRate * weight
+	r.weightedConversion += m.ConversionRate * float64(m.ActiveUsers) * weight
+
+	r.visitors += float64(m.ConversionFunnel.Visitors) * weight
+	r.productViews += float64(m.ConversionFunnel.ProductViews) * weight
+	r.addedToCart += float64(m.ConversionFunnel.AddedToCart) * weight
+	r.beganCheckout += float64(m.ConversionFunnel.BeganCheckout) * weight
+	r.purchased += float64(m.ConversionFunnel.PurchasedItems) * weight
+
+	for source, count := range m.SourcesData {
+		r.sources[source] += float64(count) * weight
+	}
+	for name, region := range m.RegionalData {
+		sums := r.region(name)
+		sums.users += float64(region.ActiveUsers) * weight
+		sums.sales += region.Sales
+		sums.conversion += region.ConversionRate * weight
+		sums.weightedConversion += region.ConversionRate * float64(region.ActiveUsers) * weight
+	}
+
+	r.sales += m.Sales
+	for errType, count := range m.ErrorsByType {
+		r.errors[errType] += count
+	}
+	r.latency.Merge(m.LatencySketch)
+}
+
+// Объединение со сводкой другого периода или части того же периода
+func (r *Rollup) Merge(other *Rollup) {
+	r.Duration += other.Duration
+	r.Records += other.Records
+	if other.PeakActiveUsers > r.PeakActiveUsers {
+		r.PeakActiveUsers = other.PeakActiveUsers
+	}
+
+	r.users += other.users
+	r.rps += other.rps
+	r.load += other.load
+	r.dbConnections += other.dbConnections
+
+	r.responseTime += other.responseTime
+	r.weightedResponseTime += other.weightedResponseTime
+	r.errorRate += other.errorRate
+	r.weightedErrorRate += other.weightedErrorRate
+	r.conversion += other.conversion
+	r.weightedConversion += other.weightedConversion
+
+	r.visitors += other.visitors
+	r.productViews += other.productViews
+	r.addedToCart += other.addedToCart
+	r.beganCheckout += other.beganCheckout
+	r.purchased += other.purchased
+
+	for source, sum := range other.sources {
+		r.sources[source] += sum
+	}
+	for name, region := range other.regions {
+		sums := r.region(name)
+		sums.users += region.users
+		sums.sales += region.sales
+		sums.conversion += region.conversion
+		sums.weightedConversion += region.weightedConversion
+	}
+
+	r.sales += other.sales
+	for errType, count := range other.errors {
+		r.errors[errType] += count
+	}
+	r.latency.Merge(&other.latency)
+}
+
+func (r *Rollup) region(name string) *regionRollup {
+	sums := r.regions[name]
+	if sums == nil {
+		sums = &regionRollup{}
+		r.regions[name] = sums
+	}
+	return sums
+}
+
+// Сводка в виде метрик с меткой времени начала периода. Мгновенные значения - средние за период,
+// пик пользователей сохраняется отдельно, чтобы пережить сворачивание в следующий уровень
+func (r *Rollup) Metrics() MetricsData {
+	result := MetricsData{
+		Timestamp:       r.Start,
+		PeakActiveUsers: r.PeakActiveUsers,
+		Sales:           r.sales,
+		ErrorsByType:    make(map[string]int, len(r.errors)),
+		RegionalData:    make(map[string]Region, len(r.regions)),
+		SourcesData:     make(map[string]int, len(r.sources)),
+	}
+	for errType, count := range r.errors {
+		result.ErrorsByType[errType] = count
+	}
+	if r.latency.Count() > 0 {
+		sketch := &LatencySketch{}
+		sketch.Merge(&r.latency)
+		result.LatencySketch = sketch
+		result.Latency = sketch.Percentiles()
+	}
+	if r.Duration == 0 {
+		return result
+	}
+
+	d := r.Duration
+	result.ActiveUsers = roundInt(r.users / d)
+	result.RequestsPerSecond = r.rps / d
+	result.ServerLoad = r.load / d
+	result.DatabaseConnections = roundInt(r.dbConnections / d)
+	result.ResponseTimeMs = weightedMean(r.weightedResponseTime, r.rps, r.responseTime/d)
+	result.ErrorRate = weightedMean(r.weightedErrorRate, r.rps, r.errorRate/d)
+	result.ConversionRate = weightedMean(r.weightedConversion, r.users, r.conversion/d)
+
+	for name, sums := range r.regions {
+		result.RegionalData[name] = Region{
+			ActiveUsers:    roundInt(sums.users / d),
+			Sales:          sums.sales,
+			ConversionRate: weightedMean(sums.weightedConversion, sums.users, sums.conversion/d),
+		}
+	}
+	for source, sum := range r.sources {
+		result.SourcesData[source] = roundInt(sum / d)
+	}
+
+	result.ConversionFunnel = ConversionFunnel{
+		Visitors:       roundInt(r.visitors / d),
+		ProductViews:   roundInt(r.productViews / d),
+		AddedToCart:    roundInt(r.addedToCart / d),
+		BeganCheckout:  roundInt(r.beganCheckout / d),
+		PurchasedItems: roundInt(r.purchased / d),
+	}
+	return result
+}
+
+// Сводка в виде точки исторического графика
+func (r *Rollup) Historical() HistoricalMetrics {
+	metrics := r.Metrics()
+	return HistoricalMetrics{
+		ActiveUsers:     metrics.ActiveUsers,
+		PeakActiveUsers: r.PeakActiveUsers,
+		Sales:           metrics.Sales,
+		ConversionRate:  metrics.ConversionRate,
+		ResponseTimeMs:  metrics.ResponseTimeMs,
+		Latency:         metrics.Latency,
+	}
+}
+
+// Взвешенное среднее. При нулевом суммарном весе - простое среднее
+func weightedMean(weightedSum, totalWeight, fallback float64) float64 {
+	if totalWeight == 0 {
+		return fallback
+	}
+	return weightedSum / totalWeight
+}
+
+func roundInt(v float64) int {
+	return int(math.Round(v))
+}
+
+// Сериализуемое представление сводки для снимка состояния генератора
+type rollupState struct {
+	Start           int64   `json:"start"`
+	Duration        float64 `json:"duration"`
+	Records         int     `json:"records"`
+	PeakActiveUsers int     `json:"peakActiveUsers"`
+
+	Users                float64 `json:"users"`
+	RPS                  float64 `json:"rps"`
+	Load                 float64 `json:"load"`
+	DatabaseConnections  float64 `json:"databaseConnections"`
+	ResponseTime         float64 `json:"responseTime"`
+	WeightedResponseTime float64 `json:"weightedResponseTime"`
+	ErrorRate            float64 `json:"errorRate"`
+	WeightedErrorRate    float64 `json:"weightedErrorRate"`
+	Conversion           float64 `json:"conversion"`
+	WeightedConversion   float64 `json:"weightedConversion"`
+	Visitors             float64 `json:"visitors"`
+	ProductViews         float64 `json:"productViews"`
+	AddedToCart          float64 `json:"addedToCart"`
+	BeganCheckout        float64 `json:"beganCheckout"`
+	Purchased            float64 `json:"purchased"`
+
+	Sources map[string]float64           `json:"sources"`
+	Regions map[string]regionRollupState `json:"regions"`
+	Sales   int                          `json:"sales"`
+	Errors  map[string]int               `json:"errors"`
+	Latency LatencySketch                `json:"latency"`
+}
+
+type regionRollupState struct {
+	Users              float64 `json:"users"`
+	Conversion         float64 `json:"conversion"`
+	WeightedConversion float64 `json:"weightedConversion"`
+	Sales              int     `json:"sales"`
+}
+
+func (r *Rollup) MarshalJSON() ([]byte, error) {
+	state := rollupState{
+		Start:                r.Start,
+		Duration:             r.Duration,
+		Records:              r.Records,
+		PeakActiveUsers:      r.PeakActiveUsers,
+		Users:                r.users,
+		RPS:                  r.rps,
+		Load:                 r.load,
+		DatabaseConnections:  r.dbConnections,
+		ResponseTime:         r.responseTime,
+		WeightedResponseTime: r.weightedResponseTime,
+		ErrorRate:            r.errorRate,
+		WeightedErrorRate:    r.weightedErrorRate,
+		Conversion:           r.conversion,
+		WeightedConversion:   r.weightedConversion,
+		Visitors:             r.visitors,
+		ProductViews:         r.productViews,
+		AddedToCart:          r.addedToCart,
+		BeganCheckout:        r.beganCheckout,
+		Purchased:            r.purchased,
+		Sources:              r.sources,
+		Regions:              make(map[string]regionRollupState, len(r.regions)),
+		Sales:                r.sales,
+		Errors:               r.errors,
+		Latency:              r.latency,
+	}
+	for name, sums := range r.regions {
+		state.Regions[name] = regionRollupState{
+			Users:              sums.users,
+			Conversion:         sums.conversion,
+			WeightedConversion: sums.weightedConversion,
+			Sales:              sums.sales,
+		}
+	}
+	return json.Marshal(state)
+}
+
+func (r *Rollup) UnmarshalJSON(data []byte) error {
+	var state rollupState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	*r = *newRollup(state.Start)
+	r.Duration = state.Duration
+	r.Records = state.Records
+	r.PeakActiveUsers = state.PeakActiveUsers
+	r.users = state.Users
+	r.rps = state.RPS
+	r.load = state.Load
+	r.dbConnections = state.DatabaseConnections
+	r.responseTime = state.ResponseTime
+	r.weightedResponseTime = state.WeightedResponseTime
+	r.errorRate = state.ErrorRate
+	r.weightedErrorRate = state.WeightedErrorRate
+	r.conversion = state.Conversion
+	r.weightedConversion = state.WeightedConversion
+	r.visitors = state.Visitors
+	r.productViews = state.ProductViews
+	r.addedToCart = state.AddedToCart
+	r.beganCheckout = state.BeganCheckout
+	r.purchased = state.Purchased
+	r.sales = state.Sales
+	r.latency = state.Latency
+
+	for source, sum := range state.Sources {
+		r.sources[source] = sum
+	}
+	for name, sums := range state.Regions {
+		r.regions[name] = &regionRollup{
+			users:              sums.Users,
+			conversion:         sums.Conversion,
+			weightedConversion: sums.WeightedConversion,
+			sales:              sums.Sales,
+		}
+	}
+	for errType, count := range state.Errors {
+		r.errors[errType] = count
+	}
+	return nil
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Хранилище тиков на диске. Тики дописываются в активный сегментный файл, который
+// закрывается через SegmentDuration или по достижении SegmentMaxBytes. Запись в файле:
+//
+//	[длина полезной нагрузки uint32][CRC32-C нагрузки uint32][тик в формате tickcodec]
+//
+// Закрытый сегмент получает файл индекса с метаданными и смещениями каждой
+// indexStride-й записи, по которым Range пропускает начало сегмента.
+// После аварийного завершения у сегментов без корректного индекса записи
+// проверяются заново, а оборванный или поврежденный хвост отрезается
+const (
+	segmentExt       = ".seg"
+	indexExt         = ".idx"
+	recordHeaderSize = 8
+	maxRecordSize    = 1 << 20
+	indexStride      = 64
+	indexMagic       = "MIDX0001"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Параметры дискового хранилища, нулевые значения заменяются значениями по умолчанию
+type segmentStoreOptions struct {
+	SegmentDuration time.Duration // Через сколько активный сегмент закрывается
+	SegmentMaxBytes int64         // Максимальный размер сегмента
+	SyncInterval    time.Duration // Как часто сбрасывать записи на диск (fsync)
+}
+
+// Точка индекса: смещение записи и максимальное время всех записей перед ней
+type indexEntry struct {
+	offset int64
+	maxTs  int64
+}
+
+// Метаданные сегмента
+type segment struct {
+	id     int
+	path   string
+	size   int64
+	count  int
+	minTs  int64
+	maxTs  int64
+	index  []indexEntry
+	sealed bool
+}
+
+type segmentStore struct {
+	mu       sync.RWMutex
+	dir      string
+	options  segmentStoreOptions
+	segments []*segment // По возрастанию id, последний может быть активным
+	active   *os.File   // Открытый на запись последний сегмент, nil - активного нет
+	opened   time.Time  // Когда активный сегмент открыт
+	lastSync time.Time
+	closed   bool
+	nextID   int // Номер следующего сегмента: номера удаленных сегментов не переиспользуются
+}
+
+// Открытие хранилища с проверкой и восстановлением сегментов
+func openSegmentStore(dir string, options segmentStoreOptions) (*segmentStore, error) {
+	if options.SegmentDuration <= 0 {
+		options.SegmentDuration = time.Hour
+	}
+	if options.SegmentMaxBytes <= 0 {
+		options.SegmentMaxBytes = 32 << 20
+	}
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = time.Second
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating store directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading store directory: %w", err)
+	}
+
+	var ids []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, segmentExt))
+		if err != nil {
+			log.Printf("Skipping unknown file in metrics store: %s", name)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	store := &segmentStore{dir: dir, options: options, lastSync: time.Now(), nextID: 1}
+	if n := len(ids); n > 0 {
+		store.nextID = ids[n-1] + 1
+	}
+	for i, id := range ids {
+		seg, err := store.loadSegment(id, i == len(ids)-1)
+		if err != nil {
+			return nil, err
+		}
+		store.segments = append(store.segments, seg)
+	}
+
+	// Незакрытый последний сегмент продолжаем дописывать
+	if n := len(store.segments); n > 0 && !store.segments[n-1].sealed {
+		last := store.segments[n-1]
+		file, err := os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("opening segment %s: %w", last.path, err)
+		}
+		store.active = file
+		store.opened = time.Now()
+	}
+
+	return store, nil
+}
+
+func (s *segmentStore) segmentPath(id int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d%s", id, segmentExt))
+}
+
+func indexPath(segmentPath string) string {
+	return strings.TrimSuffix(segmentPath, segmentExt) + indexExt
+}
+
+// Загрузка метаданных сегмента: из индекса, если он цел, иначе проверкой всех записей.
+// Последний сегмент без индекса остается открытым для записи
+func (s *segmentStore) loadSegment(id int, last bool) (*segment, error) {
+	path := s.segmentPath(id)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if seg, err := readIndex(id, path, info.Size()); err == nil {
+		return seg, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Rebuilding index of segment %s: %v", path, err)
+	}
+
+	seg, err := recoverSegment(id, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !last {
+		seg.sealed = true
+		if err := writeIndex(seg); err != nil {
+			return nil, err
+		}
+	}
+	return seg, nil
+}
+
+// Проверка всех записей сегмента. Все, что следует за первой поврежденной
+// или оборванной записью, отрезается
+func recoverSegment(id int, path string) (*segment, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening segment %s: %w", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	seg := &segment{id: id, path: path}
+	reader := bufio.NewReader(file)
+	var payload []byte
+	for {
+		payload, err = readRecord(reader, payload)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			var ts int64
+			if ts, err = tickTimestamp(payload); err == nil {
+				seg.add(ts, int64(recordHeaderSize+len(payload)))
+				continue
+			}
+		}
+
+		log.Printf("Recovering segment %s: dropping %d bytes after offset %d: %v",
+			path, info.Size()-seg.size, seg.size, err)
+		if err := file.Truncate(seg.size); err != nil {
+			return nil, fmt.Errorf("truncating segment %s: %w", path, err)
+		}
+		if err := file.Sync(); err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	return seg, nil
+}
+
+// Учет новой записи в метаданных сегмента
+func (seg *segment) add(ts int64, recordSize int64) {
+	if seg.count%indexStride == 0 {
+		maxTs := int64(math.MinInt64)
+		if seg.count > 0 {
+			maxTs = seg.maxTs
+		}
+		seg.index = append(seg.index, indexEntry{offset: seg.size, maxTs: maxTs})
+	}
+
+	if seg.count == 0 || ts < seg.minTs {
+		seg.minTs = ts
+	}
+	if seg.count == 0 || ts > seg.maxTs {
+		seg.maxTs = ts
+	}
+	seg.count++
+	seg.size += recordSize
+}
+
+// Чтение одной записи. io.EOF только на границе записей
+func readRecord(reader *bufio.Reader, buf []byte) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("torn record header")
+		}
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:4])
+	if length == 0 || length > maxRecordSize {
+		return nil, fmt.Errorf("invalid record length %d", length)
+	}
+
+	if cap(buf) < int(length) {
+		buf = make([]byte, length)
+	}
+	buf = buf[:length]
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, errors.New("torn record payload")
+	}
+
+	if crc32.Checksum(buf, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errors.New("record checksum mismatch")
+	}
+	return buf, nil
+}
+
+// Файл индекса: магическая строка, размер сегмента, число записей, границы времени,
+// число точек, сами точки и CRC32-C всего предыдущего содержимого
+func writeIndex(seg *segment) error {
+	buf := []byte(indexMagic)
+	buf = appendUint64(buf, uint64(seg.size))
+	buf = appendUint64(buf, uint64(seg.count))
+	buf = appendUint64(buf, uint64(seg.minTs))
+	buf = appendUint64(buf, uint64(seg.maxTs))
+	buf = appendUint64(buf, uint64(len(seg.index)))
+	for _, entry := range seg.index {
+		buf = appendUint64(buf, uint64(entry.offset))
+		buf = appendUint64(buf, uint64(entry.maxTs))
+	}
+	buf = appendUint32(buf, crc32.Checksum(buf, crcTable))
+
+	// Пишем во временный файл и переименовываем, чтобы индекс не оказался записан наполовину
+	path := indexPath(seg.path)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o644); err != nil {
+		return fmt.Errorf("writing index %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("writing index %s: %w", path, err)
+	}
+	return nil
+}
+
+func readIndex(id int, segmentPath string, segmentSize int64) (*segment, error) {
+	data, err := os.ReadFile(indexPath(segmentPath))
+	if err != nil {
+		return nil, err
+	}
+
+	const headerSize = len(indexMagic) + 5*8
+	if len(data) < headerSize+4 || string(data[:len(indexMagic)]) != indexMagic {
+		return nil, errors.New("invalid index header")
+	}
+	body, checksum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crcTable) != checksum {
+		return nil, errors.New("index checksum mismatch")
+	}
+
+	field := func(i int) int64 {
+		return int64(binary.BigEndian.Uint64(body[len(indexMagic)+i*8:]))
+	}
+	seg := &segment{
+		id:     id,
+		path:   segmentPath,
+		size:   field(0),
+		count:  int(field(1)),
+		minTs:  field(2),
+		maxTs:  field(3),
+		sealed: true,
+	}
+	if seg.size != segmentSize {
+		return nil, fmt.Errorf("index describes %d bytes, segment has %d", seg.size, segmentSize)
+	}
+
+	entries := field(4)
+	if entries < 0 || int64(len(body)) != int64(headerSize)+entries*16 {
+		return nil, errors.New("invalid index size")
+	}
+	seg.index = make([]indexEntry, entries)
+	for i := range seg.index {
+		offset := headerSize + i*16
+		seg.index[i] = indexEntry{
+			offset: int64(binary.BigEndian.Uint64(body[offset:])),
+			maxTs:  int64(binary.BigEndian.Uint64(body[offset+8:])),
+		}
+	}
+	return seg, nil
+}
+
+func (s *segmentStore) Append(metrics MetricsData) error {
+	payload := encodeTick(make([]byte, recordHeaderSize, 512), &metrics)
+	length := len(payload) - recordHeaderSize
+	binary.BigEndian.PutUint32(payload[:4], uint32(length))
+	binary.BigEndian.PutUint32(payload[4:8], crc32.Checksum(payload[recordHeaderSize:], crcTable))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errors.New("metrics store is closed")
+	}
+
+	if s.active != nil {
+		seg := s.segments[len(s.segments)-1]
+		if time.Since(s.opened) >= s.options.SegmentDuration || seg.size+int64(len(payload)) > s.options.SegmentMaxBytes {
+			if err := s.seal(); err != nil {
+				return err
+			}
+		}
+	}
+	if s.active == nil {
+		if err := s.createSegment(); err != nil {
+			return err
+		}
+	}
+
+	seg := s.segments[len(s.segments)-1]
+
+	if _, err := s.active.Write(payload); err != nil {
+		// Отрезаем возможную частичную запись, чтобы сегмент оставался читаемым
+		if truncErr := s.active.Truncate(seg.size); truncErr != nil {
+			log.Printf("Error truncating segment %s after failed write: %v", seg.path, truncErr)
+		}
+		return fmt.Errorf("writing segment %s: %w", seg.path, err)
+	}
+	seg.add(metrics.Timestamp, int64(len(payload)))
+
+	if time.Since(s.lastSync) >= s.options.SyncInterval {
+		s.lastSync = time.Now()
+		if err := s.active.Sync(); err != nil {
+			return fmt.Errorf("syncing segment %s: %w", seg.path, err)
+		}
+	}
+	return nil
+}
+
+// Создание нового активного сегмента
+func (s *segmentStore) createSegment() error {
+	id := s.nextID
+	s.nextID++
+
+	path := s.segmentPath(id)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("creating segment: %w", err)
+	}
+
+	s.segments = append(s.segments, &segment{id: id, path: path})
+	s.active = file
+	s.opened = time.Now()
+	return nil
+}
+
+// Закрытие активного сегмента с записью индекса. Пустой сегмент удаляется
+func (s *segmentStore) seal() error {
+	seg := s.segments[len(s.segments)-1]
+	file := s.active
+	s.active = nil
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("syncing segment %s: %w", seg.path, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("closing segment %s: %w", seg.path, err)
+	}
+
+	if seg.count == 0 {
+		s.segments = s.segments[:len(s.segments)-1]
+		return os.Remove(seg.path)
+	}
+
+	seg.sealed = true
+	return writeIndex(seg)
+}
+
+func (s *segmentStore) Range(from, to int64, fn func(metrics MetricsData) bool) error {
+	// Копии метаданных: активный сегмент может расти, пока идет чтение
+	s.mu.RLock()
+	var snapshots []segment
+	for _, seg := range s.segments {
+		if seg.count > 0 && seg.minTs < to && seg.maxTs >= from {
+			snapshots = append(snapshots, *seg)
+		}
+	}
+	s.mu.RUnlock()
+
+	for i := range snapshots {
+		more, err := readSegment(&snapshots[i], from, to, fn)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Чтение тиков сегмента в диапазоне. false, если fn остановила обход
+func readSegment(seg *segment, from, to int64, fn func(metrics MetricsData) bool) (bool, error) {
+	file, err := os.Open(seg.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil // Сегмент удален по сроку хранения, пока шло чтение
+	}
+	if err != nil {
+		return false, fmt.Errorf("opening segment %s: %w", seg.path, err)
+	}
+	defer file.Close()
+
+	// Пропускаем записи, время которых заведомо меньше from
+	start := int64(0)
+	if i := sort.Search(len(seg.index), func(i int) bool { return seg.index[i].maxTs >= from }); i > 0 {
+		start = seg.index[i-1].offset
+	}
+
+	reader := bufio.NewReaderSize(io.NewSectionReader(file, start, seg.size-start), 64*1024)
+	var payload []byte
+	for {
+		payload, err = readRecord(reader, payload)
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("reading segment %s: %w", seg.path, err)
+		}
+
+		ts, err := tickTimestamp(payload)
+		if err != nil {
+			return false, fmt.Errorf("reading segment %s: %w", seg.path, err)
+		}
+		if ts < from || ts >= to {
+			continue
+		}
+
+		metrics, err := decodeTick(payload)
+		if err != nil {
+			return false, fmt.Errorf("reading segment %s: %w", seg.path, err)
+		}
+		if !fn(metrics) {
+			return false, nil
+		}
+	}
+}
+
+func (s *segmentStore) Bounds() (int64, int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var first, last int64
+	found := false
+	for _, seg := range s.segments {
+		if seg.count == 0 {
+			continue
+		}
+		if !found || seg.minTs < first {
+			first = seg.minTs
+		}
+		if !found || seg.maxTs > last {
+			last = seg.maxTs
+		}
+		found = true
+	}
+	return first, last, found
+}
+
+// Удаление закрытых сегментов, все тики которых старше before.
+// Сегменты удаляются целиком, поэтому часть старых тиков может прожить дольше
+func (s *segmentStore) DeleteBefore(before int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.segments[:0]
+	var firstErr error
+	for _, seg := range s.segments {
+		if !seg.sealed || seg.maxTs >= before || firstErr != nil {
+			kept = append(kept, seg)
+			continue
+		}
+
+		if err := os.Remove(seg.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			firstErr = fmt.Errorf("removing segment %s: %w", seg.path, err)
+			kept = append(kept, seg)
+			continue
+		}
+		if err := os.Remove(indexPath(seg.path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error removing index of evicted segment %s: %v", seg.path, err)
+		}
+		log.Printf("Evicted segment %s (%d ticks up to %s)", seg.path, seg.count, time.Unix(seg.maxTs, 0).Format(time.RFC3339))
+	}
+	s.segments = kept
+	return firstErr
+}
+
+// Закрытие хранилища: активный сегмент закрывается с записью индекса
+func (s *segmentStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.active == nil {
+		return nil
+	}
+	return s.seal()
+}
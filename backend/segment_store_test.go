@@ -0,0 +1,378 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const segmentTestStart = 1700000000
+
+// Размер записи тика в сегменте
+func segmentRecordSize(ts int64) int64 {
+	tick := testTick(ts)
+	return int64(recordHeaderSize + len(encodeTick(nil, &tick)))
+}
+
+func writeSegmentTicks(t *testing.T, store *segmentStore, from, n int) {
+	t.Helper()
+	for i := from; i < from+n; i++ {
+		if err := store.Append(testTick(int64(segmentTestStart + i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Имитация аварийного завершения: активный сегмент закрывается без индекса
+func crashSegmentStore(t *testing.T, store *segmentStore) {
+	t.Helper()
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.active != nil {
+		if err := store.active.Close(); err != nil {
+			t.Fatal(err)
+		}
+		store.active = nil
+	}
+	store.closed = true
+}
+
+func openTestSegmentStore(t *testing.T, dir string, options segmentStoreOptions) *segmentStore {
+	t.Helper()
+	store, err := openSegmentStore(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// Тики хранилища должны быть ровно первыми n записанными
+func assertSegmentPrefix(t *testing.T, store *segmentStore, n int) {
+	t.Helper()
+	var got []MetricsData
+	err := store.Range(0, segmentTestStart*2, func(metrics MetricsData) bool {
+		got = append(got, metrics)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != n {
+		t.Fatalf("expected %d ticks, got %d", n, len(got))
+	}
+	for i, metrics := range got {
+		want := testTick(int64(segmentTestStart + i))
+		if metrics.Timestamp != want.Timestamp || metrics.Sales != want.Sales ||
+			metrics.LatencySketch == nil || metrics.LatencySketch.Count() != want.LatencySketch.Count() {
+			t.Fatalf("tick %d decoded as %+v", i, metrics)
+		}
+	}
+}
+
+func singleSegmentPath(t *testing.T, dir string) string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("expected one segment, got %v (%v)", paths, err)
+	}
+	return paths[0]
+}
+
+// Оборванная последняя запись: после обрезки файла в любом месте остаются только целые записи
+func TestSegmentStoreRecoversTornTail(t *testing.T) {
+	const ticks = 10
+	var ends []int64 // Конец каждой записи
+	size := int64(0)
+	for i := 0; i < ticks; i++ {
+		size += segmentRecordSize(int64(segmentTestStart + i))
+		ends = append(ends, size)
+	}
+	lastStart := ends[ticks-2]
+
+	cuts := []struct {
+		name   string
+		offset int64
+		intact int
+	}{
+		{"empty file", 0, 0},
+		{"inside first header", 3, 0},
+		{"after last header", lastStart + recordHeaderSize, ticks - 1},
+		{"inside last header", lastStart + 5, ticks - 1},
+		{"inside last payload", ends[ticks-1] - 1, ticks - 1},
+		{"record boundary", ends[4], 5},
+		{"inside middle payload", ends[4] + recordHeaderSize + 2, 5},
+		{"intact", ends[ticks-1], ticks},
+	}
+	for _, cut := range cuts {
+		t.Run(cut.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := openTestSegmentStore(t, dir, segmentStoreOptions{})
+			writeSegmentTicks(t, store, 0, ticks)
+			crashSegmentStore(t, store)
+
+			path := singleSegmentPath(t, dir)
+			if err := os.Truncate(path, cut.offset); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened := openTestSegmentStore(t, dir, segmentStoreOptions{})
+			assertSegmentPrefix(t, reopened, cut.intact)
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := int64(0)
+			if cut.intact > 0 {
+				want = ends[cut.intact-1]
+			}
+			if info.Size() != want {
+				t.Fatalf("segment truncated to %d bytes, want %d", info.Size(), want)
+			}
+
+			// Запись продолжается сразу за уцелевшими записями
+			writeSegmentTicks(t, reopened, cut.intact, 3)
+			assertSegmentPrefix(t, reopened, cut.intact+3)
+		})
+	}
+}
+
+// Поврежденная запись отрезается вместе со всеми следующими
+func TestSegmentStoreDropsCorruptedRecords(t *testing.T) {
+	const ticks = 10
+	recordStart := func(i int) int64 {
+		offset := int64(0)
+		for j := 0; j < i; j++ {
+			offset += segmentRecordSize(int64(segmentTestStart + j))
+		}
+		return offset
+	}
+
+	corruptions := []struct {
+		name   string
+		offset int64
+		intact int
+	}{
+		{"payload of the first record", recordHeaderSize + 3, 0},
+		{"payload of a middle record", recordStart(6) + recordHeaderSize + 10, 6},
+		{"checksum of a middle record", recordStart(3) + 5, 3},
+		{"length of a middle record", recordStart(8), 8},
+		{"last byte of the last record", recordStart(ticks) - 1, ticks - 1},
+	}
+	for _, corruption := range corruptions {
+		t.Run(corruption.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := openTestSegmentStore(t, dir, segmentStoreOptions{})
+			writeSegmentTicks(t, store, 0, ticks)
+			crashSegmentStore(t, store)
+
+			path := singleSegmentPath(t, dir)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[corruption.offset] ^= 0xff
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened := openTestSegmentStore(t, dir, segmentStoreOptions{})
+			assertSegmentPrefix(t, reopened, corruption.intact)
+			if info, _ := os.Stat(path); info.Size() != recordStart(corruption.intact) {
+				t.Fatalf("segment truncated to %d bytes, want %d", info.Size(), recordStart(corruption.intact))
+			}
+		})
+	}
+}
+
+// Индекс, не соответствующий сегменту, не используется: сегмент проверяется заново,
+// а для закрытых сегментов индекс переписывается
+func TestSegmentStoreIgnoresStaleIndex(t *testing.T) {
+	const ticks = 200 // Несколько точек индекса
+	recordSize := segmentRecordSize(segmentTestStart)
+
+	staleIndexes := []struct {
+		name   string
+		stale  func(t *testing.T, segmentPath string)
+		intact int
+	}{
+		{"segment grew after indexing", func(t *testing.T, segmentPath string) {
+			// Индекс от первых 100 записей при полном сегменте
+			data, err := os.ReadFile(segmentPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seg, err := recoverSegmentFromBytes(t, data[:100*recordSize])
+			if err != nil {
+				t.Fatal(err)
+			}
+			seg.path = segmentPath
+			if err := writeIndex(seg); err != nil {
+				t.Fatal(err)
+			}
+		}, ticks},
+		{"segment torn after indexing", func(t *testing.T, segmentPath string) {
+			if err := os.Truncate(segmentPath, 150*recordSize+3); err != nil {
+				t.Fatal(err)
+			}
+		}, 150},
+		{"index checksum mismatch", func(t *testing.T, segmentPath string) {
+			flipByte(t, indexPath(segmentPath), len(indexMagic)+20)
+		}, ticks},
+		{"unknown index magic", func(t *testing.T, segmentPath string) {
+			flipByte(t, indexPath(segmentPath), 0)
+		}, ticks},
+		{"truncated index", func(t *testing.T, segmentPath string) {
+			if err := os.Truncate(indexPath(segmentPath), int64(len(indexMagic)+8)); err != nil {
+				t.Fatal(err)
+			}
+		}, ticks},
+	}
+	for _, stale := range staleIndexes {
+		t.Run(stale.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := openTestSegmentStore(t, dir, segmentStoreOptions{})
+			writeSegmentTicks(t, store, 0, ticks)
+			// Закрытие запечатывает сегмент, второй сегмент делает его не последним
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+			path := singleSegmentPath(t, dir)
+			if _, err := os.Stat(indexPath(path)); err != nil {
+				t.Fatalf("sealed segment has no index: %v", err)
+			}
+			next := openTestSegmentStore(t, dir, segmentStoreOptions{})
+			writeSegmentTicks(t, next, ticks, 1)
+			if err := next.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			stale.stale(t, path)
+
+			reopened := openTestSegmentStore(t, dir, segmentStoreOptions{})
+			if n := countSegmentTicks(t, reopened, segmentTestStart, segmentTestStart+ticks); n != stale.intact {
+				t.Fatalf("expected %d ticks in the first segment, got %d", stale.intact, n)
+			}
+
+			// Индекс переписан и теперь соответствует сегменту
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seg, err := readIndex(1, path, info.Size())
+			if err != nil {
+				t.Fatalf("index was not rebuilt: %v", err)
+			}
+			if seg.count != stale.intact {
+				t.Fatalf("rebuilt index has %d records, want %d", seg.count, stale.intact)
+			}
+
+			// Поиск по индексу находит тики с середины сегмента
+			if n := countSegmentTicks(t, reopened, segmentTestStart+100, segmentTestStart+110); n != 10 {
+				t.Fatalf("expected 10 ticks from the middle of the segment, got %d", n)
+			}
+		})
+	}
+}
+
+// Сегмент в памяти для построения индекса по части записей
+func recoverSegmentFromBytes(t *testing.T, data []byte) (*segment, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "00000001"+segmentExt)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return nil, err
+	}
+	return recoverSegment(1, path)
+}
+
+func flipByte(t *testing.T, path string, offset int) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countSegmentTicks(t *testing.T, store *segmentStore, from, to int64) int {
+	t.Helper()
+	n := 0
+	err := store.Range(from, to, func(metrics MetricsData) bool {
+		if metrics.Timestamp != from+int64(n) {
+			t.Fatalf("tick %d has timestamp %d", n, metrics.Timestamp)
+		}
+		n++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// Удаление по сроку хранения затрагивает только закрытые сегменты целиком старше границы
+func TestSegmentStoreDeleteBeforeAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+	const perSegment = 10
+	options := segmentStoreOptions{SegmentMaxBytes: perSegment * segmentRecordSize(segmentTestStart)}
+	store := openTestSegmentStore(t, dir, options)
+	writeSegmentTicks(t, store, 0, 5*perSegment+3) // Пять закрытых сегментов и активный
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(segments) != 6 {
+		t.Fatalf("expected 6 segments, got %d", len(segments))
+	}
+
+	// Граница внутри третьего сегмента: удаляются первые два
+	if err := store.DeleteBefore(segmentTestStart + 2*perSegment + 4); err != nil {
+		t.Fatal(err)
+	}
+	if first, _, _ := store.Bounds(); first != segmentTestStart+2*perSegment {
+		t.Fatalf("first tick after eviction %d", first-segmentTestStart)
+	}
+	if n := countSegmentTicks(t, store, segmentTestStart+2*perSegment, segmentTestStart+1000); n != 3*perSegment+3 {
+		t.Fatalf("expected %d ticks after eviction, got %d", 3*perSegment+3, n)
+	}
+	for _, path := range segments[:2] {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("segment %s was not removed", path)
+		}
+		if _, err := os.Stat(indexPath(path)); !os.IsNotExist(err) {
+			t.Fatalf("index of segment %s was not removed", path)
+		}
+	}
+
+	// Граница на стыке сегментов удаляет сегмент, последний тик которого перед ней
+	if err := store.DeleteBefore(segmentTestStart + 3*perSegment); err != nil {
+		t.Fatal(err)
+	}
+	if first, _, _ := store.Bounds(); first != segmentTestStart+3*perSegment {
+		t.Fatalf("first tick after eviction at a boundary %d", first-segmentTestStart)
+	}
+
+	// Активный сегмент не удаляется, даже если все его тики старше границы
+	if err := store.DeleteBefore(segmentTestStart + 1000); err != nil {
+		t.Fatal(err)
+	}
+	if n := countSegmentTicks(t, store, segmentTestStart+5*perSegment, segmentTestStart+1000); n != 3 {
+		t.Fatalf("active segment lost ticks: %d left", n)
+	}
+
+	// После перезапуска номера удаленных сегментов не переиспользуются
+	crashSegmentStore(t, store)
+	reopened := openTestSegmentStore(t, dir, options)
+	if n := countSegmentTicks(t, reopened, segmentTestStart+5*perSegment, segmentTestStart+1000); n != 3 {
+		t.Fatalf("expected 3 ticks after reopening, got %d", n)
+	}
+	writeSegmentTicks(t, reopened, 5*perSegment+3, 2*perSegment)
+	if last := reopened.segments[len(reopened.segments)-1]; last.id <= 6 {
+		t.Fatalf("new segment reused id %d", last.id)
+	}
+	if n := countSegmentTicks(t, reopened, segmentTestStart+5*perSegment, segmentTestStart+1000); n != 2*perSegment+3 {
+		t.Fatalf("expected %d ticks, got %d", 2*perSegment+3, n)
+	}
+}
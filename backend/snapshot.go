@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const generatorSnapshotVersion = 1
+
+// Снимок полного состояния генератора. Восстановленный генератор отдает те же текущие
+// метрики и историю и продолжает ту же случайную последовательность, поэтому дашборд
+// можно воспроизвести на разборе инцидента или перенести между перезапусками без базы
+type GeneratorSnapshot struct {
+	Version         int                `json:"version"`
+	CreatedAt       time.Time          `json:"createdAt"`
+	BaseDataTime    time.Time          `json:"baseDataTime"`
+	CurrentDataTime time.Time          `json:"currentDataTime"`
+	LastMetrics     MetricsData        `json:"lastMetrics"` // Без historicalData: она совпадает с historical
+	LastLatency     *LatencySketch     `json:"lastLatencySketch,omitempty"`
+	Trends          map[string]float64 `json:"trends"`
+	Historical      HistoricalData     `json:"historical"`
+	Rollups         snapshotRollups    `json:"rollups"` // Сводки открытых периодов продолжают накапливаться после восстановления
+	RNG             [4]uint64          `json:"rng"`
+}
+
+type snapshotRollups struct {
+	Hourly map[int64]*Rollup `json:"hourly"`
+	Daily  map[int64]*Rollup `json:"daily"`
+	Weekly map[int64]*Rollup `json:"weekly"`
+}
+
+// Сериализация состояния генератора. Выполняется под блокировкой, чтобы снимок не разошелся с тиком
+func (dg *CoherentDataGenerator) MarshalSnapshot() ([]byte, error) {
+	dg.mu.Lock()
+	defer dg.mu.Unlock()
+
+	snapshot := GeneratorSnapshot{
+		Version:         generatorSnapshotVersion,
+		CreatedAt:       time.Now(),
+		BaseDataTime:    dg.baseDataTime,
+		CurrentDataTime: dg.currentDataTime,
+		LastMetrics:     dg.lastMetrics,
+		LastLatency:     dg.lastMetrics.LatencySketch,
+		Trends:          dg.trends,
+		Historical: HistoricalData{
+			Hourly: dg.historicalHourly,
+			Daily:  dg.historicalDaily,
+			Weekly: dg.historicalWeekly,
+		},
+		Rollups: snapshotRollups{
+			Hourly: dg.rollups.hourly,
+			Daily:  dg.rollups.daily,
+			Weekly: dg.rollups.weekly,
+		},
+		RNG: dg.source.State(),
+	}
+	snapshot.LastMetrics.HistoricalData = HistoricalData{}
+	return json.Marshal(snapshot)
+}
+
+// Восстановление состояния генератора из снимка
+func (dg *CoherentDataGenerator) RestoreSnapshot(data []byte) error {
+	var snapshot GeneratorSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("decoding snapshot: %w", err)
+	}
+	if snapshot.Version != generatorSnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+
+	rollups := historyRollups{
+		hourly: nonNilRollups(snapshot.Rollups.Hourly),
+		daily:  nonNilRollups(snapshot.Rollups.Daily),
+		weekly: nonNilRollups(snapshot.Rollups.Weekly),
+	}
+	history := HistoricalData{
+		Hourly: nonNilHistory(snapshot.Historical.Hourly),
+		Daily:  nonNilHistory(snapshot.Historical.Daily),
+		Weekly: nonNilHistory(snapshot.Historical.Weekly),
+	}
+
+	dg.mu.Lock()
+	defer dg.mu.Unlock()
+
+	if !dg.source.SetState(snapshot.RNG) {
+		return fmt.Errorf("invalid RNG state in snapshot")
+	}
+	dg.baseDataTime = snapshot.BaseDataTime
+	dg.currentDataTime = snapshot.CurrentDataTime
+	dg.trends = make(map[string]float64, len(snapshot.Trends))
+	for name, trend := range snapshot.Trends {
+		dg.trends[name] = trend
+	}
+	dg.rollups = rollups
+	dg.historicalHourly = history.Hourly
+	dg.historicalDaily = history.Daily
+	dg.historicalWeekly = history.Weekly
+
+	dg.lastMetrics = snapshot.LastMetrics
+	dg.lastMetrics.LatencySketch = snapshot.LastLatency
+	dg.lastMetrics.HistoricalData = HistoricalData{
+		Hourly: copyHistory(history.Hourly),
+		Daily:  copyHistory(history.Daily),
+		Weekly: copyHistory(history.Weekly),
+	}
+	return nil
+}
+
+func nonNilRollups(periods map[int64]*Rollup) map[int64]*Rollup {
+	if periods == nil {
+		return make(map[int64]*Rollup)
+	}
+	return periods
+}
+
+// Запись снимка в файл. Пишем во временный файл и переименовываем, чтобы снимок,
+// прерванный остановкой, не затер предыдущий
+func (dg *CoherentDataGenerator) SaveSnapshot(path string) error {
+	data, err := dg.MarshalSnapshot()
+	if err != nil {
+		return fmt.Errorf("encoding snapshot: %w", err)
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("writing snapshot %s: %w", path, err)
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("writing snapshot %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("writing snapshot %s: %w", path, err)
+	}
+	return nil
+}
+
+// Загрузка снимка из файла
+func (dg *CoherentDataGenerator) LoadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := dg.RestoreSnapshot(data); err != nil {
+		return fmt.Errorf("restoring snapshot %s: %w", path, err)
+	}
+	return nil
+}
+
+// Сохранение снимка по запросу администратора. Файл создается в GENERATOR_SNAPSHOT_DIR,
+// имя задается сервером, чтобы запрос не мог записать произвольный путь
+func handleSaveSnapshot(c *gin.Context) {
+	if generator == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Generator is not running, snapshots require METRICS_SOURCE=synthetic"})
+		return
+	}
+
+	dir := getEnv("GENERATOR_SNAPSHOT_DIR", "data/snapshots")
+	createdAt := time.Now()
+	path := filepath.Join(dir, fmt.Sprintf("generator-%s.json", createdAt.UTC().Format("20060102T150405Z")))
+
+	if err := generator.SaveSnapshot(path); err != nil {
+		log.Printf("Error saving generator snapshot: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save snapshot"})
+		return
+	}
+	log.Printf("Generator snapshot saved to %s", path)
+	c.JSON(http.StatusOK, gin.H{
+		"path":      path,
+		"createdAt": createdAt.Unix(),
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// Генератор с заданным seed в виртуальном времени: тики зависят только от его состояния,
+// а не от того, когда их сгенерировали
+func newSnapshotTestGenerator(seed int64) *CoherentDataGenerator {
+	generator := NewCoherentDataGenerator(nil)
+	generator.source = newGeneratorSource(seed)
+	generator.rng = rand.New(generator.source)
+	generator.currentDataTime = generator.baseDataTime.Add(36 * time.Hour)
+	return generator
+}
+
+// Сериализованные тики и состояние генератора после них
+func generateSnapshotTicks(t *testing.T, generator *CoherentDataGenerator, n int) ([]byte, []byte) {
+	t.Helper()
+	var ticks bytes.Buffer
+	for i := 0; i < n; i++ {
+		metrics := generator.GenerateMetrics()
+		data, err := json.Marshal(struct {
+			Metrics MetricsData    `json:"metrics"`
+			Latency *LatencySketch `json:"latency"`
+		}{metrics, metrics.LatencySketch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ticks.Write(data)
+		ticks.WriteByte('\n')
+	}
+
+	generator.mu.Lock()
+	defer generator.mu.Unlock()
+	state, err := json.Marshal(struct {
+		LastMetrics  MetricsData        `json:"lastMetrics"`
+		LastLatency  *LatencySketch     `json:"lastLatency"`
+		Trends       map[string]float64 `json:"trends"`
+		Historical   HistoricalData     `json:"historical"`
+		Rollups      snapshotRollups    `json:"rollups"`
+		BaseDataTime time.Time          `json:"baseDataTime"`
+		RNG          [4]uint64          `json:"rng"`
+	}{
+		LastMetrics:  generator.lastMetrics,
+		LastLatency:  generator.lastMetrics.LatencySketch,
+		Trends:       generator.trends,
+		Historical:   HistoricalData{Hourly: generator.historicalHourly, Daily: generator.historicalDaily, Weekly: generator.historicalWeekly},
+		Rollups:      snapshotRollups{Hourly: generator.rollups.hourly, Daily: generator.rollups.daily, Weekly: generator.rollups.weekly},
+		BaseDataTime: generator.baseDataTime,
+		RNG:          generator.source.State(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ticks.Bytes(), state
+}
+
+// После восстановления снимка генератор повторяет те же тики и приходит в то же состояние
+// байт в байт - и сам, и новый генератор с другим seed
+func TestSnapshotRestoreReplaysTicks(t *testing.T) {
+	const n = 50
+	generator := newSnapshotTestGenerator(1)
+	generateSnapshotTicks(t, generator, n)
+
+	snapshot, err := generator.MarshalSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTicks, wantState := generateSnapshotTicks(t, generator, n)
+
+	targets := map[string]*CoherentDataGenerator{
+		"same generator":  generator,
+		"fresh generator": newSnapshotTestGenerator(2),
+	}
+	for name, target := range targets {
+		if err := target.RestoreSnapshot(snapshot); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		ticks, state := generateSnapshotTicks(t, target, n)
+		if !bytes.Equal(ticks, wantTicks) {
+			t.Fatalf("%s: ticks after restore differ from ticks after the snapshot", name)
+		}
+		if !bytes.Equal(state, wantState) {
+			t.Fatalf("%s: state after restore differs:\n%s\nwant:\n%s", name, state, wantState)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Источник метрик для рассылки. Next вызывается раз в тик и возвращает метрики тика вместе
+// с историей источника; Backfill заполняет пустое хранилище прошлыми данными при первом запуске
+type MetricsSource interface {
+	Name() string
+	Start(ctx context.Context) error
+	Stop() error
+	Next(now time.Time) MetricsData
+	Current() MetricsData
+	Backfill(now time.Time) error
+}
+
+// Источник, который ведет собственную историю. За MergedSource история строится по
+// объединенным тикам, поэтому собственная история источника отключается до запуска
+type historyKeeper interface {
+	disableHistory()
+}
+
+var metricsSourceNames = []string{"synthetic", "ingest", "statsd", "remote_write", "replay"}
+
+// Несколько источников за одним: метрики тика объединяются, история строится по объединенным тикам
+type MergedSource struct {
+	mu      sync.Mutex
+	sources []MetricsSource
+	store   *TieredStore
+	history *historyTracker
+	last    MetricsData
+}
+
+func NewMergedSource(store *TieredStore, sources ...MetricsSource) *MergedSource {
+	for _, source := range sources {
+		if keeper, ok := source.(historyKeeper); ok {
+			keeper.disableHistory()
+		}
+	}
+	return &MergedSource{
+		sources: sources,
+		store:   store,
+		history: &historyTracker{rollups: newHistoryRollups()},
+	}
+}
+
+func (m *MergedSource) Name() string {
+	names := make([]string, len(m.sources))
+	for i, source := range m.sources {
+		names[i] = source.Name()
+	}
+	return strings.Join(names, "+")
+}
+
+// Запуск всех источников. Если один не запустился, уже запущенные останавливаются
+func (m *MergedSource) Start(ctx context.Context) error {
+	for i, source := range m.sources {
+		if err := source.Start(ctx); err != nil {
+			for _, started := range m.sources[:i] {
+				started.Stop()
+			}
+			return fmt.Errorf("starting %s source: %w", source.Name(), err)
+		}
+	}
+
+	history := loadHistoryTracker(m.store, time.Now())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.history = history
+	return nil
+}
+
+func (m *MergedSource) Stop() error {
+	var firstErr error
+	for _, source := range m.sources {
+		if err := source.Stop(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("stopping %s source: %w", source.Name(), err)
+		}
+	}
+	return firstErr
+}
+
+func (m *MergedSource) Next(now time.Time) MetricsData {
+	parts := make([]MetricsData, len(m.sources))
+	for i, source := range m.sources {
+		parts[i] = source.Next(now)
+	}
+	metrics := mergeMetrics(now, parts)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.history.add(&metrics)
+	m.last = metrics
+	return metrics
+}
+
+func (m *MergedSource) Current() MetricsData {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last
+}
+
+func (m *MergedSource) Backfill(now time.Time) error {
+	for _, source := range m.sources {
+		if err := source.Backfill(now); err != nil {
+			return fmt.Errorf("backfilling %s source: %w", source.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Объединение метрик источников за один тик. Пользователи, запросы, продажи и ошибки
+// складываются, время ответа и доля ошибок взвешиваются по числу запросов, конверсия - по
+// числу пользователей, нагрузка усредняется. Перцентили считаются по объединенному скетчу
+func mergeMetrics(now time.Time, parts []MetricsData) MetricsData {
+	result := MetricsData{
+		Timestamp:    now.Unix(),
+		ErrorsByType: make(map[string]int),
+		RegionalData: make(map[string]Region),
+		SourcesData:  make(map[string]int),
+	}
+
+	var responseTime, weightedResponseTime, errorRate, weightedErrorRate float64
+	var conversion, weightedConversion, load float64
+	regionConversion := make(map[string]float64)
+	var sketch *LatencySketch
+	var latency LatencyPercentiles
+	for _, part := range parts {
+		result.ActiveUsers += part.ActiveUsers
+		result.RequestsPerSecond += part.RequestsPerSecond
+		result.Sales += part.Sales
+		result.DatabaseConnections += part.DatabaseConnections
+
+		responseTime += part.ResponseTimeMs
+		weightedResponseTime += part.ResponseTimeMs * part.RequestsPerSecond
+		errorRate += part.ErrorRate
+		weightedErrorRate += part.ErrorRate * part.RequestsPerSecond
+		conversion += part.ConversionRate
+		weightedConversion += part.ConversionRate * float64(part.ActiveUsers)
+		load += part.ServerLoad
+
+		for errType, count := range part.ErrorsByType {
+			result.ErrorsByType[errType] += count
+		}
+		for source, users := range part.SourcesData {
+			result.SourcesData[source] += users
+		}
+		for name, region := range part.RegionalData {
+			merged := result.RegionalData[name]
+			merged.ActiveUsers += region.ActiveUsers
+			merged.Sales += region.Sales
+			result.RegionalData[name] = merged
+			regionConversion[name] += region.ConversionRate * float64(region.ActiveUsers)
+		}
+
+		funnel := &result.ConversionFunnel
+		funnel.Visitors += part.ConversionFunnel.Visitors
+		funnel.ProductViews += part.ConversionFunnel.ProductViews
+		funnel.AddedToCart += part.ConversionFunnel.AddedToCart
+		funnel.BeganCheckout += part.ConversionFunnel.BeganCheckout
+		funnel.PurchasedItems += part.ConversionFunnel.PurchasedItems
+
+		if part.LatencySketch != nil {
+			if sketch == nil {
+				sketch = &LatencySketch{}
+			}
+			sketch.Merge(part.LatencySketch)
+		}
+		latency.P50 += part.Latency.P50 * part.RequestsPerSecond
+		latency.P90 += part.Latency.P90 * part.RequestsPerSecond
+		latency.P95 += part.Latency.P95 * part.RequestsPerSecond
+		latency.P99 += part.Latency.P99 * part.RequestsPerSecond
+	}
+	if len(parts) == 0 {
+		return result
+	}
+
+	n := float64(len(parts))
+	result.ResponseTimeMs = weightedMean(weightedResponseTime, result.RequestsPerSecond, responseTime/n)
+	result.ErrorRate = weightedMean(weightedErrorRate, result.RequestsPerSecond, errorRate/n)
+	result.ConversionRate = weightedMean(weightedConversion, float64(result.ActiveUsers), conversion/n)
+	result.ServerLoad = load / n
+	for name, region := range result.RegionalData {
+		region.ConversionRate = weightedMean(regionConversion[name], float64(region.ActiveUsers), 0)
+		result.RegionalData[name] = region
+	}
+	if sketch != nil {
+		result.LatencySketch = sketch
+		result.Latency = sketch.Percentiles()
+	} else if result.RequestsPerSecond > 0 {
+		// Без скетчей (например, при воспроизведении записи) перцентили приближаются средним по запросам
+		rps := result.RequestsPerSecond
+		result.Latency = LatencyPercentiles{P50: latency.P50 / rps, P90: latency.P90 / rps, P95: latency.P95 / rps, P99: latency.P99 / rps}
+	}
+	return result
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// За MergedSource история строится один раз по объединенным тикам: генератор и прием
+// свою не ведут и историю в метрики тика не кладут
+func TestMergedSourceKeepsSingleHistory(t *testing.T) {
+	store := newTestTieredStore(t)
+	generator := NewCoherentDataGenerator(store)
+	generator.source = newGeneratorSource(1)
+	generator.rng = rand.New(generator.source)
+	ingest := NewIngestAggregator(store, IngestConfig{MaxLabelValues: 10, GaugeTTL: time.Minute})
+
+	merged := NewMergedSource(store, generator, ingest)
+	if err := merged.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer merged.Stop()
+
+	now := time.Now()
+	var metrics MetricsData
+	for i := 0; i < 3; i++ {
+		if part := generator.Next(now); len(part.HistoricalData.Hourly) != 0 {
+			t.Fatal("generator behind MergedSource attaches its own history")
+		}
+		metrics = merged.Next(now)
+	}
+
+	if len(generator.historicalHourly) != 0 || len(generator.rollups.hourly) != 0 {
+		t.Fatalf("generator keeps its own history: %d hours, %d rollups", len(generator.historicalHourly), len(generator.rollups.hourly))
+	}
+	if ingest.history != nil {
+		t.Fatal("ingest behind MergedSource keeps its own history")
+	}
+	if len(metrics.HistoricalData.Hourly) != 1 || len(metrics.HistoricalData.Daily) != 1 {
+		t.Fatalf("merged history: %d hours, %d days", len(metrics.HistoricalData.Hourly), len(metrics.HistoricalData.Daily))
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+// Обработчик Server-Sent Events - запасной транспорт для сетей, где прокси режут WebSocket.
+// Поток тот же, что и у /ws: параметры ?topics=, ?mode=delta и ?interval=, продолжение после
+// переподключения по заголовку Last-Event-ID (или параметру ?lastEventId=)
+func handleSSE(c *gin.Context) {
+	if rejectWhileDraining(c) {
+		return
+	}
+
+	topics, err := initialTopics(c.Query("topics"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "validTopics": validTopicNames()})
+		return
+	}
+
+	delta, err := parseFrameMode(c.Query("mode"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	interval, err := parseInterval(c.Query("interval"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "validIntervals": validIntervalNames()})
+		return
+	}
+
+	// EventSource сам присылает Last-Event-ID при переподключении
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+
+	options := ClientOptions{Topics: topics, Delta: delta, Format: FormatJSON, Interval: interval}
+
+	var client *Client
+	if lastEventID != "" {
+		since, err := parseStreamPosition(lastEventID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Last-Event-ID"})
+			return
+		}
+		client = hub.Resume(options, since)
+	} else {
+		client = hub.Register(options)
+	}
+	defer hub.Unregister(client)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // Отключаем буферизацию в nginx
+
+	client.streamSSE(c)
+}
+
+// Запись кадров клиента в поток SSE до отключения клиента или завершения работы сервера
+func (c *Client) streamSSE(ctx *gin.Context) {
+	backlog := c.backlog
+	c.backlog = nil
+
+	// По истечении времени жизни поток завершается, EventSource переподключится с Last-Event-ID
+	expired, stopLifetime := c.hub.lifetimeTimer()
+	defer stopLifetime()
+
+	// Комментарии-пинги с интервалом ping WebSocket: без них прокси закрывают поток,
+	// в котором долго нет событий, например на длинных интервалах тиков
+	keepalive := time.NewTicker(c.hub.config.PingInterval)
+	defer keepalive.Stop()
+
+	ctx.Stream(func(w io.Writer) bool {
+		if len(backlog) > 0 {
+			frame := backlog[0]
+			backlog = backlog[1:]
+			return c.writeEvent(ctx, frame)
+		}
+
+		select {
+		case frame := <-c.send:
+			return c.writeEvent(ctx, frame)
+		case <-keepalive.C:
+			// Stream сбрасывает буфер после каждого шага
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return false
+			}
+			return true
+		case <-expired:
+			c.expire()
+			return false
+		case <-c.done:
+			c.writeCloseEvent(ctx)
+			return false
+		case <-ctx.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// Завершающее событие close с причиной закрытия, аналог close-фрейма WebSocket.
+// Поле retry подсказывает EventSource переподключиться без задержки
+func (c *Client) writeCloseEvent(ctx *gin.Context) {
+	if c.closeText == "" {
+		return
+	}
+	if err := sse.Encode(ctx.Writer, sse.Event{
+		Event: "close",
+		Retry: 1000,
+		Data:  c.closeText,
+	}); err != nil {
+		return
+	}
+	c.markClean()
+}
+
+// Запись одного кадра событием SSE с позицией кадра в поле id
+func (c *Client) writeEvent(ctx *gin.Context, frame *Frame) bool {
+	data, err := c.encode(frame)
+	if err != nil {
+		log.Printf("Error encoding metrics frame %d: %v", frame.Seq, err)
+		return true
+	}
+
+	if err := sse.Encode(ctx.Writer, sse.Event{
+		Id:   frame.Position().String(),
+		Data: string(data),
+	}); err != nil {
+		log.Printf("Error sending SSE metrics: %v", err)
+		return false
+	}
+	atomic.AddUint64(&c.hub.framesSent, 1)
+	return true
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Поток без кадров получает keepalive-комментарии с интервалом ping, кадры идут между ними
+func TestSSEKeepalive(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	hub := newTestHub(t, HubConfig{})
+	hub.config.PingInterval = 20 * time.Millisecond
+	client := hub.Register(ClientOptions{Topics: TopicKPI, Format: FormatJSON})
+
+	router := gin.New()
+	router.GET("/sse", func(c *gin.Context) {
+		client.streamSSE(c)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+	defer client.Close()
+
+	resp, err := http.Get(server.URL + "/sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	next := func(prefix string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatalf("stream ended before %q", prefix)
+				}
+				if strings.HasPrefix(line, prefix) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no %q within 5s", prefix)
+			}
+		}
+	}
+
+	next(": keepalive")
+	if _, err := hub.Publish(testTick(1700000000), ""); err != nil {
+		t.Fatal(err)
+	}
+	next("id:")
+	next(": keepalive")
+}
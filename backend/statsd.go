@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Соответствие метрик StatsD метрикам приема по умолчанию
+const defaultStatsdMapping = "sales=sales,response_time=responseTime,errors=errors,active_users=activeUsers,server_load=serverLoad,db_connections=databaseConnections"
+
+// Соответствие тегов DogStatsD меткам выборок по умолчанию. service отличает серии последних значений
+const defaultStatsdTags = "region=region,source=source,type=errorType,service=service"
+
+// Типы StatsD, допустимые для метрики приема
+var statsdMetricTypes = map[string][]string{
+	IngestSales:               {"c"},
+	IngestErrors:              {"c"},
+	IngestResponseTime:        {"ms", "h", "d"},
+	IngestActiveUsers:         {"g"},
+	IngestServerLoad:          {"g"},
+	IngestDatabaseConnections: {"g"},
+}
+
+// Максимальный размер датаграммы UDP
+const maxStatsdPacketBytes = 65535
+
+// Интервал между записями в лог об ошибочных строках
+const statsdErrorLogInterval = 10 * time.Second
+
+// Строка StatsD: name:value[:value...]|type[|@rate][|#tag:value,...]
+type statsdLine struct {
+	name     string
+	values   []float64
+	kind     string
+	rate     float64
+	relative bool // Относительное изменение gauge: +N или -N
+	tags     map[string]string
+}
+
+// Разбор строки StatsD/DogStatsD. События (_e) и проверки сервисов (_sc) не являются метриками
+// и возвращаются как nil без ошибки
+func parseStatsdLine(line string) (*statsdLine, error) {
+	if strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+		return nil, nil
+	}
+
+	colon := strings.IndexByte(line, ':')
+	if colon <= 0 {
+		return nil, fmt.Errorf("missing metric name or value")
+	}
+	parsed := &statsdLine{name: line[:colon], rate: 1}
+
+	fields := strings.Split(line[colon+1:], "|")
+	if len(fields) < 2 || fields[1] == "" {
+		return nil, fmt.Errorf("missing metric type")
+	}
+	parsed.kind = fields[1]
+
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			rate, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid sample rate: %q", field)
+			}
+			parsed.rate = rate
+		case strings.HasPrefix(field, "#"):
+			parsed.tags = make(map[string]string)
+			for _, tag := range strings.Split(field[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				key, value := tag, ""
+				if i := strings.IndexByte(tag, ':'); i >= 0 {
+					key, value = tag[:i], tag[i+1:]
+				}
+				parsed.tags[key] = value
+			}
+		}
+		// Прочие расширения DogStatsD (c:, T) не влияют на значения и пропускаются
+	}
+
+	for _, raw := range strings.Split(fields[0], ":") {
+		if parsed.kind == "g" && (strings.HasPrefix(raw, "+") || strings.HasPrefix(raw, "-")) {
+			parsed.relative = true
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value: %q", raw)
+		}
+		parsed.values = append(parsed.values, value)
+	}
+	return parsed, nil
+}
+
+// Счетчики приема StatsD
+type StatsdStats struct {
+	Packets  uint64 `json:"packets"`
+	Lines    uint64 `json:"lines"`
+	Unmapped uint64 `json:"unmapped"` // Метрики без соответствия
+	Invalid  uint64 `json:"invalid"`  // Строки с ошибкой разбора или проверки
+}
+
+// Источник метрик из StatsD/DogStatsD по UDP. Строки переводятся в выборки приема по
+// соответствию имен и тегов и сворачиваются в тики тем же агрегатором, что и POST /api/ingest
+type StatsdSource struct {
+	*IngestAggregator
+	addr    string
+	metrics map[string]string // Имя StatsD -> метрика приема
+	tags    map[string]string // Тег -> поле выборки
+
+	conn net.PacketConn
+	wg   sync.WaitGroup
+
+	packets, lines, unmapped, invalid uint64
+	lastErrorLog                      time.Time
+}
+
+func NewStatsdSource(store *TieredStore, addr, metricMapping, tagMapping string, config IngestConfig) (*StatsdSource, error) {
+	metrics, err := parseNameMapping(metricMapping, ingestMetricNames())
+	if err != nil {
+		return nil, err
+	}
+	tags, err := parseNameMapping(tagMapping, ingestLabelFields)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsdSource{
+		IngestAggregator: NewIngestAggregator(store, config),
+		addr:             addr,
+		metrics:          metrics,
+		tags:             tags,
+	}, nil
+}
+
+func (s *StatsdSource) Name() string {
+	return "statsd"
+}
+
+func (s *StatsdSource) Start(ctx context.Context) error {
+	if err := s.IngestAggregator.Start(ctx); err != nil {
+		return err
+	}
+	conn, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	log.Printf("StatsD listener started on %s", conn.LocalAddr())
+
+	s.wg.Add(1)
+	go s.listen()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	return nil
+}
+
+func (s *StatsdSource) Stop() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.wg.Wait()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *StatsdSource) listen() {
+	defer s.wg.Done()
+	buf := make([]byte, maxStatsdPacketBytes)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("StatsD read error: %v", err)
+			}
+			return
+		}
+		atomic.AddUint64(&s.packets, 1)
+		s.handlePacket(string(buf[:n]), time.Now())
+	}
+}
+
+// Пакет может содержать несколько строк
+func (s *StatsdSource) handlePacket(packet string, now time.Time) {
+	for _, line := range strings.Split(packet, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		atomic.AddUint64(&s.lines, 1)
+		if err := s.handleLine(line, now); err != nil {
+			atomic.AddUint64(&s.invalid, 1)
+			s.logError(line, err)
+		}
+	}
+}
+
+func (s *StatsdSource) handleLine(line string, now time.Time) error {
+	parsed, err := parseStatsdLine(line)
+	if err != nil || parsed == nil {
+		return err
+	}
+	metric, ok := s.metrics[parsed.name]
+	if !ok {
+		atomic.AddUint64(&s.unmapped, 1)
+		return nil
+	}
+	if !containsString(statsdMetricTypes[metric], parsed.kind) {
+		return fmt.Errorf("type %q is not valid for %s, expected %s", parsed.kind, metric, strings.Join(statsdMetricTypes[metric], ", "))
+	}
+
+	labels := make(map[string]string)
+	for tag, value := range parsed.tags {
+		if field, ok := s.tags[tag]; ok {
+			labels[field] = value
+		}
+	}
+	template := ingestSampleTemplate(metric, labels)
+
+	var samples []IngestSample
+	switch parsed.kind {
+	case "c":
+		// Счетчик при выборке с частотой rate пересчитывается в полное число событий
+		total := 0.0
+		for _, value := range parsed.values {
+			total += value / parsed.rate
+		}
+		sample := template
+		sample.Value = total
+		samples = append(samples, sample)
+	case "g":
+		// Изменения со знаком складываются и применяются агрегатором к последнему значению серии
+		sample := template
+		sample.relative = parsed.relative
+		for _, v := range parsed.values {
+			if parsed.relative {
+				sample.Value += v
+			} else {
+				sample.Value = v
+			}
+		}
+		samples = append(samples, sample)
+	default:
+		// Таймер: каждое значение - время ответа, при выборке представляет 1/rate запросов
+		for _, value := range parsed.values {
+			sample := template
+			sample.Value = value
+			sample.Count = 1 / parsed.rate
+			samples = append(samples, sample)
+		}
+	}
+
+	if problems := s.Ingest(IngestBatch{Service: labels["service"], Samples: samples}, now); problems != nil {
+		return fmt.Errorf("%s", problems[0].Error)
+	}
+	return nil
+}
+
+// Ошибочные строки пишем в лог не чаще statsdErrorLogInterval, чтобы поток мусора не забил лог
+func (s *StatsdSource) logError(line string, err error) {
+	now := time.Now()
+	if now.Sub(s.lastErrorLog) < statsdErrorLogInterval {
+		return
+	}
+	s.lastErrorLog = now
+	log.Printf("Invalid StatsD line %q: %v (%d invalid lines so far)", line, err, atomic.LoadUint64(&s.invalid))
+}
+
+func (s *StatsdSource) Stats() StatsdStats {
+	return StatsdStats{
+		Packets:  atomic.LoadUint64(&s.packets),
+		Lines:    atomic.LoadUint64(&s.lines),
+		Unmapped: atomic.LoadUint64(&s.unmapped),
+		Invalid:  atomic.LoadUint64(&s.invalid),
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStatsdLine(t *testing.T) {
+	cases := []struct {
+		line    string
+		want    *statsdLine
+		invalid bool
+	}{
+		{line: "sales:1|c", want: &statsdLine{name: "sales", values: []float64{1}, kind: "c", rate: 1}},
+		{line: "sales:1|c|@0.25", want: &statsdLine{name: "sales", values: []float64{1}, kind: "c", rate: 0.25}},
+		{line: "response_time:120:80.5|ms", want: &statsdLine{name: "response_time", values: []float64{120, 80.5}, kind: "ms", rate: 1}},
+		{line: "active_users:+5|g", want: &statsdLine{name: "active_users", values: []float64{5}, kind: "g", rate: 1, relative: true}},
+		{line: "active_users:-5|g", want: &statsdLine{name: "active_users", values: []float64{-5}, kind: "g", rate: 1, relative: true}},
+		{line: "active_users:5|g", want: &statsdLine{name: "active_users", values: []float64{5}, kind: "g", rate: 1}},
+		{line: "sales:-1|c", want: &statsdLine{name: "sales", values: []float64{-1}, kind: "c", rate: 1}},
+		{
+			line: "errors:2|c|@0.5|#type:Timeout,region:Москва,canary,|c:abc|T1700000000",
+			want: &statsdLine{name: "errors", values: []float64{2}, kind: "c", rate: 0.5,
+				tags: map[string]string{"type": "Timeout", "region": "Москва", "canary": ""}},
+		},
+		{line: "_e{5,4}:title|text|#region:Москва"},
+		{line: "_sc|checkout.up|0|#region:Москва"},
+		{line: "sales", invalid: true},
+		{line: ":1|c", invalid: true},
+		{line: "sales:1", invalid: true},
+		{line: "sales:1|", invalid: true},
+		{line: "sales:1|c|@0", invalid: true},
+		{line: "sales:1|c|@1.5", invalid: true},
+		{line: "sales:1|c|@fast", invalid: true},
+		{line: "sales:one|c", invalid: true},
+		{line: "sales:1::2|c", invalid: true},
+	}
+	for _, c := range cases {
+		t.Run(c.line, func(t *testing.T) {
+			got, err := parseStatsdLine(c.line)
+			if c.invalid {
+				if err == nil {
+					t.Fatalf("accepted as %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func newTestStatsdSource(t *testing.T) *StatsdSource {
+	t.Helper()
+	source, err := NewStatsdSource(newTestTieredStore(t), "127.0.0.1:0", defaultStatsdMapping, defaultStatsdTags, IngestConfig{
+		MaxLabelValues: 10,
+		GaugeTTL:       time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Агрегатор без UDP-слушателя: строки передаются напрямую
+	if err := source.IngestAggregator.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+// Пакеты StatsD сворачиваются в метрики тика: частота выборки пересчитывается в полное число
+// событий, относительные gauge меняют последнее значение серии, теги DogStatsD становятся метками
+func TestStatsdHandlePacket(t *testing.T) {
+	cases := []struct {
+		name    string
+		packets []string
+		check   func(m MetricsData) bool
+		stats   StatsdStats // Ожидаемые Lines, Unmapped и Invalid
+	}{
+		{
+			name:    "counter sample rate",
+			packets: []string{"sales:1|c|@0.1\nsales:2|c", "sales:3:1|c|@0.5"},
+			check:   func(m MetricsData) bool { return m.Sales == 10+2+8 },
+			stats:   StatsdStats{Lines: 3},
+		},
+		{
+			name:    "timer sample rate",
+			packets: []string{"response_time:100|ms|@0.5\nresponse_time:200:400|h"},
+			check: func(m MetricsData) bool {
+				// 2 запроса по 100 мс и по одному по 200 и 400 мс
+				return m.RequestsPerSecond == 4 && m.ResponseTimeMs == 200
+			},
+			stats: StatsdStats{Lines: 2},
+		},
+		{
+			name: "relative gauges",
+			packets: []string{
+				"active_users:100|g|#region:Москва",
+				"active_users:+20|g|#region:Москва\nactive_users:-5|g|#region:Москва",
+				"active_users:+7|g|#region:Казань",
+			},
+			check: func(m MetricsData) bool {
+				return m.ActiveUsers == 122 && m.RegionalData["Москва"].ActiveUsers == 115 && m.RegionalData["Казань"].ActiveUsers == 7
+			},
+			stats: StatsdStats{Lines: 4},
+		},
+		{
+			// Строка с отклоненной меткой не меняет последнее значение серии
+			name: "rejected relative gauge",
+			packets: []string{
+				"active_users:100|g|#region:Москва",
+				"active_users:+20|g|#region:Москва,source:" + strings.Repeat("x", maxIngestLabelLength+1),
+				"server_load:+120|g",
+			},
+			check: func(m MetricsData) bool {
+				return m.ActiveUsers == 100 && len(m.SourcesData) == 0 && m.ServerLoad == 0
+			},
+			stats: StatsdStats{Lines: 3, Invalid: 2},
+		},
+		{
+			name:    "service name over the limit",
+			packets: []string{"db_connections:1|g|#service:" + strings.Repeat("x", maxIngestLabelLength+1)},
+			check:   func(m MetricsData) bool { return m.DatabaseConnections == 0 },
+			stats:   StatsdStats{Lines: 1, Invalid: 1},
+		},
+		{
+			name:    "relative gauge below zero",
+			packets: []string{"server_load:30|g", "server_load:-50|g"},
+			check:   func(m MetricsData) bool { return m.ServerLoad == 0 },
+			stats:   StatsdStats{Lines: 2},
+		},
+		{
+			name:    "relative gauge after absolute in one line",
+			packets: []string{"db_connections:10|g", "db_connections:+1:+2|g"},
+			check:   func(m MetricsData) bool { return m.DatabaseConnections == 13 },
+			stats:   StatsdStats{Lines: 2},
+		},
+		{
+			name: "DogStatsD tags",
+			packets: []string{
+				"errors:2|c|#type:Timeout,env:prod\nerrors:1|c|@0.5|#type:Server Error",
+				"sales:3|c|#region:Москва,source:ads",
+				"active_users:5|g|#source:ads,service:web\nactive_users:7|g|#source:ads,service:api",
+			},
+			check: func(m MetricsData) bool {
+				return m.ErrorsByType["Timeout"] == 2 && m.ErrorsByType["Server Error"] == 2 &&
+					m.RegionalData["Москва"].Sales == 3 && m.SourcesData["ads"] == 12
+			},
+			stats: StatsdStats{Lines: 5},
+		},
+		{
+			name:    "events and service checks",
+			packets: []string{"_e{5,4}:title|text|#region:Москва\n_sc|checkout.up|0\nsales:1|c"},
+			check:   func(m MetricsData) bool { return m.Sales == 1 },
+			stats:   StatsdStats{Lines: 3},
+		},
+		{
+			name:    "unmapped and invalid lines",
+			packets: []string{"cache_hits:5|c\nsales:1|g\nerrors:1|c\nsales:x|c\n\n  \nsales:4|c"},
+			check:   func(m MetricsData) bool { return m.Sales == 4 && len(m.ErrorsByType) == 0 },
+			// Ошибка без типа не проходит проверку приема, sales|g - недопустимый тип
+			stats: StatsdStats{Lines: 5, Unmapped: 1, Invalid: 3},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			source := newTestStatsdSource(t)
+			now := time.Unix(1700000000, 0)
+			for _, packet := range c.packets {
+				source.handlePacket(packet, now)
+			}
+
+			metrics := source.Next(now)
+			if !c.check(metrics) {
+				t.Fatalf("unexpected metrics: sales %d, errors %v, users %d, regions %v, sources %v, load %v, connections %d, rps %v, response %v",
+					metrics.Sales, metrics.ErrorsByType, metrics.ActiveUsers, metrics.RegionalData, metrics.SourcesData,
+					metrics.ServerLoad, metrics.DatabaseConnections, metrics.RequestsPerSecond, metrics.ResponseTimeMs)
+			}
+			if stats := source.Stats(); stats != c.stats {
+				t.Fatalf("stats %+v, want %+v", stats, c.stats)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// Хранилище тиков метрик. Исторические данные строятся из сохраненных тиков,
+// поэтому переживают перезапуск сервиса
+type MetricsStore interface {
+	// Запись тика. Исторические карты тика не сохраняются
+	Append(metrics MetricsData) error
+
+	// Обход тиков с from <= Timestamp < to в порядке записи.
+	// Обход прекращается, если fn вернула false
+	Range(from, to int64, fn func(metrics MetricsData) bool) error
+
+	// Метки времени самого раннего и самого позднего тика; ok=false для пустого хранилища
+	Bounds() (first, last int64, ok bool)
+
+	// Удаление тиков старше before по сроку хранения. Реализация может удалять
+	// данные крупными блоками и оставить часть старых тиков
+	DeleteBefore(before int64) error
+
+	Close() error
+}
+
+// Открытие хранилища по конфигурации: disk - сегментные файлы в каталоге dir,
+// memory - только в памяти (данные теряются при перезапуске)
+func openMetricsStore(kind, dir string, options segmentStoreOptions) (MetricsStore, error) {
+	switch kind {
+	case "disk":
+		return openSegmentStore(dir, options)
+	case "memory":
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown metrics store: %q, valid stores: disk, memory", kind)
+	}
+}
+
+// Хранилище тиков в памяти
+type memoryStore struct {
+	mu          sync.RWMutex
+	ticks       []MetricsData
+	first, last int64
+	unordered   bool // Были ли тики с убывающим временем
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{}
+}
+
+func (s *memoryStore) Append(metrics MetricsData) error {
+	metrics.HistoricalData = HistoricalData{}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.ticks) == 0 || metrics.Timestamp < s.first {
+		s.first = metrics.Timestamp
+	}
+	if len(s.ticks) > 0 && metrics.Timestamp < s.last {
+		s.unordered = true
+	}
+	if len(s.ticks) == 0 || metrics.Timestamp > s.last {
+		s.last = metrics.Timestamp
+	}
+	s.ticks = append(s.ticks, metrics)
+	return nil
+}
+
+func (s *memoryStore) Range(from, to int64, fn func(metrics MetricsData) bool) error {
+	s.mu.RLock()
+	ticks, unordered := s.ticks, s.unordered
+	s.mu.RUnlock()
+
+	// Пока тики шли по возрастанию времени, начало диапазона находим бинарным поиском
+	start := 0
+	if !unordered {
+		start = sort.Search(len(ticks), func(i int) bool { return ticks[i].Timestamp >= from })
+	}
+
+	for _, metrics := range ticks[start:] {
+		if metrics.Timestamp < from || metrics.Timestamp >= to {
+			continue
+		}
+		if !fn(metrics) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Bounds() (int64, int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.first, s.last, len(s.ticks) > 0
+}
+
+func (s *memoryStore) DeleteBefore(before int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Новый срез: Range может продолжать читать старый
+	kept := make([]MetricsData, 0, len(s.ticks))
+	for _, metrics := range s.ticks {
+		if metrics.Timestamp >= before {
+			kept = append(kept, metrics)
+		}
+	}
+	s.ticks = kept
+	if len(kept) > 0 && s.first < before {
+		s.first = kept[0].Timestamp
+		for _, metrics := range kept {
+			if metrics.Timestamp < s.first {
+				s.first = metrics.Timestamp
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// Запись тика с логированием ошибки: сбой хранилища не должен останавливать рассылку
+func storeTick(store MetricsStore, metrics MetricsData) {
+	if err := store.Append(metrics); err != nil {
+		log.Printf("Error storing metrics tick: %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Компактное бинарное представление тика для хранилища. Исторические карты
+// не сохраняются: они строятся из самих тиков. Поля идут в фиксированном порядке,
+// целые числа кодируются varint, дробные - 8 байт IEEE 754, карты - числом
+// записей и парами ключ/значение с ключами по возрастанию. Версия 2 добавляет
+// в конец пик пользователей сводки, версия 3 - скетч времени ответа; записи
+// прежних версий читаются без них
+const tickCodecVersion = 3
+
+var errTruncatedTick = errors.New("truncated tick record")
+
+func encodeTick(buf []byte, m *MetricsData) []byte {
+	buf = append(buf, tickCodecVersion)
+	buf = appendVarint(buf, m.Timestamp)
+	buf = appendVarint(buf, int64(m.ActiveUsers))
+	buf = appendFloat(buf, m.RequestsPerSecond)
+	buf = appendFloat(buf, m.ResponseTimeMs)
+	buf = appendFloat(buf, m.ConversionRate)
+	buf = appendVarint(buf, int64(m.Sales))
+	buf = appendFloat(buf, m.ErrorRate)
+	buf = appendFloat(buf, m.ServerLoad)
+	buf = appendVarint(buf, int64(m.DatabaseConnections))
+	buf = appendIntMap(buf, m.ErrorsByType)
+	buf = appendIntMap(buf, m.SourcesData)
+
+	names := make([]string, 0, len(m.RegionalData))
+	for name := range m.RegionalData {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf = appendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		region := m.RegionalData[name]
+		buf = appendString(buf, name)
+		buf = appendVarint(buf, int64(region.ActiveUsers))
+		buf = appendVarint(buf, int64(region.Sales))
+		buf = appendFloat(buf, region.ConversionRate)
+	}
+
+	f := m.ConversionFunnel
+	for _, v := range []int{f.Visitors, f.ProductViews, f.AddedToCart, f.BeganCheckout, f.PurchasedItems} {
+		buf = appendVarint(buf, int64(v))
+	}
+
+	buf = appendVarint(buf, int64(m.PeakActiveUsers))
+
+	// Скетч: нулевая корзина и непустые корзины парами (шаг индекса, счетчик)
+	sketch := m.LatencySketch
+	if sketch == nil {
+		sketch = &LatencySketch{}
+	}
+	buf = appendFloat(buf, sketch.Zero)
+	nonEmpty := 0
+	for _, count := range sketch.Counts {
+		if count != 0 {
+			nonEmpty++
+		}
+	}
+	buf = appendUvarint(buf, uint64(nonEmpty))
+	prev := int64(0)
+	for i, count := range sketch.Counts {
+		if count == 0 {
+			continue
+		}
+		index := int64(sketch.Offset) + int64(i)
+		buf = appendVarint(buf, index-prev)
+		buf = appendFloat(buf, count)
+		prev = index
+	}
+	return buf
+}
+
+func decodeTick(data []byte) (MetricsData, error) {
+	var m MetricsData
+	d := tickDecoder{data: data}
+
+	version := d.byte()
+	if d.err == nil && (version < 1 || version > tickCodecVersion) {
+		return m, fmt.Errorf("unsupported tick codec version: %d", version)
+	}
+
+	m.Timestamp = d.varint()
+	m.ActiveUsers = int(d.varint())
+	m.RequestsPerSecond = d.float()
+	m.ResponseTimeMs = d.float()
+	m.ConversionRate = d.float()
+	m.Sales = int(d.varint())
+	m.ErrorRate = d.float()
+	m.ServerLoad = d.float()
+	m.DatabaseConnections = int(d.varint())
+	m.ErrorsByType = d.intMap()
+	m.SourcesData = d.intMap()
+
+	count := d.length()
+	m.RegionalData = make(map[string]Region, count)
+	for i := 0; i < count && d.err == nil; i++ {
+		name := d.string()
+		m.RegionalData[name] = Region{
+			ActiveUsers:    int(d.varint()),
+			Sales:          int(d.varint()),
+			ConversionRate: d.float(),
+		}
+	}
+
+	m.ConversionFunnel = ConversionFunnel{
+		Visitors:       int(d.varint()),
+		ProductViews:   int(d.varint()),
+		AddedToCart:    int(d.varint()),
+		BeganCheckout:  int(d.varint()),
+		PurchasedItems: int(d.varint()),
+	}
+	if version >= 2 {
+		m.PeakActiveUsers = int(d.varint())
+	}
+
+	if version >= 3 {
+		sketch := &LatencySketch{Zero: d.float()}
+		count := d.length()
+		index := int64(0)
+		for i := 0; i < count && d.err == nil; i++ {
+			index += d.varint()
+			if index < int64(latencySketchMinIndex) || index > int64(latencySketchMaxIndex) {
+				d.err = fmt.Errorf("latency bucket %d out of range", index)
+				break
+			}
+			count := d.float()
+			if !validLatencyCount(count) {
+				d.err = fmt.Errorf("invalid count %v in latency bucket %d", count, index)
+				break
+			}
+			sketch.AddBucket(int32(index), count)
+		}
+		if d.err == nil && sketch.Count() > 0 {
+			m.LatencySketch = sketch
+			m.Latency = sketch.Percentiles()
+		}
+	}
+
+	if d.err == nil && len(d.data) != 0 {
+		d.err = fmt.Errorf("%d trailing bytes in tick record", len(d.data))
+	}
+	return m, d.err
+}
+
+// Метка времени тика без полного декодирования, используется при построении индекса
+func tickTimestamp(data []byte) (int64, error) {
+	d := tickDecoder{data: data}
+	d.byte()
+	ts := d.varint()
+	return ts, d.err
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], v)]...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func appendFloat(buf []byte, v float64) []byte {
+	return appendUint64(buf, math.Float64bits(v))
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendIntMap(buf []byte, values map[string]int) []byte {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buf = appendUvarint(buf, uint64(len(keys)))
+	for _, key := range keys {
+		buf = appendString(buf, key)
+		buf = appendVarint(buf, int64(values[key]))
+	}
+	return buf
+}
+
+// Последовательное чтение полей тика. Первая ошибка запоминается,
+// дальнейшие чтения возвращают нулевые значения
+type tickDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *tickDecoder) fail() {
+	if d.err == nil {
+		d.err = errTruncatedTick
+	}
+	d.data = nil
+}
+
+func (d *tickDecoder) byte() byte {
+	if len(d.data) < 1 {
+		d.fail()
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *tickDecoder) varint() int64 {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *tickDecoder) length() int {
+	v, n := binary.Uvarint(d.data)
+	// Каждый элемент занимает хотя бы байт, большее значение означает поврежденную запись
+	if n <= 0 || v > uint64(len(d.data)) {
+		d.fail()
+		return 0
+	}
+	d.data = d.data[n:]
+	return int(v)
+}
+
+func (d *tickDecoder) float() float64 {
+	if len(d.data) < 8 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.data)
+	d.data = d.data[8:]
+	return math.Float64frombits(v)
+}
+
+func (d *tickDecoder) string() string {
+	n := d.length()
+	if n > len(d.data) {
+		d.fail()
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+func (d *tickDecoder) intMap() map[string]int {
+	count := d.length()
+	values := make(map[string]int, count)
+	for i := 0; i < count && d.err == nil; i++ {
+		key := d.string()
+		values[key] = int(d.varint())
+	}
+	return values
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestTickCodecPeakActiveUsers(t *testing.T) {
+	tick := testTick(1700000000)
+	tick.PeakActiveUsers = 1500
+
+	decoded, err := decodeTick(encodeTick(nil, &tick))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.PeakActiveUsers != 1500 || decoded.ActiveUsers != tick.ActiveUsers || decoded.Sales != tick.Sales {
+		t.Fatalf("decoded %+v", decoded)
+	}
+	if decoded.LatencySketch == nil || decoded.LatencySketch.Count() != tick.LatencySketch.Count() {
+		t.Fatal("latency sketch lost")
+	}
+}
+
+// Записи прежних версий читаются без полей, добавленных позже
+func TestTickCodecReadsOlderVersions(t *testing.T) {
+	tick := testTick(1700000000)
+	tick.PeakActiveUsers = 1500
+	tick.LatencySketch = nil
+	record := encodeTick(nil, &tick)
+	record = record[:len(record)-9] // Пустой скетч: нулевая корзина и число корзин
+	record[0] = 2
+
+	decoded, err := decodeTick(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.PeakActiveUsers != 1500 || decoded.LatencySketch != nil || decoded.Timestamp != tick.Timestamp {
+		t.Fatalf("version 2 decoded as %+v", decoded)
+	}
+
+	record = record[:len(record)-2] // Пик 1500 занимает два байта
+	record[0] = 1
+	decoded, err = decodeTick(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.PeakActiveUsers != 0 || decoded.Sales != tick.Sales || decoded.Timestamp != tick.Timestamp {
+		t.Fatalf("version 1 decoded as %+v", decoded)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Уровни хранения истории: сырые тики и сводки с более грубым разрешением.
+// Фоновый компактор сворачивает закрытые интервалы каждого уровня в следующий
+// и удаляет данные старше срока хранения уровня
+const defaultRetention = "raw=6h,1m=7d,1h=90d,1d=2y"
+
+// Через сколько после конца интервала сырые тики считаются полными
+const compactionGrace = 5 * time.Second
+
+// Разрешение и срок хранения уровня
+type TierConfig struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+// Разбор конфигурации уровней вида "raw=6h,1m=7d,1h=90d,1d=2y".
+// Первый уровень - сырые тики, разрешение каждого следующего кратно предыдущему
+func parseRetention(spec string) ([]TierConfig, error) {
+	var configs []TierConfig
+	for _, item := range strings.Split(spec, ",") {
+		name, value := item, ""
+		if idx := strings.Index(item, "="); idx >= 0 {
+			name, value = strings.TrimSpace(item[:idx]), strings.TrimSpace(item[idx+1:])
+		}
+
+		retention, err := parseLongDuration(value)
+		if err != nil || retention <= 0 {
+			return nil, fmt.Errorf("invalid retention for tier %q: %q", name, value)
+		}
+
+		resolution := tickInterval
+		if name != "raw" {
+			if resolution, err = parseLongDuration(name); err != nil {
+				return nil, fmt.Errorf("invalid tier resolution: %q", name)
+			}
+		}
+		configs = append(configs, TierConfig{Resolution: resolution, Retention: retention})
+	}
+
+	if len(configs) == 0 || configs[0].Resolution != tickInterval {
+		return nil, fmt.Errorf("the first tier must be raw ticks")
+	}
+	for i := 1; i < len(configs); i++ {
+		prev, cur := configs[i-1].Resolution, configs[i].Resolution
+		if cur <= prev || cur%prev != 0 {
+			return nil, fmt.Errorf("tier resolution %v must be a multiple of %v", cur, prev)
+		}
+		if cur > 24*time.Hour || (24*time.Hour)%cur != 0 {
+			return nil, fmt.Errorf("tier resolution %v must divide a day", cur)
+		}
+	}
+	return configs, nil
+}
+
+// Длительность в формате time.ParseDuration или целым числом с суффиксом d, w или y
+func parseLongDuration(value string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "y": 365 * 24 * time.Hour}
+	if len(value) > 1 {
+		if unit, ok := units[value[len(value)-1:]]; ok {
+			n, err := strconv.Atoi(value[:len(value)-1])
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return time.ParseDuration(value)
+}
+
+// Короткое имя разрешения: 1m, 1h, 1d
+func resolutionName(resolution time.Duration) string {
+	switch {
+	case resolution == tickInterval:
+		return "raw"
+	case resolution%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", resolution/(24*time.Hour))
+	case resolution%time.Hour == 0:
+		return fmt.Sprintf("%dh", resolution/time.Hour)
+	case resolution%time.Minute == 0:
+		return fmt.Sprintf("%dm", resolution/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", resolution/time.Second)
+	}
+}
+
+// Начало интервала разрешения resolution, в который попадает ts.
+// Сутки выравниваются по местной полуночи, как и исторические данные генератора
+func bucketStart(ts int64, resolution time.Duration) int64 {
+	if resolution == 24*time.Hour {
+		t := time.Unix(ts, 0)
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).Unix()
+	}
+	seconds := int64(resolution / time.Second)
+	return ts - ((ts%seconds)+seconds)%seconds
+}
+
+// Начало следующего интервала
+func bucketEnd(ts int64, resolution time.Duration) int64 {
+	start := bucketStart(ts, resolution)
+	if resolution == 24*time.Hour {
+		t := time.Unix(start, 0)
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Unix()
+	}
+	return start + int64(resolution/time.Second)
+}
+
+// Уровень хранения
+type storeTier struct {
+	TierConfig
+	name      string
+	store     MetricsStore
+	watermark int64 // Конец последнего свернутого в этот уровень интервала, 0 - сводок еще нет
+}
+
+// Хранилище с уровнями разрешения. Как MetricsStore работает с сырыми тиками,
+// сводки читаются через Buckets
+type TieredStore struct {
+	mu        sync.RWMutex // Защищает watermark уровней
+	compactMu sync.Mutex
+	tiers     []*storeTier
+}
+
+// Открытие всех уровней. Сырые тики лежат в корне каталога, сводки - в подкаталогах по имени разрешения
+func openTieredStore(kind, dir string, configs []TierConfig) (*TieredStore, error) {
+	t := &TieredStore{}
+	for i, config := range configs {
+		name := resolutionName(config.Resolution)
+		tierDir := dir
+		if i > 0 {
+			tierDir = filepath.Join(dir, name)
+		}
+
+		// Сегменты удаляются целиком, поэтому делаем их заметно короче срока хранения
+		segmentDuration := config.Retention / 8
+		if segmentDuration < time.Hour {
+			segmentDuration = time.Hour
+		}
+
+		store, err := openMetricsStore(kind, tierDir, segmentStoreOptions{SegmentDuration: segmentDuration})
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("opening %s tier: %w", name, err)
+		}
+
+		tier := &storeTier{TierConfig: config, name: name, store: store}
+		if _, last, ok := store.Bounds(); ok && i > 0 {
+			tier.watermark = bucketEnd(last, config.Resolution)
+		}
+		t.tiers = append(t.tiers, tier)
+	}
+	return t, nil
+}
+
+func (t *TieredStore) raw() MetricsStore {
+	return t.tiers[0].store
+}
+
+func (t *TieredStore) Append(metrics MetricsData) error {
+	return t.raw().Append(metrics)
+}
+
+func (t *TieredStore) Range(from, to int64, fn func(metrics MetricsData) bool) error {
+	return t.raw().Range(from, to, fn)
+}
+
+// Границы данных по всем уровням: после долгого простоя сырых тиков может уже не быть
+func (t *TieredStore) Bounds() (int64, int64, bool) {
+	var first, last int64
+	found := false
+	for _, tier := range t.tiers {
+		tierFirst, tierLast, ok := tier.store.Bounds()
+		if !ok {
+			continue
+		}
+		if !found || tierFirst < first {
+			first = tierFirst
+		}
+		if !found || tierLast > last {
+			last = tierLast
+		}
+		found = true
+	}
+	return first, last, found
+}
+
+func (t *TieredStore) DeleteBefore(before int64) error {
+	for _, tier := range t.tiers {
+		if err := tier.store.DeleteBefore(before); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TieredStore) Close() error {
+	var firstErr error
+	for _, tier := range t.tiers {
+		if err := tier.store.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (t *TieredStore) watermarkOf(tier *storeTier) int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return tier.watermark
+}
+
+// Разрешения уровней по возрастанию
+func (t *TieredStore) Resolutions() []time.Duration {
+	resolutions := make([]time.Duration, len(t.tiers))
+	for i, tier := range t.tiers {
+		resolutions[i] = tier.Resolution
+	}
+	return resolutions
+}
+
+// Самый грубый уровень, разрешение которого укладывается в resolution целое число раз.
+// У него же самый долгий срок хранения среди подходящих
+func (t *TieredStore) pickTier(resolution time.Duration) int {
+	best := 0
+	for i, tier := range t.tiers {
+		if tier.Resolution <= resolution && resolution%tier.Resolution == 0 {
+			best = i
+		}
+	}
+	return best
+}
+
+// Сводки с разрешением resolution за интервалы, начинающиеся в [from, to), по возрастанию времени.
+// Данные берутся из самого грубого подходящего уровня, а еще не свернутый хвост -
+// из более мелких уровней, вплоть до сырых тиков, поэтому текущий интервал тоже попадает в ответ.
+// Записи разных уровней входят в сводку с весом своего разрешения
+func (t *TieredStore) Buckets(resolution time.Duration, from, to int64) ([]*Rollup, error) {
+	rollups := make(map[int64]*Rollup)
+
+	lower := from
+	for i := t.pickTier(resolution); i >= 0 && lower < to; i-- {
+		tier := t.tiers[i]
+		upper := to
+		if i > 0 {
+			if watermark := t.watermarkOf(tier); watermark < upper {
+				upper = watermark
+			}
+		}
+		if upper <= lower {
+			continue
+		}
+
+		weight := tier.Resolution.Seconds()
+		err := tier.store.Range(lower, upper, func(metrics MetricsData) bool {
+			start := bucketStart(metrics.Timestamp, resolution)
+			rollup := rollups[start]
+			if rollup == nil {
+				rollup = newRollup(start)
+				rollups[start] = rollup
+			}
+			rollup.Add(metrics, weight)
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading %s tier: %w", tier.name, err)
+		}
+		lower = upper
+	}
+
+	result := make([]*Rollup, 0, len(rollups))
+	for _, rollup := range rollups {
+		result = append(result, rollup)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Start < result[j].Start })
+	return result, nil
+}
+
+// Заполнение истории за [from, end) готовыми записями в обход сырых тиков. Записи пишутся
+// в самый грубый уровень, разрешение которого укладывается в resolution, по одной на интервал
+// уровня: record(start, seconds) возвращает запись за [start, start+seconds), где счетчики
+// просуммированы за весь интервал. Уровень после этого считается свернутым до end
+func (t *TieredStore) Backfill(resolution time.Duration, from, end int64, record func(start int64, seconds float64) MetricsData) error {
+	t.compactMu.Lock()
+	defer t.compactMu.Unlock()
+
+	i := t.pickTier(resolution)
+	tier := t.tiers[i]
+	for start := bucketStart(from, tier.Resolution); start < end; start = bucketEnd(start, tier.Resolution) {
+		metrics := record(start, tier.Resolution.Seconds())
+		metrics.Timestamp = start
+		if err := tier.store.Append(metrics); err != nil {
+			return fmt.Errorf("backfilling %s tier: %w", tier.name, err)
+		}
+	}
+
+	if i > 0 {
+		t.mu.Lock()
+		if end > tier.watermark {
+			tier.watermark = end
+		}
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+// Сворачивание закрытых интервалов каждого уровня в следующий. Возвращает число записанных сводок
+func (t *TieredStore) Compact(now time.Time) (int, error) {
+	t.compactMu.Lock()
+	defer t.compactMu.Unlock()
+
+	written := 0
+	sourceEnd := now.Add(-compactionGrace).Unix()
+	for i := 1; i < len(t.tiers); i++ {
+		tier, source := t.tiers[i], t.tiers[i-1]
+
+		// Сворачиваем только интервалы, полностью закрытые в исходном уровне
+		end := bucketStart(sourceEnd, tier.Resolution)
+		from := t.watermarkOf(tier)
+		if from == 0 {
+			first, _, ok := source.store.Bounds()
+			if !ok {
+				sourceEnd = math.MinInt64
+				continue
+			}
+			from = bucketStart(first, tier.Resolution)
+		}
+
+		if from < end {
+			n, err := t.compactRange(source, tier, from, end)
+			written += n
+			if err != nil {
+				return written, fmt.Errorf("compacting %s tier: %w", tier.name, err)
+			}
+
+			t.mu.Lock()
+			tier.watermark = end
+			t.mu.Unlock()
+		}
+		sourceEnd = t.watermarkOf(tier)
+	}
+	return written, nil
+}
+
+func (t *TieredStore) compactRange(source, tier *storeTier, from, end int64) (int, error) {
+	written := 0
+	weight := source.Resolution.Seconds()
+	var rollup *Rollup
+	var appendErr error
+
+	flush := func() {
+		if rollup == nil || appendErr != nil {
+			return
+		}
+		if appendErr = tier.store.Append(rollup.Metrics()); appendErr == nil {
+			written++
+		}
+		rollup = nil
+	}
+
+	err := source.store.Range(from, end, func(metrics MetricsData) bool {
+		if start := bucketStart(metrics.Timestamp, tier.Resolution); rollup == nil || start != rollup.Start {
+			flush()
+			rollup = newRollup(start)
+		}
+		rollup.Add(metrics, weight)
+		return appendErr == nil
+	})
+	flush()
+
+	if err != nil {
+		return written, err
+	}
+	return written, appendErr
+}
+
+// Удаление данных старше срока хранения. Данные, еще не свернутые в следующий уровень, не удаляются
+func (t *TieredStore) Evict(now time.Time) error {
+	for i, tier := range t.tiers {
+		cutoff := now.Add(-tier.Retention).Unix()
+		if i+1 < len(t.tiers) {
+			if watermark := t.watermarkOf(t.tiers[i+1]); watermark < cutoff {
+				cutoff = watermark
+			}
+		}
+		if err := tier.store.DeleteBefore(cutoff); err != nil {
+			return fmt.Errorf("evicting %s tier: %w", tier.name, err)
+		}
+	}
+	return nil
+}
+
+// Фоновая компактизация и очистка. Первый проход выполняется сразу,
+// чтобы догнать данные, накопленные до перезапуска
+func (t *TieredStore) RunCompactor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		if _, err := t.Compact(now); err != nil {
+			log.Printf("Error compacting metrics store: %v", err)
+		}
+		if err := t.Evict(now); err != nil {
+			log.Printf("Error evicting old metrics: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
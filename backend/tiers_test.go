@@ -0,0 +1,194 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func newTestTieredStore(t *testing.T) *TieredStore {
+	t.Helper()
+	retention, err := parseRetention(defaultRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := openTieredStore("memory", "", retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// Тик с постоянными значениями: счетчики за секунду
+func testTick(ts int64) MetricsData {
+	sketch := &LatencySketch{}
+	sketch.AddN(120, 40)
+	return MetricsData{
+		Timestamp:         ts,
+		ActiveUsers:       1000,
+		RequestsPerSecond: 40,
+		ResponseTimeMs:    120,
+		Sales:             3,
+		ErrorsByType:      map[string]int{"Server Error": 1},
+		RegionalData: map[string]Region{
+			"Москва": {ActiveUsers: 600, Sales: 2},
+			"Казань": {ActiveUsers: 400, Sales: 1},
+		},
+		LatencySketch: sketch,
+	}
+}
+
+// Заполненный час должен совпадать с часом, собранным из живых тиков с теми же значениями,
+// а не отличаться в число тиков за час
+func TestBackfillHourMatchesLiveHour(t *testing.T) {
+	store := newTestTieredStore(t)
+	live := bucketStart(time.Now().Unix(), time.Hour)
+
+	err := store.Backfill(time.Hour, live-3600, live, func(start int64, seconds float64) MetricsData {
+		return scaleCounters(testTick(start), seconds)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ts := live; ts < live+3600; ts++ {
+		if err := store.Append(testTick(ts)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rollups, err := store.Buckets(time.Hour, live-3600, live+3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rollups) != 2 || rollups[0].Start != live-3600 || rollups[1].Start != live {
+		t.Fatalf("expected the backfilled and the live hour, got %d rollups", len(rollups))
+	}
+	if rollups[0].Duration != rollups[1].Duration {
+		t.Fatalf("hour durations: backfilled %v, live %v", rollups[0].Duration, rollups[1].Duration)
+	}
+
+	backfilled, current := rollups[0].Metrics(), rollups[1].Metrics()
+	if backfilled.Sales != current.Sales || current.Sales != 3*3600 {
+		t.Fatalf("sales: backfilled %d, live %d", backfilled.Sales, current.Sales)
+	}
+	if backfilled.ErrorsByType["Server Error"] != current.ErrorsByType["Server Error"] {
+		t.Fatalf("errors: backfilled %v, live %v", backfilled.ErrorsByType, current.ErrorsByType)
+	}
+	for name, region := range current.RegionalData {
+		if backfilled.RegionalData[name].Sales != region.Sales {
+			t.Fatalf("%s sales: backfilled %d, live %d", name, backfilled.RegionalData[name].Sales, region.Sales)
+		}
+	}
+	if backfilled.ActiveUsers != current.ActiveUsers {
+		t.Fatalf("active users: backfilled %d, live %d", backfilled.ActiveUsers, current.ActiveUsers)
+	}
+	if a, b := rollups[0].latency.Count(), rollups[1].latency.Count(); a != b {
+		t.Fatalf("requests: backfilled %v, live %v", a, b)
+	}
+}
+
+// Генератор заполняет только закрытые часы и только уровень почасовых сводок
+func TestGeneratorBackfillWritesHourTier(t *testing.T) {
+	store := newTestTieredStore(t)
+	generator := NewCoherentDataGenerator(store)
+	generator.source = newGeneratorSource(1)
+	generator.rng = rand.New(generator.source)
+
+	now := time.Now()
+	if err := generator.Backfill(now); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := store.raw().Bounds(); ok {
+		t.Fatal("backfill wrote raw ticks")
+	}
+
+	hourTier := store.tiers[store.pickTier(time.Hour)]
+	first, last, ok := hourTier.store.Bounds()
+	if !ok {
+		t.Fatal("backfill wrote nothing to the hour tier")
+	}
+	current := bucketStart(now.Unix(), time.Hour)
+	if last != current-3600 || first != bucketEnd(generator.baseDataTime.Unix(), time.Hour) {
+		t.Fatalf("backfilled hours %d..%d, current hour %d", first, last, current)
+	}
+}
+
+// Уровень, в который записана история, считается свернутым до ее конца, и компактор
+// не пересобирает эти часы из пустых мелких уровней
+func TestBackfillAdvancesWatermark(t *testing.T) {
+	store := newTestTieredStore(t)
+	end := bucketStart(time.Now().Unix(), time.Hour)
+	from := end - 24*3600
+
+	err := store.Backfill(time.Hour, from, end, func(start int64, seconds float64) MetricsData {
+		return MetricsData{ActiveUsers: 100, Sales: int(seconds)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hourTier := store.tiers[store.pickTier(time.Hour)]
+	if hourTier.Resolution != time.Hour {
+		t.Fatalf("backfill tier resolution %v", hourTier.Resolution)
+	}
+	if watermark := store.watermarkOf(hourTier); watermark != end {
+		t.Fatalf("watermark %d, want %d", watermark, end)
+	}
+
+	if _, err := store.Compact(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	rollups, err := store.Buckets(time.Hour, from, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rollups) != 24 {
+		t.Fatalf("expected 24 hours, got %d", len(rollups))
+	}
+	for _, rollup := range rollups {
+		if metrics := rollup.Metrics(); metrics.Sales != 3600 || rollup.Records != 1 {
+			t.Fatalf("hour %d: sales %d from %d records", rollup.Start, metrics.Sales, rollup.Records)
+		}
+	}
+}
+
+// Пик пользователей переживает сворачивание в минутный, часовой и суточный уровни,
+// а не заменяется средним за период
+func TestCompactionKeepsPeakActiveUsers(t *testing.T) {
+	store := newTestTieredStore(t)
+	hour := bucketStart(time.Now().Add(-48*time.Hour).Unix(), time.Hour)
+	for ts := hour; ts < hour+3600; ts++ {
+		tick := testTick(ts)
+		tick.ActiveUsers = 100
+		if ts == hour+1234 {
+			tick.ActiveUsers = 900
+		}
+		if err := store.Append(tick); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Compact(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, resolution := range []time.Duration{time.Minute, time.Hour, 24 * time.Hour} {
+		tier := store.tiers[store.pickTier(resolution)]
+		if tier.Resolution != resolution || store.watermarkOf(tier) <= hour {
+			t.Fatalf("%s tier is not compacted", resolutionName(resolution))
+		}
+		rollups, err := store.Buckets(resolution, bucketStart(hour, resolution), hour+3600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peak := 0
+		for _, rollup := range rollups {
+			if rollup.PeakActiveUsers > peak {
+				peak = rollup.PeakActiveUsers
+			}
+		}
+		if peak != 900 {
+			t.Fatalf("%s tier: peak %d, want 900", resolutionName(resolution), peak)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+// Агрегатор метрик за окно из нескольких тиков. Окна выровнены по часам:
+// окно 15s охватывает секунды :00-:14, :15-:29 и т.д., поэтому инстансы
+// и клиенты видят одинаковые границы окон
+type windowAggregator struct {
+	seconds int64         // Длина окна в секундах
+	start   int64         // Начало текущего окна (unix)
+	ticks   []MetricsData // Тики текущего окна
+}
+
+func newWindowAggregator(seconds int64) *windowAggregator {
+	return &windowAggregator{seconds: seconds}
+}
+
+// Добавление тика. Возвращает агрегаты закрывшихся окон: окно закрывается
+// на последней секунде или при переходе тика в следующее окно, если последняя секунда пропущена
+func (w *windowAggregator) Add(metrics MetricsData) []MetricsData {
+	var closed []MetricsData
+
+	start := metrics.Timestamp - metrics.Timestamp%w.seconds
+	if len(w.ticks) > 0 {
+		if start < w.start {
+			// Запоздавший тик учитываем в текущем окне
+			start = w.start
+		} else if start != w.start {
+			closed = append(closed, aggregateWindow(w.ticks))
+			w.ticks = w.ticks[:0]
+		}
+	}
+
+	w.start = start
+	w.ticks = append(w.ticks, metrics)
+
+	if metrics.Timestamp >= start+w.seconds-1 {
+		closed = append(closed, aggregateWindow(w.ticks))
+		w.ticks = w.ticks[:0]
+	}
+	return closed
+}
+
+// Сводка метрик окна, все тики входят с равным весом. Исторические данные и метка
+// времени берутся из последнего тика окна
+func aggregateWindow(ticks []MetricsData) MetricsData {
+	rollup := newRollup(0)
+	for _, m := range ticks {
+		rollup.Add(m, 1)
+	}
+
+	last := ticks[len(ticks)-1]
+	result := rollup.Metrics()
+	result.Timestamp = last.Timestamp
+	result.HistoricalData = last.HistoricalData
+	return result
+}
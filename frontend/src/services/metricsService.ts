@@ -1,6 +1,7 @@
 import { ref, reactive, onUnmounted } from 'vue';
 import dayjs from 'dayjs';
 import { PeriodType } from './timePeriodService';
+import { decodeMsgpack } from './msgpack';
 
 // Интерфейс для региональных данных
 export interface RegionData {
@@ -18,12 +19,22 @@ export interface ConversionFunnel {
   purchasedItems: number;
 }
 
+// Перцентили времени ответа, мс
+export interface LatencyPercentiles {
+  p50: number;
+  p90: number;
+  p95: number;
+  p99: number;
+}
+
 // Интерфейс для исторических метрик
 export interface HistoricalMetrics {
   activeUsers: number;
+  peakActiveUsers?: number;
   sales: number;
   conversionRate: number;
   responseTimeMs: number;
+  latency?: LatencyPercentiles;
 }
 
 // Интерфейс для исторических данных
@@ -39,6 +50,7 @@ export interface Metrics {
   activeUsers: number;
   requestsPerSecond: number;
   responseTimeMs: number;
+  latency?: LatencyPercentiles;
   conversionRate: number;
   sales: number;
   errorRate: number;
@@ -165,6 +177,10 @@ export const metrics = reactive<Metrics>({...defaultMetrics});
 let ws: WebSocket | null = null;
 let reconnectTimeout: number | null = null;
 
+// Позиция последнего полученного кадра вида <эпоха>:<интервал>:<seq>: при переподключении
+// сервер досылает пропущенные кадры того же потока
+let lastPosition: string | null = null;
+
 // Состояние подключения
 export const connectionState = reactive({
   isConnected: false,
@@ -256,6 +272,43 @@ export const fetchHistoricalData = async (period: string, metric: string): Promi
   }
 };
 
+// Серия исторических значений на общей оси времени
+export interface HistorySeries {
+  metric: string;
+  dimension?: 'region' | 'source' | 'errorType' | 'funnelStage';
+  key?: string;
+  values: (number | null)[];
+}
+
+export interface HistoryResult {
+  step: number;
+  timestamps: number[];
+  series: HistorySeries[];
+}
+
+// Несколько метрик и их разложения (регионы, источники, типы ошибок, этапы воронки) одним запросом
+export const fetchHistoricalSeries = async (
+  period: string,
+  metrics: string[],
+  dimensions: string[] = [],
+  params: Record<string, string> = {}
+): Promise<HistoryResult | null> => {
+  try {
+    const query = new URLSearchParams({ ...params, metrics: metrics.join(',') });
+    if (dimensions.length > 0) {
+      query.set('dimensions', dimensions.join(','));
+    }
+    const response = await fetch(`http://localhost:8080/metrics/historical/${period}?${query}`);
+    if (!response.ok) {
+      throw new Error(`HTTP error! status: ${response.status}`);
+    }
+    return await response.json();
+  } catch (error) {
+    console.error('Ошибка при получении исторических серий:', error);
+    return null;
+  }
+};
+
 // Получение текущих метрик по REST API (для аутентифицированных пользователей)
 export const fetchCurrentMetrics = async (): Promise<Metrics | null> => {
   try {
@@ -279,7 +332,10 @@ export const connectWebSocket = () => {
   connectionState.reconnecting = true;
   
   try {
-    ws = new WebSocket('ws://localhost:8080/ws');
+    const url = lastPosition !== null ? `ws://localhost:8080/ws?since=${lastPosition}` : 'ws://localhost:8080/ws';
+    // Бинарные кадры MessagePack компактнее JSON; сервер без их поддержки выберет JSON
+    ws = new WebSocket(url, ['dashboard.msgpack.v1', 'dashboard.json.v1']);
+    ws.binaryType = 'arraybuffer';
     
     ws.onopen = () => {
       connectionState.isConnected = true;
@@ -289,7 +345,19 @@ export const connectWebSocket = () => {
     };
     
     ws.onmessage = (event) => {
-      const newMetrics: Metrics = JSON.parse(event.data);
+      const message = typeof event.data === 'string'
+        ? JSON.parse(event.data)
+        : decodeMsgpack(event.data as ArrayBuffer) as Record<string, any>;
+
+      // Управляющие ответы сервера не содержат метрик
+      if (message.type !== undefined && message.type !== 'snapshot') {
+        return;
+      }
+      if (typeof message.seq === 'number') {
+        lastPosition = `${message.epoch}:${message.interval}:${message.seq}`;
+      }
+
+      const newMetrics: Metrics = message;
       
       // Применяем сглаживание данных только для числовых полей верхнего уровня
       const smoothedMetrics = smoothData(newMetrics);
@@ -0,0 +1,148 @@
+// Декодер MessagePack для бинарных кадров подпротокола dashboard.msgpack.v1.
+// Поддерживает все типы, которые формирует сервер: nil, bool, целые до 64 бит,
+// float32/64, строки, бинарные данные, массивы и карты со строковыми ключами.
+// 64-битные целые переводятся в number, как и при разборе JSON-кадра
+
+const textDecoder = new TextDecoder();
+
+class MsgpackReader {
+  private view: DataView;
+  private bytes: Uint8Array;
+  private pos = 0;
+
+  constructor(buffer: ArrayBuffer) {
+    this.view = new DataView(buffer);
+    this.bytes = new Uint8Array(buffer);
+  }
+
+  get done(): boolean {
+    return this.pos >= this.bytes.length;
+  }
+
+  private need(n: number) {
+    if (this.pos + n > this.bytes.length) {
+      throw new Error('msgpack: unexpected end of data');
+    }
+  }
+
+  private uint8(): number {
+    this.need(1);
+    return this.view.getUint8(this.pos++);
+  }
+
+  private uint16(): number {
+    this.need(2);
+    const value = this.view.getUint16(this.pos);
+    this.pos += 2;
+    return value;
+  }
+
+  private uint32(): number {
+    this.need(4);
+    const value = this.view.getUint32(this.pos);
+    this.pos += 4;
+    return value;
+  }
+
+  private uint64(): number {
+    this.need(8);
+    const value = Number(this.view.getBigUint64(this.pos));
+    this.pos += 8;
+    return value;
+  }
+
+  private int64(): number {
+    this.need(8);
+    const value = Number(this.view.getBigInt64(this.pos));
+    this.pos += 8;
+    return value;
+  }
+
+  private string(length: number): string {
+    this.need(length);
+    const value = textDecoder.decode(this.bytes.subarray(this.pos, this.pos + length));
+    this.pos += length;
+    return value;
+  }
+
+  private binary(length: number): Uint8Array {
+    this.need(length);
+    const value = this.bytes.slice(this.pos, this.pos + length);
+    this.pos += length;
+    return value;
+  }
+
+  private array(length: number): unknown[] {
+    const result = new Array(length);
+    for (let i = 0; i < length; i++) {
+      result[i] = this.read();
+    }
+    return result;
+  }
+
+  private map(length: number): Record<string, unknown> {
+    const result: Record<string, unknown> = {};
+    for (let i = 0; i < length; i++) {
+      const key = this.read();
+      result[String(key)] = this.read();
+    }
+    return result;
+  }
+
+  read(): unknown {
+    const type = this.uint8();
+
+    if (type <= 0x7f) return type;
+    if (type >= 0xe0) return type - 0x100;
+    if ((type & 0xf0) === 0x80) return this.map(type & 0x0f);
+    if ((type & 0xf0) === 0x90) return this.array(type & 0x0f);
+    if ((type & 0xe0) === 0xa0) return this.string(type & 0x1f);
+
+    switch (type) {
+      case 0xc0: return null;
+      case 0xc2: return false;
+      case 0xc3: return true;
+      case 0xc4: return this.binary(this.uint8());
+      case 0xc5: return this.binary(this.uint16());
+      case 0xc6: return this.binary(this.uint32());
+      case 0xca: {
+        this.need(4);
+        const value = this.view.getFloat32(this.pos);
+        this.pos += 4;
+        return value;
+      }
+      case 0xcb: {
+        this.need(8);
+        const value = this.view.getFloat64(this.pos);
+        this.pos += 8;
+        return value;
+      }
+      case 0xcc: return this.uint8();
+      case 0xcd: return this.uint16();
+      case 0xce: return this.uint32();
+      case 0xcf: return this.uint64();
+      case 0xd0: return (this.uint8() << 24) >> 24;
+      case 0xd1: return (this.uint16() << 16) >> 16;
+      case 0xd2: return this.uint32() | 0;
+      case 0xd3: return this.int64();
+      case 0xd9: return this.string(this.uint8());
+      case 0xda: return this.string(this.uint16());
+      case 0xdb: return this.string(this.uint32());
+      case 0xdc: return this.array(this.uint16());
+      case 0xdd: return this.array(this.uint32());
+      case 0xde: return this.map(this.uint16());
+      case 0xdf: return this.map(this.uint32());
+    }
+    throw new Error(`msgpack: unsupported type 0x${type.toString(16)}`);
+  }
+}
+
+// Разбор одного значения, занимающего буфер целиком
+export const decodeMsgpack = (buffer: ArrayBuffer): unknown => {
+  const reader = new MsgpackReader(buffer);
+  const value = reader.read();
+  if (!reader.done) {
+    throw new Error('msgpack: trailing data after value');
+  }
+  return value;
+};